@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/httpclient"
+	"github.com/KNN3-Network/oauth-server/module"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"go.uber.org/zap"
+)
+
+// 把以 login 绑定的 github 账号回填为数字 id:
+//
+//	go run ./cmd/backfill-github -dry-run
+//	GITHUB_API_TOKEN=... go run ./cmd/backfill-github
+func main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "配置文件, 支持 .yaml/.yml/.toml")
+	dryRun := flag.Bool("dry-run", false, "只查询 github, 不修改数据库")
+	flag.Parse()
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	utils.Logger = utils.NewLogger("logger.log")
+
+	store, db, err := utils.OpenStore(cfg.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if db == nil {
+		log.Fatal("DB_DRIVER memory has nothing to backfill")
+	}
+	github := module.NewGithub(cfg, httpclient.New(cfg.HTTP, utils.Logger).HTTPClient(), utils.Logger)
+
+	result, err := module.BackfillGithubIDs(context.Background(), store, github, *dryRun, utils.Logger)
+	utils.Logger.Info("backfill github ids", zap.Int("scanned", result.Scanned), zap.Int("updated", result.Updated),
+		zap.Int("not_found", result.NotFound), zap.Int("conflicts", result.Conflicts), zap.Bool("dry_run", *dryRun))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/module"
+	"github.com/KNN3-Network/oauth-server/utils"
+)
+
+// 注册使用 "Login with KNN3" 的第三方应用, client_secret 只显示一次:
+//
+//	go run ./cmd/client -name demo -redirect-uri https://demo.example/callback
+//	go run ./cmd/client -name demo-spa -redirect-uri https://demo.example/callback -public
+//	go run ./cmd/client -name api -resource-server
+func main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "配置文件, 支持 .yaml/.yml/.toml")
+	name := flag.String("name", "", "应用名称, 展示在授权页面")
+	redirectURIs := flag.String("redirect-uri", "", "允许的 redirect_uri, 多个以逗号分隔, 完整匹配")
+	public := flag.Bool("public", false, "公开客户端 (浏览器或移动端), 没有 client_secret, 必须使用 PKCE")
+	resourceServer := flag.Bool("resource-server", false, "下游服务, 用 /oauth/introspect 校验任意 token, 不需要 redirect_uri")
+	flag.Parse()
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	utils.Logger = utils.NewLogger("logger.log")
+
+	store, db, err := utils.OpenStore(cfg.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if db == nil {
+		log.Fatal("DB_DRIVER memory can not persist clients")
+	}
+	var uris []string
+	for _, uri := range strings.Split(*redirectURIs, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	var client *utils.OAuthClient
+	var secret string
+	if *resourceServer {
+		client, secret, err = module.RegisterResourceServer(context.Background(), store, *name)
+	} else {
+		client, secret, err = module.RegisterClient(context.Background(), store, *name, uris, *public)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("client_id:", client.ClientID)
+	if secret != "" {
+		fmt.Println("client_secret:", secret)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/utils"
+)
+
+// 把 oauth_bind 迁移到 linked_identity, 并建立刷新令牌、撤销列表、第三方应用、授权码和用户授权的表:
+//
+//	go run ./cmd/migrate
+func main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "配置文件, 支持 .yaml/.yml/.toml")
+	flag.Parse()
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	utils.Logger = utils.NewLogger("logger.log")
+
+	_, db, err := utils.OpenStore(cfg.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if db == nil {
+		log.Fatal("DB_DRIVER memory has nothing to migrate")
+	}
+	if err := utils.MigrateLinkedIdentity(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := utils.MigrateSessions(db); err != nil {
+		log.Fatal(err)
+	}
+	utils.Logger.Info("migrate linked_identity done")
+}
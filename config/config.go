@@ -0,0 +1,534 @@
+package config
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config 服务的全部配置. 先取默认值, 再读取配置文件, 最后用环境变量 (env tag) 覆盖
+type Config struct {
+	Server        ServerConfig        `yaml:"server" toml:"server"`
+	DB            DBConfig            `yaml:"db" toml:"db"`
+	OAuth         OAuthConfig         `yaml:"oauth" toml:"oauth"`
+	Github        GithubConfig        `yaml:"github" toml:"github"`
+	Discord       DiscordConfig       `yaml:"discord" toml:"discord"`
+	Gmail         GmailConfig         `yaml:"gmail" toml:"gmail"`
+	Knexus        KnexusConfig        `yaml:"knexus" toml:"knexus"`
+	Stackoverflow StackoverflowConfig `yaml:"stackoverflow" toml:"stackoverflow"`
+	JWT           JWTConfig           `yaml:"jwt" toml:"jwt"`
+	HTTP          HTTPConfig          `yaml:"http" toml:"http"`
+	Login         LoginConfig         `yaml:"login" toml:"login"`
+	OIDC          OIDCConfig          `yaml:"oidc" toml:"oidc"`
+}
+
+type ServerConfig struct {
+	Addr string `yaml:"addr" toml:"addr" env:"SERVER_ADDR"`
+	// DebugAddr 只在内网监听的运行指标 (/debug/vars) 地址, 为空时不开启
+	DebugAddr string `yaml:"debug_addr" toml:"debug_addr" env:"DEBUG_ADDR"`
+	// PassURL 前端完成绑定的页面, 回调时把 code 和 state 转交过去
+	PassURL string `yaml:"pass_url" toml:"pass_url" env:"PASS_URL"`
+	// TransformerRedirectURL 带 source 的 github 回调跳转到 transformer 的地址
+	TransformerRedirectURL string `yaml:"transformer_redirect_url" toml:"transformer_redirect_url" env:"TRANSFORMER_REDIRECT_URL"`
+	// TransformerURL transformer 的接口地址, 用于 github 登录
+	TransformerURL string `yaml:"transformer_url" toml:"transformer_url" env:"TRANSFORMER_URL"`
+	// SiweDomain Sign-In with Ethereum 消息中要求的 domain, 必须配置
+	SiweDomain string `yaml:"siwe_domain" toml:"siwe_domain" env:"SIWE_DOMAIN"`
+}
+
+type DBConfig struct {
+	// Driver mysql、sqlite 或 memory
+	Driver     string `yaml:"driver" toml:"driver" env:"DB_DRIVER"`
+	Username   string `yaml:"username" toml:"username" env:"DB_USERNAME"`
+	Password   string `yaml:"password" toml:"password" env:"DB_PASSWORD"`
+	Host       string `yaml:"host" toml:"host" env:"DB_HOST"`
+	Port       int    `yaml:"port" toml:"port" env:"DB_PORT"`
+	Name       string `yaml:"name" toml:"name" env:"DB_NAME"`
+	SqlitePath string `yaml:"sqlite_path" toml:"sqlite_path" env:"SQLITE_PATH"`
+}
+
+type OAuthConfig struct {
+	// StateSecret 签名 state、授权请求和授权页面凭证的密钥, 所有实例使用同一个, 必须配置
+	StateSecret       string    `yaml:"state_secret" toml:"state_secret" env:"STATE_SECRET"`
+	RedirectAllowlist Allowlist `yaml:"redirect_allowlist" toml:"redirect_allowlist" env:"REDIRECT_ALLOWLIST"`
+	// PKCEProviders 使用 PKCE 的平台, none 为全部关闭
+	PKCEProviders []string `yaml:"pkce_providers" toml:"pkce_providers" env:"PKCE_PROVIDERS"`
+}
+
+// EndpointConfig 平台的授权、token 和 api 地址, 测试时可以指向本地的 fake 服务
+type EndpointConfig struct {
+	AuthURL  string `yaml:"auth_url" toml:"auth_url" env:"AUTH_URL"`
+	TokenURL string `yaml:"token_url" toml:"token_url" env:"TOKEN_URL"`
+	APIURL   string `yaml:"api_url" toml:"api_url" env:"API_URL"`
+}
+
+type GithubConfig struct {
+	ClientID     string         `yaml:"client_id" toml:"client_id" env:"CLIENT_ID"`
+	ClientSecret string         `yaml:"client_secret" toml:"client_secret" env:"CLIENT_SECRET"`
+	RedirectURL  string         `yaml:"redirect_url" toml:"redirect_url" env:"REDIRECT_URL"`
+	Endpoint     EndpointConfig `yaml:"endpoint" toml:"endpoint" env:"GITHUB_"`
+	// APIToken 回填数字 id 时查询 github 用户使用的 token, 为空时受匿名请求的限流
+	APIToken string `yaml:"api_token" toml:"api_token" env:"GITHUB_API_TOKEN"`
+}
+
+type DiscordConfig struct {
+	ClientID     string         `yaml:"client_id" toml:"client_id" env:"DISCORD_ID"`
+	ClientSecret string         `yaml:"client_secret" toml:"client_secret" env:"DISCORD_SECRET"`
+	RedirectURL  string         `yaml:"redirect_url" toml:"redirect_url" env:"DISCORD_REDIRECT_URL"`
+	Endpoint     EndpointConfig `yaml:"endpoint" toml:"endpoint" env:"DISCORD_"`
+}
+
+// GmailConfig knexus 的 gmail 应用使用同样的 Endpoint
+type GmailConfig struct {
+	ClientID     string         `yaml:"client_id" toml:"client_id" env:"GMAIL_ID"`
+	ClientSecret string         `yaml:"client_secret" toml:"client_secret" env:"GMAIL_SECRET"`
+	RedirectURL  string         `yaml:"redirect_url" toml:"redirect_url" env:"GMAIL_REDIRECT_URL"`
+	Endpoint     EndpointConfig `yaml:"endpoint" toml:"endpoint" env:"GMAIL_"`
+}
+
+// KnexusConfig knexus 的 gmail 登录使用单独的 oauth 应用
+type KnexusConfig struct {
+	GmailClientID     string `yaml:"gmail_client_id" toml:"gmail_client_id" env:"KNEXUS_GMAIL_ID"`
+	GmailClientSecret string `yaml:"gmail_client_secret" toml:"gmail_client_secret" env:"KNEXUS_GMAIL_SECRET"`
+	GmailRedirectURL  string `yaml:"gmail_redirect_url" toml:"gmail_redirect_url" env:"KNEXUS_GMAIL_REDIRECT_URL"`
+	// API 用 gmail 换取 knexus access token 的接口
+	API string `yaml:"api" toml:"api" env:"KNEXUS_API"`
+}
+
+type StackoverflowConfig struct {
+	ClientID     string         `yaml:"client_id" toml:"client_id" env:"STACKOVERFLOW_CLIENT_ID"`
+	ClientSecret string         `yaml:"client_secret" toml:"client_secret" env:"STACKOVERFLOW_CLIENT_SECRET"`
+	RedirectURL  string         `yaml:"redirect_url" toml:"redirect_url" env:"STACKOVERFLOW_REDIRECT_URL"`
+	AppsKey      string         `yaml:"apps_key" toml:"apps_key" env:"STACKOVERFLOW_APPS_KEY"`
+	Endpoint     EndpointConfig `yaml:"endpoint" toml:"endpoint" env:"STACKOVERFLOW_"`
+}
+
+type JWTConfig struct {
+	// Secret HMAC 密钥, 为空时不接受也不签发 HMAC jwt
+	Secret string `yaml:"secret" toml:"secret" env:"JWT_SECRET"`
+	// Issuer/Audience 为空时不校验 iss/aud
+	Issuer   string `yaml:"issuer" toml:"issuer" env:"JWT_ISSUER"`
+	Audience string `yaml:"audience" toml:"audience" env:"JWT_AUDIENCE"`
+	// Leeway exp/nbf 允许的时钟误差, 单位为秒
+	Leeway int `yaml:"leeway" toml:"leeway" env:"JWT_LEEWAY"`
+	// JWKSFile/JWKSURL 其他服务签发 jwt 的公钥
+	JWKSFile string `yaml:"jwks_file" toml:"jwks_file" env:"JWKS_FILE"`
+	JWKSURL  string `yaml:"jwks_url" toml:"jwks_url" env:"JWKS_URL"`
+	// SigningKey 本服务签发 jwt 用的 PEM 私钥文件, 第一个私钥用于签发
+	SigningKey string `yaml:"signing_key" toml:"signing_key" env:"JWT_SIGNING_KEY"`
+	// AccessTTL 本服务签发的 jwt 的有效期, RefreshTTL 刷新令牌的有效期, 单位为秒
+	AccessTTL  int `yaml:"access_ttl" toml:"access_ttl" env:"JWT_ACCESS_TTL"`
+	RefreshTTL int `yaml:"refresh_ttl" toml:"refresh_ttl" env:"JWT_REFRESH_TTL"`
+}
+
+// LoginConfig /oauth/login 签发会话的方式
+type LoginConfig struct {
+	// Backend session 为本服务按账号绑定的地址签发 jwt, transformer 为交给 TransformerURL 的第三方登录接口
+	Backend string `yaml:"backend" toml:"backend" env:"LOGIN_BACKEND"`
+	// V1Backend v1 /oauth/login 使用的后端, 默认 transformer, 与原来只支持 github 时的行为一致
+	V1Backend string `yaml:"v1_backend" toml:"v1_backend" env:"LOGIN_V1_BACKEND"`
+}
+
+// OIDCConfig 本服务作为 OAuth2/OIDC 授权服务器 ("Login with KNN3") 的配置, Issuer 为空时不开启
+type OIDCConfig struct {
+	// Issuer id_token 的 iss 和 discovery 中的地址前缀, 如 https://oauth.knn3.xyz
+	Issuer string `yaml:"issuer" toml:"issuer" env:"OIDC_ISSUER"`
+	// LoginURL 前端的登录和授权页面, /authorize 带上签名的 request 跳转过去
+	LoginURL string `yaml:"login_url" toml:"login_url" env:"OIDC_LOGIN_URL"`
+	// PrivateBindings 为 true 时绑定查询接口只对地址本人和获得授权的第三方应用返回账号,
+	// 为 false 时匿名查询保持公开, 第三方应用的 access token 仍然只能看到授权过的账号
+	PrivateBindings bool `yaml:"private_bindings" toml:"private_bindings" env:"OIDC_PRIVATE_BINDINGS"`
+}
+
+// HTTPConfig 请求第三方平台、knexus 和 transformer 使用的 http 客户端
+type HTTPConfig struct {
+	// Timeout 单次请求的超时, 单位为秒
+	Timeout int `yaml:"timeout" toml:"timeout" env:"HTTP_TIMEOUT"`
+	// HostTimeouts 按 host 覆盖 Timeout
+	HostTimeouts HostTimeouts `yaml:"host_timeouts" toml:"host_timeouts" env:"HTTP_HOST_TIMEOUTS"`
+	// Retries GET 等幂等请求遇到网络错误、429 和 5xx 时的重试次数
+	Retries int `yaml:"retries" toml:"retries" env:"HTTP_RETRIES"`
+	// BreakerThreshold 同一个 host 连续失败多少次后熔断, 0 为不熔断
+	BreakerThreshold int `yaml:"breaker_threshold" toml:"breaker_threshold" env:"HTTP_BREAKER_THRESHOLD"`
+	// BreakerCooldown 熔断后多久放行一个试探请求, 单位为秒
+	BreakerCooldown int `yaml:"breaker_cooldown" toml:"breaker_cooldown" env:"HTTP_BREAKER_COOLDOWN"`
+}
+
+// HostTimeouts 每个 host 的超时秒数.
+// 配置文件中写成 map, 环境变量写成 host=5,host2=10
+type HostTimeouts map[string]int
+
+func (h *HostTimeouts) UnmarshalText(text []byte) error {
+	timeouts := HostTimeouts{}
+	for _, entry := range strings.Split(string(text), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		host, seconds, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("%q should be host=seconds", entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(seconds))
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", seconds)
+		}
+		timeouts[strings.TrimSpace(host)] = n
+	}
+	*h = timeouts
+	return nil
+}
+
+// Allowlist 每个 client 允许跳转的地址, 以 * 结尾的为前缀匹配.
+// 配置文件中写成 map, 环境变量写成 client=url1,url2;client2=url3
+type Allowlist map[string][]string
+
+func (a *Allowlist) UnmarshalText(text []byte) error {
+	allowlist := Allowlist{}
+	for _, entry := range strings.Split(string(text), ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		client, targets, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(client) == "" {
+			return fmt.Errorf("malformed entry %q, want client=url1,url2", entry)
+		}
+		client = strings.TrimSpace(client)
+		for _, target := range strings.Split(targets, ",") {
+			if target = strings.TrimSpace(target); target != "" {
+				allowlist[client] = append(allowlist[client], target)
+			}
+		}
+	}
+	*a = allowlist
+	return nil
+}
+
+// defaultRedirectAllowlist 没有配置 REDIRECT_ALLOWLIST 时使用.
+// 配置文件中的 map 会合并进已有的值, 所以在读取配置之后再补上
+func defaultRedirectAllowlist() Allowlist {
+	return Allowlist{
+		"knexus":       {"https://knexus.xyz", "https://knexus.xyz/*"},
+		"knexus_early": {"https://knexus.xyz", "https://knexus.xyz/*"},
+	}
+}
+
+// Default 没有配置时的默认值
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:                   ":8001",
+			PassURL:                "https://topscore.social/pass",
+			TransformerRedirectURL: "https://transformer.knn3.xyz",
+		},
+		DB: DBConfig{
+			Driver:     "mysql",
+			Name:       "lens",
+			SqlitePath: "oauth.db",
+		},
+		OAuth: OAuthConfig{
+			PKCEProviders: []string{"github", "discord", "gmail"},
+		},
+		Github: GithubConfig{
+			Endpoint: EndpointConfig{
+				AuthURL:  "https://github.com/login/oauth/authorize",
+				TokenURL: "https://github.com/login/oauth/access_token",
+				APIURL:   "https://api.github.com",
+			},
+		},
+		Discord: DiscordConfig{
+			RedirectURL: "https://knn3-gateway.knn3.xyz/oauth/discord",
+			Endpoint: EndpointConfig{
+				AuthURL:  "https://discord.com/api/oauth2/authorize",
+				TokenURL: "https://discordapp.com/api/oauth2/token",
+				APIURL:   "https://discordapp.com/api",
+			},
+		},
+		Gmail: GmailConfig{
+			RedirectURL: "https://knn3-gateway.knn3.xyz/oauth/gmail",
+			Endpoint: EndpointConfig{
+				AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+				TokenURL: "https://oauth2.googleapis.com/token",
+				APIURL:   "https://gmail.googleapis.com/",
+			},
+		},
+		Stackoverflow: StackoverflowConfig{
+			Endpoint: EndpointConfig{
+				AuthURL:  "https://stackoverflow.com/oauth",
+				TokenURL: "https://stackoverflow.com/oauth/access_token",
+				APIURL:   "https://api.stackexchange.com/2.3",
+			},
+		},
+		HTTP: HTTPConfig{
+			Timeout:          10,
+			Retries:          2,
+			BreakerThreshold: 5,
+			BreakerCooldown:  30,
+		},
+		JWT: JWTConfig{
+			AccessTTL:  900,
+			RefreshTTL: 30 * 24 * 3600,
+		},
+		Login: LoginConfig{
+			Backend:   "session",
+			V1Backend: "transformer",
+		},
+	}
+}
+
+// Load 读取 .env (可选)、配置文件 (可选, .yaml/.yml/.toml) 和环境变量, 并校验
+func Load(file string) (*Config, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("load .env: %w", err)
+	}
+	cfg := Default()
+	if file != "" {
+		if err := cfg.loadFile(file); err != nil {
+			return nil, err
+		}
+	}
+	problems := applyEnv(reflect.ValueOf(cfg).Elem(), "")
+	if cfg.OAuth.RedirectAllowlist == nil {
+		cfg.OAuth.RedirectAllowlist = defaultRedirectAllowlist()
+	}
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	switch ext := strings.ToLower(filepath.Ext(file)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("unsupported config file %q, want .yaml, .yml or .toml", file)
+	}
+	if err != nil {
+		return fmt.Errorf("parse config %s: %w", file, err)
+	}
+	return nil
+}
+
+// applyEnv 用非空的环境变量覆盖带 env tag 的字段, 返回格式错误的变量.
+// 结构体字段的 env tag 作为其中字段的前缀, 如 GITHUB_ + AUTH_URL
+func applyEnv(v reflect.Value, prefix string) []string {
+	var problems []string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		name := t.Field(i).Tag.Get("env")
+		if field.Kind() == reflect.Struct {
+			problems = append(problems, applyEnv(field, prefix+name)...)
+			continue
+		}
+		if name == "" {
+			continue
+		}
+		name = prefix + name
+		raw := os.Getenv(name)
+		if raw == "" {
+			continue
+		}
+		if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			if err := u.UnmarshalText([]byte(raw)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			}
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(raw)
+		case reflect.Int:
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not an integer", name, raw))
+				continue
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a boolean", name, raw))
+				continue
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			var list []string
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		}
+	}
+	return problems
+}
+
+// ValidationError 列出所有缺失或格式错误的配置
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func (cfg *Config) validate() []string {
+	var problems []string
+	require := func(name, value string) {
+		if value == "" {
+			problems = append(problems, name+" is required")
+		}
+	}
+	checkURL := func(name, value string) {
+		if value == "" {
+			return
+		}
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s: %q is not an absolute http(s) url", name, value))
+		}
+	}
+
+	require("SERVER_ADDR", cfg.Server.Addr)
+	if cfg.Server.DebugAddr != "" && cfg.Server.DebugAddr == cfg.Server.Addr {
+		problems = append(problems, "DEBUG_ADDR: must differ from SERVER_ADDR")
+	}
+	require("PASS_URL", cfg.Server.PassURL)
+	// 为空时 /auth/siwe/verify 拒绝所有消息
+	require("SIWE_DOMAIN", cfg.Server.SiweDomain)
+	checkURL("PASS_URL", cfg.Server.PassURL)
+	checkURL("TRANSFORMER_REDIRECT_URL", cfg.Server.TransformerRedirectURL)
+	checkURL("TRANSFORMER_URL", cfg.Server.TransformerURL)
+
+	transformer := false
+	for _, backend := range []struct{ name, value string }{
+		{"LOGIN_BACKEND", cfg.Login.Backend},
+		{"LOGIN_V1_BACKEND", cfg.Login.V1Backend},
+	} {
+		switch backend.value {
+		case "session":
+		case "transformer":
+			transformer = true
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown backend %q, want session or transformer", backend.name, backend.value))
+		}
+	}
+	if transformer {
+		require("TRANSFORMER_URL", cfg.Server.TransformerURL)
+	}
+
+	switch cfg.DB.Driver {
+	case "mysql":
+		require("DB_USERNAME", cfg.DB.Username)
+		require("DB_HOST", cfg.DB.Host)
+		require("DB_NAME", cfg.DB.Name)
+		if cfg.DB.Port <= 0 || cfg.DB.Port > 65535 {
+			problems = append(problems, fmt.Sprintf("DB_PORT: %d is not a valid port", cfg.DB.Port))
+		}
+	case "sqlite":
+		require("SQLITE_PATH", cfg.DB.SqlitePath)
+	case "memory":
+	default:
+		problems = append(problems, fmt.Sprintf("DB_DRIVER: unknown driver %q, want mysql, sqlite or memory", cfg.DB.Driver))
+	}
+
+	// 随机密钥签的 state 在其他实例和重启后都无法校验
+	require("STATE_SECRET", cfg.OAuth.StateSecret)
+
+	clients := make([]string, 0, len(cfg.OAuth.RedirectAllowlist))
+	for client := range cfg.OAuth.RedirectAllowlist {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	for _, client := range clients {
+		for _, target := range cfg.OAuth.RedirectAllowlist[client] {
+			checkURL("REDIRECT_ALLOWLIST "+client, strings.TrimSuffix(target, "*"))
+		}
+	}
+
+	// 配置了 client id 的平台必须同时配置密钥和回调地址
+	app := func(prefix, id, secret, redirect string) {
+		if id == "" {
+			return
+		}
+		require(prefix+" client secret", secret)
+		require(prefix+" redirect url", redirect)
+		checkURL(prefix+" redirect url", redirect)
+	}
+	endpoint := func(prefix string, e EndpointConfig) {
+		checkURL(prefix+"AUTH_URL", e.AuthURL)
+		checkURL(prefix+"TOKEN_URL", e.TokenURL)
+		checkURL(prefix+"API_URL", e.APIURL)
+	}
+	endpoint("GITHUB_", cfg.Github.Endpoint)
+	endpoint("DISCORD_", cfg.Discord.Endpoint)
+	endpoint("GMAIL_", cfg.Gmail.Endpoint)
+	endpoint("STACKOVERFLOW_", cfg.Stackoverflow.Endpoint)
+	app("github", cfg.Github.ClientID, cfg.Github.ClientSecret, cfg.Github.RedirectURL)
+	app("discord", cfg.Discord.ClientID, cfg.Discord.ClientSecret, cfg.Discord.RedirectURL)
+	app("gmail", cfg.Gmail.ClientID, cfg.Gmail.ClientSecret, cfg.Gmail.RedirectURL)
+	app("knexus gmail", cfg.Knexus.GmailClientID, cfg.Knexus.GmailClientSecret, cfg.Knexus.GmailRedirectURL)
+	app("stackoverflow", cfg.Stackoverflow.ClientID, cfg.Stackoverflow.ClientSecret, cfg.Stackoverflow.RedirectURL)
+	if cfg.Knexus.GmailClientID != "" {
+		require("KNEXUS_API", cfg.Knexus.API)
+	}
+	checkURL("KNEXUS_API", cfg.Knexus.API)
+	if cfg.Stackoverflow.ClientID != "" {
+		require("STACKOVERFLOW_APPS_KEY", cfg.Stackoverflow.AppsKey)
+	}
+
+	if cfg.JWT.Secret == "" && cfg.JWT.SigningKey == "" {
+		problems = append(problems, "JWT_SECRET or JWT_SIGNING_KEY is required")
+	}
+	if cfg.JWT.Leeway < 0 {
+		problems = append(problems, "JWT_LEEWAY must not be negative")
+	}
+	if cfg.JWT.AccessTTL <= 0 {
+		problems = append(problems, "JWT_ACCESS_TTL must be positive")
+	}
+	if cfg.JWT.RefreshTTL <= 0 {
+		problems = append(problems, "JWT_REFRESH_TTL must be positive")
+	}
+	checkURL("JWKS_URL", cfg.JWT.JWKSURL)
+
+	if cfg.OIDC.Issuer != "" {
+		require("OIDC_LOGIN_URL", cfg.OIDC.LoginURL)
+		// id_token 需要第三方应用能通过 JWKS 校验
+		require("JWT_SIGNING_KEY", cfg.JWT.SigningKey)
+	}
+	checkURL("OIDC_ISSUER", cfg.OIDC.Issuer)
+	checkURL("OIDC_LOGIN_URL", cfg.OIDC.LoginURL)
+
+	if cfg.HTTP.Timeout <= 0 {
+		problems = append(problems, "HTTP_TIMEOUT must be positive")
+	}
+	for host, seconds := range cfg.HTTP.HostTimeouts {
+		if seconds <= 0 {
+			problems = append(problems, fmt.Sprintf("HTTP_HOST_TIMEOUTS %s must be positive", host))
+		}
+	}
+	if cfg.HTTP.Retries < 0 || cfg.HTTP.BreakerThreshold < 0 || cfg.HTTP.BreakerCooldown < 0 {
+		problems = append(problems, "HTTP_RETRIES, HTTP_BREAKER_THRESHOLD and HTTP_BREAKER_COOLDOWN must not be negative")
+	}
+	return problems
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadFileAndEnv(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+db:
+  driver: sqlite
+  sqlite_path: /tmp/oauth.db
+oauth:
+  redirect_allowlist:
+    app: ["https://app.example/*"]
+jwt:
+  secret: file-secret
+`,
+		"config.toml": `
+[db]
+driver = "sqlite"
+sqlite_path = "/tmp/oauth.db"
+
+[oauth.redirect_allowlist]
+app = ["https://app.example/*"]
+
+[jwt]
+secret = "file-secret"
+`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("JWT_SECRET", "env-secret")
+			t.Setenv("PKCE_PROVIDERS", "github, gmail")
+			t.Setenv("STATE_SECRET", "state-secret")
+			t.Setenv("SIWE_DOMAIN", "knn3.xyz")
+			// v1 /oauth/login 默认交给 transformer
+			t.Setenv("TRANSFORMER_URL", "https://transformer.test")
+			cfg, err := Load(writeConfig(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.DB.Driver != "sqlite" || cfg.DB.SqlitePath != "/tmp/oauth.db" {
+				t.Errorf("db = %+v", cfg.DB)
+			}
+			if cfg.JWT.Secret != "env-secret" {
+				t.Errorf("env should override file, got %q", cfg.JWT.Secret)
+			}
+			if want := []string{"github", "gmail"}; !reflect.DeepEqual(cfg.OAuth.PKCEProviders, want) {
+				t.Errorf("pkce providers = %v, want %v", cfg.OAuth.PKCEProviders, want)
+			}
+			// 配置文件中的白名单替换默认值
+			if want := (Allowlist{"app": {"https://app.example/*"}}); !reflect.DeepEqual(cfg.OAuth.RedirectAllowlist, want) {
+				t.Errorf("allowlist = %v, want %v", cfg.OAuth.RedirectAllowlist, want)
+			}
+			if cfg.Server.Addr != ":8001" {
+				t.Errorf("default addr = %q", cfg.Server.Addr)
+			}
+		})
+	}
+}
+
+func TestLoadValidation(t *testing.T) {
+	t.Setenv("DB_DRIVER", "mysql")
+	t.Setenv("DB_PORT", "abc")
+	t.Setenv("CLIENT_ID", "github-id")
+	t.Setenv("REDIRECT_ALLOWLIST", "knexus")
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("STATE_SECRET", "")
+	t.Setenv("SIWE_DOMAIN", "")
+	t.Setenv("OIDC_ISSUER", "https://oauth.test")
+	_, err := Load("")
+	var validation *ValidationError
+	if !errors.As(err, &validation) {
+		t.Fatalf("got %v, want ValidationError", err)
+	}
+	for _, want := range []string{"DB_PORT", "REDIRECT_ALLOWLIST", "DB_USERNAME", "github client secret", "JWT_SECRET or JWT_SIGNING_KEY", "OIDC_LOGIN_URL", "STATE_SECRET", "SIWE_DOMAIN"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should mention %s:\n%v", want, err)
+		}
+	}
+}
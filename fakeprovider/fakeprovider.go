@@ -0,0 +1,328 @@
+// Package fakeprovider 本地模拟 GitHub、Discord、Google/Gmail、StackExchange 的 oauth 和用户信息接口,
+// 以及 knexus 和 transformer 的接口, 用于端到端测试和本地开发
+package fakeprovider
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/KNN3-Network/oauth-server/config"
+)
+
+// 模拟的 oauth 应用
+const (
+	ClientID     = "fake-client-id"
+	ClientSecret = "fake-client-secret"
+)
+
+// User 授权的平台账号
+type User struct {
+	ID    string // github/discord 的 id, google 的 sub, stackexchange 的 account_id, 需要是数字, stackexchange 为空时返回空的 items
+	Login string // github login, discord username, stackexchange display_name
+	Name  string
+	Email string // gmail 地址
+	// ProfileStatus 不为 0 时用户信息接口返回该状态码, 用于模拟平台故障
+	ProfileStatus int
+}
+
+type grant struct {
+	provider    string
+	user        User
+	redirectURI string
+	challenge   string
+}
+
+type Server struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	codes  map[string]grant
+	tokens map[string]User
+	// githubUsers 以 login 为 key, GET /github/users/{login} 使用
+	githubUsers map[string]User
+}
+
+// New 启动模拟服务, 测试结束时需要 Close
+func New() *Server {
+	s := &Server{codes: map[string]grant{}, tokens: map[string]User{}, githubUsers: map[string]User{}}
+	mux := http.NewServeMux()
+	for _, provider := range []string{"github", "discord", "google", "stackexchange"} {
+		mux.HandleFunc("/"+provider+"/token", s.token(provider))
+	}
+	mux.HandleFunc("/github/user", s.githubUser)
+	mux.HandleFunc("/github/users/", s.githubUserByLogin)
+	mux.HandleFunc("/discord/users/@me", s.discordUser)
+	mux.HandleFunc("/google/gmail/v1/users/me/profile", s.gmailProfile)
+	mux.HandleFunc("/stackexchange/me", s.stackexchangeMe)
+	mux.HandleFunc("/knexus/token", s.knexusToken)
+	mux.HandleFunc("/transformer/api/users/thirdPartyLogin", s.transformerLogin)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Configure 把 cfg 中各平台的地址指向模拟服务, callbackBase 为本服务的地址, 用于拼接回调地址
+func (s *Server) Configure(cfg *config.Config, callbackBase string) {
+	endpoint := func(provider, api string) config.EndpointConfig {
+		return config.EndpointConfig{
+			AuthURL:  s.URL + "/" + provider + "/authorize",
+			TokenURL: s.URL + "/" + provider + "/token",
+			APIURL:   s.URL + "/" + provider + api,
+		}
+	}
+	cfg.Github = config.GithubConfig{ClientID: ClientID, ClientSecret: ClientSecret, RedirectURL: callbackBase + "/oauth/github", Endpoint: endpoint("github", "")}
+	cfg.Discord = config.DiscordConfig{ClientID: ClientID, ClientSecret: ClientSecret, RedirectURL: callbackBase + "/oauth/discord", Endpoint: endpoint("discord", "")}
+	cfg.Gmail = config.GmailConfig{ClientID: ClientID, ClientSecret: ClientSecret, RedirectURL: callbackBase + "/oauth/gmail", Endpoint: endpoint("google", "/")}
+	cfg.Stackoverflow = config.StackoverflowConfig{ClientID: ClientID, ClientSecret: ClientSecret, RedirectURL: callbackBase + "/oauth/stackoverflow/", AppsKey: "fake-key", Endpoint: endpoint("stackexchange", "")}
+	cfg.Knexus = config.KnexusConfig{GmailClientID: ClientID, GmailClientSecret: ClientSecret, GmailRedirectURL: callbackBase + "/oauth/gmail", API: s.URL + "/knexus/token"}
+	cfg.Server.TransformerURL = s.URL + "/transformer"
+}
+
+// AddGithubUser 添加可以通过 login 查询的 github 用户
+func (s *Server) AddGithubUser(user User) {
+	s.mu.Lock()
+	s.githubUsers[user.Login] = user
+	s.mu.Unlock()
+}
+
+// Authorize 模拟用户在平台的授权页同意授权, 返回平台跳回 redirect_uri 的地址 (带 code 和 state)
+func (s *Server) Authorize(authURL string, user User) (string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+	provider, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	q := u.Query()
+	if q.Get("client_id") != ClientID {
+		return "", fmt.Errorf("unknown client_id %q", q.Get("client_id"))
+	}
+	if q.Get("code_challenge") != "" && q.Get("code_challenge_method") != "S256" {
+		return "", errors.New("unsupported code_challenge_method")
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Host == "" {
+		return "", fmt.Errorf("invalid redirect_uri %q", q.Get("redirect_uri"))
+	}
+
+	code := randomString()
+	s.mu.Lock()
+	s.codes[code] = grant{provider: provider, user: user, redirectURI: q.Get("redirect_uri"), challenge: q.Get("code_challenge")}
+	s.mu.Unlock()
+
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+	return redirect.String(), nil
+}
+
+// token 用 code 换取 access token, 校验 client、redirect_uri 和 PKCE, code 只能使用一次
+func (s *Server) token(provider string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			oauthError(w, "invalid_request")
+			return
+		}
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok {
+			clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+		}
+		if clientID != ClientID || clientSecret != ClientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		code := r.PostForm.Get("code")
+		s.mu.Lock()
+		g, ok := s.codes[code]
+		delete(s.codes, code)
+		s.mu.Unlock()
+		if !ok || g.provider != provider {
+			oauthError(w, "invalid_grant")
+			return
+		}
+		if redirectURI := r.PostForm.Get("redirect_uri"); redirectURI != "" && redirectURI != g.redirectURI {
+			oauthError(w, "invalid_grant")
+			return
+		}
+		if g.challenge != "" {
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+				oauthError(w, "invalid_grant")
+				return
+			}
+		}
+
+		token := randomString()
+		s.mu.Lock()
+		s.tokens[token] = g.user
+		s.mu.Unlock()
+		body := map[string]interface{}{"access_token": token, "token_type": "bearer", "expires_in": 3600}
+		if provider == "google" {
+			body["id_token"] = idToken(g.user)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// idToken 不签名的 id_token, 服务端直接从 token 接口拿到, 不校验签名
+func idToken(user User) string {
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	return encode(map[string]string{"alg": "none"}) + "." + encode(map[string]interface{}{"iss": "https://accounts.google.com", "aud": ClientID, "sub": user.ID, "email": user.Email}) + ".fake"
+}
+
+func oauthError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// user 根据 Authorization: Bearer 或 access_token 参数找到授权的账号,
+// 失败时已经按平台的格式写入错误响应
+func (s *Server) user(w http.ResponseWriter, r *http.Request, provider string) (User, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+	s.mu.Lock()
+	user, ok := s.tokens[token]
+	s.mu.Unlock()
+	if !ok {
+		apiError(w, provider, http.StatusUnauthorized)
+		return User{}, false
+	}
+	if user.ProfileStatus != 0 {
+		apiError(w, provider, user.ProfileStatus)
+		return User{}, false
+	}
+	return user, true
+}
+
+// apiError 各平台 api 的错误响应格式
+func apiError(w http.ResponseWriter, provider string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	text := http.StatusText(status)
+	switch provider {
+	case "github":
+		json.NewEncoder(w).Encode(map[string]string{"message": text, "documentation_url": "https://docs.github.com/rest"})
+	case "discord":
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": fmt.Sprintf("%d: %s", status, text), "code": 0})
+	case "google":
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": status, "message": text}})
+	case "stackexchange":
+		json.NewEncoder(w).Encode(map[string]interface{}{"error_id": status, "error_name": "fake_error", "error_message": text})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) githubUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.user(w, r, "github")
+	if !ok {
+		return
+	}
+	writeGithubUser(w, user)
+}
+
+func (s *Server) githubUserByLogin(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	user, ok := s.githubUsers[strings.TrimPrefix(r.URL.Path, "/github/users/")]
+	s.mu.Unlock()
+	if !ok {
+		apiError(w, "github", http.StatusNotFound)
+		return
+	}
+	writeGithubUser(w, user)
+}
+
+func writeGithubUser(w http.ResponseWriter, user User) {
+	id, _ := strconv.ParseInt(user.ID, 10, 64)
+	writeJSON(w, map[string]interface{}{
+		"id":         id,
+		"login":      user.Login,
+		"name":       user.Name,
+		"avatar_url": "https://avatars.example/u/" + user.ID,
+	})
+}
+
+func (s *Server) discordUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.user(w, r, "discord")
+	if !ok {
+		return
+	}
+	writeJSON(w, map[string]interface{}{"id": user.ID, "username": user.Login, "avatar": "avatar-" + user.ID})
+}
+
+func (s *Server) gmailProfile(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.user(w, r, "google")
+	if !ok {
+		return
+	}
+	writeJSON(w, map[string]interface{}{"emailAddress": user.Email, "messagesTotal": 0})
+}
+
+func (s *Server) stackexchangeMe(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("key") == "" {
+		apiError(w, "stackexchange", http.StatusBadRequest)
+		return
+	}
+	user, ok := s.user(w, r, "stackexchange")
+	if !ok {
+		return
+	}
+	// 没有 ID 时返回空的 items
+	items := []map[string]interface{}{}
+	if id, err := strconv.ParseInt(user.ID, 10, 64); err == nil {
+		items = append(items, map[string]interface{}{"account_id": id, "display_name": user.Login, "profile_image": "https://avatars.example/" + user.ID})
+	}
+	writeJSON(w, map[string]interface{}{"items": items, "has_more": false})
+}
+
+// knexusToken 用 gmail 换取 knexus 的 access token
+func (s *Server) knexusToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Gmail string `json:"gmail"`
+		Type  string `json:"type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Gmail == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "knexus-%s-%s", body.Type, body.Gmail)
+}
+
+// transformerLogin transformer 的第三方登录
+func (s *Server) transformerLogin(w http.ResponseWriter, r *http.Request) {
+	var body map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["third_party_id"] == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]string{"token": "transformer-" + body["third_party_type"] + "-" + body["third_party_id"]})
+}
+
+func randomString() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
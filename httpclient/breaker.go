@@ -0,0 +1,54 @@
+package httpclient
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker 一个 host 的熔断状态.
+// 连续失败达到阈值后打开, 冷却期内拒绝所有请求; 冷却期后放行一个试探请求,
+// 成功则关闭, 失败则重新打开
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record 记录请求结果, 返回熔断是否因此打开
+func (b *breaker) record(failed bool, now time.Time, threshold int, cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return false
+	}
+	b.failures++
+	if threshold <= 0 || b.failures < threshold {
+		return false
+	}
+	b.openUntil = now.Add(cooldown)
+	return true
+}
+
+// release 试探请求被调用方取消时, 允许下一个请求继续试探
+func (b *breaker) release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
@@ -0,0 +1,186 @@
+// Package httpclient 请求第三方平台、knexus 和 transformer 共用的 http 客户端:
+// 按 host 的超时、幂等请求的有限重试、按 host 的熔断, 以及 expvar 上的延迟和失败统计
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"go.uber.org/zap"
+)
+
+// ErrCircuitOpen host 连续失败后被熔断, 冷却期内的请求直接返回该错误
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// 重试的退避时间, 第 n 次重试等待 retryBackoff*2^(n-1) 加上随机抖动
+const retryBackoff = 100 * time.Millisecond
+
+// Client 实现 http.RoundTripper, 通过 HTTPClient 或 oauth2.HTTPClient 使用
+type Client struct {
+	cfg       config.HTTPConfig
+	transport http.RoundTripper
+	logger    *zap.Logger
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// New 使用配置创建客户端, 底层使用 http.DefaultTransport
+func New(cfg config.HTTPConfig, logger *zap.Logger) *Client {
+	return &Client{
+		cfg:       cfg,
+		transport: http.DefaultTransport,
+		logger:    logger,
+		breakers:  map[string]*breaker{},
+	}
+}
+
+// HTTPClient 返回使用本客户端的 http.Client. 超时由 RoundTrip 按 host 控制,
+// 请求的 context 取消时会立即中断, 调用方应使用 http.NewRequestWithContext
+func (c *Client) HTTPClient() *http.Client {
+	return &http.Client{Transport: c}
+}
+
+func (c *Client) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	b := c.breaker(host)
+	if !b.allow(time.Now()) {
+		stats(host).Add("rejected", 1)
+		return nil, fmt.Errorf("%s: %w", host, ErrCircuitOpen)
+	}
+
+	attempts := 1
+	if retryable(req) {
+		attempts += c.cfg.Retries
+	}
+	var resp *http.Response
+	var err error
+	r := req
+	for attempt := 1; ; attempt++ {
+		resp, err = c.do(r, host)
+		if attempt >= attempts || !shouldRetry(req.Context(), resp, err) {
+			break
+		}
+		if resp != nil {
+			c.logger.Warn("retry upstream request", zap.String("host", host), zap.Int("attempt", attempt), zap.Int("status", resp.StatusCode))
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		} else {
+			c.logger.Warn("retry upstream request", zap.String("host", host), zap.Int("attempt", attempt), zap.Error(err))
+		}
+		if err = sleep(req.Context(), backoff(attempt)); err != nil {
+			resp = nil
+			break
+		}
+		if req.GetBody != nil {
+			r = req.Clone(req.Context())
+			if r.Body, err = req.GetBody(); err != nil {
+				resp = nil
+				break
+			}
+		}
+		stats(host).Add("retries", 1)
+	}
+
+	// 调用方主动取消的请求不计入熔断
+	if req.Context().Err() != nil {
+		b.release()
+		return resp, err
+	}
+	failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+	if b.record(failed, time.Now(), c.cfg.BreakerThreshold, time.Duration(c.cfg.BreakerCooldown)*time.Second) {
+		stats(host).Add("opened", 1)
+		c.logger.Error("upstream circuit breaker open", zap.String("host", host), zap.Int("cooldown", c.cfg.BreakerCooldown))
+	}
+	return resp, err
+}
+
+// do 发送一次请求, 超时覆盖到读取完响应体
+func (c *Client) do(req *http.Request, host string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), c.timeout(req))
+	start := time.Now()
+	resp, err := c.transport.RoundTrip(req.WithContext(ctx))
+	observe(host, time.Since(start), err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (c *Client) timeout(req *http.Request) time.Duration {
+	seconds, ok := c.cfg.HostTimeouts[req.URL.Host]
+	if !ok {
+		seconds, ok = c.cfg.HostTimeouts[req.URL.Hostname()]
+	}
+	if !ok {
+		seconds = c.cfg.Timeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (c *Client) breaker(host string) *breaker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.breakers[host]
+	if !ok {
+		b = &breaker{}
+		c.breakers[host] = b
+	}
+	return b
+}
+
+// retryable 只重试幂等且可以重放请求体的请求. code 换 token 等 POST 请求不重试
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
+
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+func backoff(attempt int) time.Duration {
+	d := retryBackoff << (attempt - 1)
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// cancelBody 关闭响应体时释放超时的 context
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
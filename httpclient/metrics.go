@@ -0,0 +1,56 @@
+package httpclient
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// metrics 以 host 为 key 的统计, 通过 /debug/vars 的 upstream 字段查看:
+// requests/failures 为请求和失败 (网络错误或 5xx) 次数, retries 为重试次数,
+// rejected 为熔断拒绝的次数, opened 为熔断打开的次数,
+// latency_ms 为总耗时, le_* 为耗时的分布
+var (
+	metrics   = expvar.NewMap("upstream")
+	metricsMu sync.Mutex
+)
+
+var latencyBuckets = []struct {
+	name  string
+	limit time.Duration
+}{
+	{"le_100ms", 100 * time.Millisecond},
+	{"le_500ms", 500 * time.Millisecond},
+	{"le_1s", time.Second},
+	{"le_5s", 5 * time.Second},
+}
+
+func stats(host string) *expvar.Map {
+	if m, ok := metrics.Get(host).(*expvar.Map); ok {
+		return m
+	}
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if m, ok := metrics.Get(host).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	metrics.Set(host, m)
+	return m
+}
+
+func observe(host string, latency time.Duration, failed bool) {
+	m := stats(host)
+	m.Add("requests", 1)
+	if failed {
+		m.Add("failures", 1)
+	}
+	m.Add("latency_ms", latency.Milliseconds())
+	for _, bucket := range latencyBuckets {
+		if latency <= bucket.limit {
+			m.Add(bucket.name, 1)
+			return
+		}
+	}
+	m.Add("le_inf", 1)
+}
@@ -0,0 +1,74 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/KNN3-Network/oauth-server/utils"
+	"go.uber.org/zap"
+)
+
+// backfillBatchSize 回填时每次读取的记录数
+const backfillBatchSize = 500
+
+// BackfillResult 回填的统计
+type BackfillResult struct {
+	Scanned   int // 读取的 github 绑定
+	Updated   int // 换成数字 id 的记录
+	NotFound  int // login 已经不存在, 保持不变
+	Conflicts int // 数字 id 已经绑定了其他地址, 保持不变
+}
+
+// BackfillGithubIDs 把以 login 绑定的旧 github 记录换成数字 id. dryRun 时只查询不修改.
+// 只处理标记为 LegacySubject 的记录, login 全是数字时同样按 login 查询, 可以重复执行;
+// 遇到 github 限流时返回错误, 稍后重新执行即可继续
+func BackfillGithubIDs(ctx context.Context, store utils.BindingStore, g *Github, dryRun bool, logger *zap.Logger) (BackfillResult, error) {
+	var result BackfillResult
+	var afterID uint64
+	for {
+		list, err := store.ListByProvider(ctx, g.Type(), afterID, backfillBatchSize)
+		if err != nil {
+			return result, err
+		}
+		if len(list) == 0 {
+			return result, nil
+		}
+		for _, linked := range list {
+			afterID = linked.ID
+			result.Scanned++
+			if !linked.LegacySubject {
+				continue
+			}
+
+			user, err := g.LookupUser(ctx, linked.Subject)
+			var providerErr *ProviderError
+			if errors.As(err, &providerErr) && providerErr.Status == http.StatusNotFound {
+				logger.Warn("github login not found", zap.String("addr", linked.Addr), zap.String("login", linked.Subject))
+				result.NotFound++
+				continue
+			}
+			if err != nil {
+				return result, err
+			}
+			id := strconv.FormatInt(user.ID, 10)
+			logger.Info("backfill github id", zap.String("addr", linked.Addr), zap.String("login", linked.Subject), zap.String("id", id), zap.Bool("dry_run", dryRun))
+			if dryRun {
+				result.Updated++
+				continue
+			}
+
+			err = store.UpdateSubject(ctx, linked.ID, id)
+			if errors.Is(err, utils.ErrBindingConflict) {
+				logger.Warn("github id already bound", zap.String("addr", linked.Addr), zap.String("login", linked.Subject), zap.String("id", id))
+				result.Conflicts++
+				continue
+			}
+			if err != nil {
+				return result, err
+			}
+			result.Updated++
+		}
+	}
+}
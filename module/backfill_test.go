@@ -0,0 +1,81 @@
+package module
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/fakeprovider"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"go.uber.org/zap"
+)
+
+func TestBackfillGithubIDs(t *testing.T) {
+	fake := fakeprovider.New()
+	defer fake.Close()
+	cfg := config.Default()
+	fake.Configure(cfg, "http://oauth.test")
+	fake.AddGithubUser(fakeprovider.User{ID: "1", Login: "alice"})
+	fake.AddGithubUser(fakeprovider.User{ID: "2", Login: "bob"})
+	fake.AddGithubUser(fakeprovider.User{ID: "3", Login: "12345"})
+	github := NewGithub(cfg, http.DefaultClient, zap.NewNop())
+
+	for name, newStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// mysql 测试库只清理 test- 开头的平台, 回填只处理 github
+			if name == "mysql" {
+				t.Skip("backfill only handles the github provider")
+			}
+			store := newStore(t)
+			ctx := context.Background()
+			for addr, subject := range map[string]string{
+				"0xa": "alice", // 回填为 1
+				"0xb": "bob",   // 2 已经被 0xd 绑定
+				"0xc": "gone",  // login 不存在
+				"0xe": "12345", // 全是数字的 login, 回填为 3
+			} {
+				if err := store.Upsert(ctx, &utils.LinkedIdentity{Addr: addr, Provider: "github", Subject: subject, Handle: subject, LegacySubject: true}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 已经是数字 id 的记录
+			if err := store.Upsert(ctx, &utils.LinkedIdentity{Addr: "0xd", Provider: "github", Subject: "2", Handle: "bob"}); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := BackfillGithubIDs(ctx, store, github, true, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.GetByIdentity(ctx, "github", "alice"); err != nil {
+				t.Fatalf("dry run should not update: %v", err)
+			}
+
+			result, err = BackfillGithubIDs(ctx, store, github, false, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (BackfillResult{Scanned: 5, Updated: 2, NotFound: 1, Conflicts: 1}); result != want {
+				t.Fatalf("result = %+v, want %+v", result, want)
+			}
+			linked, err := store.GetByIdentity(ctx, "github", "1")
+			if err != nil || linked.Addr != "0xa" || linked.Handle != "alice" {
+				t.Fatalf("alice = %+v %v", linked, err)
+			}
+			linked, err = store.GetByIdentity(ctx, "github", "3")
+			if err != nil || linked.Addr != "0xe" || linked.LegacySubject {
+				t.Fatalf("12345 = %+v %v", linked, err)
+			}
+
+			// 重复执行时不再查询已经回填的记录
+			result, err = BackfillGithubIDs(ctx, store, github, false, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (BackfillResult{Scanned: 5, NotFound: 1, Conflicts: 1}); result != want {
+				t.Fatalf("second run = %+v, want %+v", result, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/KNN3-Network/oauth-server/utils"
+)
+
+// ErrHasBound 该平台账号已经绑定过地址
+var ErrHasBound = errors.New("identity has bound")
+
+// BindIdentity 把平台账号绑定到 address, address 已经绑定过该平台时替换为新的账号.
+// 账号还以 LegacyID 绑定在其他地址上时同样返回 ErrHasBound
+func BindIdentity(ctx context.Context, store utils.BindingStore, address string, p Provider, identity *Identity) error {
+	if identity.LegacyID != "" && identity.LegacyID != identity.ID {
+		legacy, err := store.GetByIdentity(ctx, p.Type(), identity.LegacyID)
+		if err == nil && !strings.EqualFold(legacy.Addr, address) {
+			return ErrHasBound
+		}
+		if err != nil && !errors.Is(err, utils.ErrBindingNotFound) {
+			return err
+		}
+	}
+	now := time.Now()
+	err := store.Upsert(ctx, &utils.LinkedIdentity{
+		Addr:        address,
+		Provider:    p.Type(),
+		Subject:     identity.ID,
+		Handle:      identity.Handle,
+		DisplayName: identity.Name,
+		Metadata:    identity.Metadata,
+		VerifiedAt:  &now,
+	})
+	if errors.Is(err, utils.ErrBindingConflict) {
+		return ErrHasBound
+	}
+	return err
+}
+
+// RefreshIdentity 登录时刷新已绑定账号的 handle、名称和头像.
+// 账号还以 LegacyID 绑定时一并换成不可变的 id, 没有绑定时不做任何事
+func RefreshIdentity(ctx context.Context, store utils.BindingStore, p Provider, identity *Identity) error {
+	linked, err := store.GetByIdentity(ctx, p.Type(), identity.ID)
+	if errors.Is(err, utils.ErrBindingNotFound) && identity.LegacyID != "" {
+		linked, err = store.GetByIdentity(ctx, p.Type(), identity.LegacyID)
+	}
+	if errors.Is(err, utils.ErrBindingNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return BindIdentity(ctx, store, linked.Addr, p, identity)
+}
+
+// ErrNotBound address 没有绑定该平台账号
+var ErrNotBound = errors.New("identity not bound")
+
+// UnbindIdentity 删除 address 在该平台绑定的账号
+func UnbindIdentity(ctx context.Context, store utils.BindingStore, address string, p Provider) error {
+	err := store.Delete(ctx, address, p.Type())
+	if errors.Is(err, utils.ErrBindingNotFound) {
+		return ErrNotBound
+	}
+	return err
+}
+
+// Account 地址绑定的一个平台账号
+type Account struct {
+	Type string `json:"type"`
+	Identity
+	BoundAt time.Time `json:"bound_at"`
+}
+
+// Bindings 查询 address 绑定的所有平台账号, masked 为 true 时隐私平台的账号脱敏
+func Bindings(ctx context.Context, store utils.BindingStore, registry *Registry, address string, masked bool) ([]Account, error) {
+	linked, err := store.GetByAddress(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	list := []Account{}
+	for i := range linked {
+		if account, ok := newAccount(registry, &linked[i], masked); ok {
+			list = append(list, account)
+		}
+	}
+	return list, nil
+}
+
+// newAccount 只返回已注册平台的账号
+func newAccount(registry *Registry, linked *utils.LinkedIdentity, masked bool) (Account, bool) {
+	p, ok := registry.Get(linked.Provider)
+	if !ok {
+		return Account{}, false
+	}
+	identity := &Identity{ID: linked.Subject, Handle: linked.Handle, Name: linked.DisplayName, Metadata: linked.Metadata}
+	if mp, ok := p.(MaskedProvider); ok && masked {
+		identity = mp.Mask(identity)
+	}
+	return Account{Type: linked.Provider, Identity: *identity, BoundAt: linked.CreatedAt}, true
+}
+
+// LookupAddress 通过平台账号反查绑定的地址, 没有绑定返回 ErrNotBound
+func LookupAddress(ctx context.Context, store utils.BindingStore, p Provider, id string) (string, error) {
+	linked, err := store.GetByIdentity(ctx, p.Type(), id)
+	if errors.Is(err, utils.ErrBindingNotFound) {
+		return "", ErrNotBound
+	}
+	if err != nil {
+		return "", err
+	}
+	return linked.Addr, nil
+}
+
+// batchChunkSize 批量查询时每次查询的地址数量
+const batchChunkSize = 1000
+
+// AddressBindings 批量查询中一个地址的绑定结果
+type AddressBindings struct {
+	Addr     string    `json:"addr"`
+	Accounts []Account `json:"accounts"`
+}
+
+// BatchBindings 分批查询多个地址的绑定情况, 每查到一个有绑定的地址调用一次 fn.
+// p 不为 nil 时只返回该平台的账号, 隐私平台的账号总是脱敏
+func BatchBindings(ctx context.Context, store utils.BindingStore, registry *Registry, addrs []string, p Provider, fn func(*AddressBindings) error) error {
+	platformType := ""
+	if p != nil {
+		platformType = p.Type()
+	}
+	for start := 0; start < len(addrs); start += batchChunkSize {
+		end := start + batchChunkSize
+		if end > len(addrs) {
+			end = len(addrs)
+		}
+		linked, err := store.List(ctx, addrs[start:end], platformType)
+		if err != nil {
+			return err
+		}
+		// 结果按 addr 排序, 相邻的记录属于同一个地址
+		var current *AddressBindings
+		for i := range linked {
+			if current != nil && !strings.EqualFold(current.Addr, linked[i].Addr) {
+				if err := fn(current); err != nil {
+					return err
+				}
+				current = nil
+			}
+			account, ok := newAccount(registry, &linked[i], true)
+			if !ok {
+				continue
+			}
+			if current == nil {
+				current = &AddressBindings{Addr: linked[i].Addr}
+			}
+			current.Accounts = append(current.Accounts, account)
+		}
+		if current != nil {
+			if err := fn(current); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
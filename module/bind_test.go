@@ -0,0 +1,156 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/KNN3-Network/oauth-server/utils"
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+// testProvider 只需要 Type 的平台
+type testProvider struct {
+	Provider
+	platformType string
+}
+
+func (p testProvider) Type() string { return p.platformType }
+
+// testMysqlDB 需要真实的 MySQL, 通过 TEST_MYSQL_DSN 指定, 如
+// user:pass@tcp(127.0.0.1:3306)/oauth_test?charset=utf8mb4&parseTime=True&loc=Local
+func testMysqlDB(t *testing.T) *gorm.DB {
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("TEST_MYSQL_DSN not set")
+	}
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&utils.LinkedIdentity{}, &utils.RefreshToken{}, &utils.Revocation{}, &utils.OAuthClient{}, &utils.AuthorizationCode{}, &utils.ConsentGrant{}, &utils.FlowNonce{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func testSqliteDB(t *testing.T) *gorm.DB {
+	path := filepath.Join(t.TempDir(), "oauth.db")
+	db, err := gorm.Open(sqlite.Open(path+"?_pragma=busy_timeout(5000)"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&utils.LinkedIdentity{}, &utils.RefreshToken{}, &utils.Revocation{}, &utils.OAuthClient{}, &utils.AuthorizationCode{}, &utils.ConsentGrant{}, &utils.FlowNonce{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func testStores(t *testing.T) map[string]func(t *testing.T) utils.BindingStore {
+	return map[string]func(t *testing.T) utils.BindingStore{
+		"memory": func(t *testing.T) utils.BindingStore { return utils.NewMemoryStore() },
+		"sqlite": func(t *testing.T) utils.BindingStore { return utils.NewGormStore(testSqliteDB(t)) },
+		"mysql": func(t *testing.T) utils.BindingStore {
+			db := testMysqlDB(t)
+			db.Where("provider LIKE ?", "test-%").Delete(&utils.LinkedIdentity{})
+			t.Cleanup(func() { db.Where("provider LIKE ?", "test-%").Delete(&utils.LinkedIdentity{}) })
+			return utils.NewGormStore(db)
+		},
+	}
+}
+
+func TestBindIdentityConcurrent(t *testing.T) {
+	for name, newStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+			p := testProvider{platformType: "test-concurrent"}
+
+			const workers = 20
+			var wg sync.WaitGroup
+			errs := make([]error, workers)
+			addrs := make([]string, workers)
+			for i := 0; i < workers; i++ {
+				addrs[i] = fmt.Sprintf("0x%040d", i)
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = BindIdentity(ctx, store, addrs[i], p, &Identity{ID: "same-account"})
+				}(i)
+			}
+			wg.Wait()
+
+			success := 0
+			for _, err := range errs {
+				switch {
+				case err == nil:
+					success++
+				case errors.Is(err, ErrHasBound):
+				default:
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+			if success != 1 {
+				t.Errorf("%d addresses bound the same account, want 1", success)
+			}
+			linked, err := store.List(ctx, addrs, p.Type())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(linked) != 1 {
+				t.Errorf("got %d rows, want 1", len(linked))
+			}
+		})
+	}
+}
+
+func TestBindingStore(t *testing.T) {
+	for name, newStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+			p := testProvider{platformType: "test-store"}
+			alice, bob := fmt.Sprintf("0x%040d", 1), fmt.Sprintf("0x%040d", 2)
+
+			if err := BindIdentity(ctx, store, alice, p, &Identity{ID: "1", Handle: "old"}); err != nil {
+				t.Fatal(err)
+			}
+			// 重复绑定刷新账号信息, 绑定新账号替换旧账号
+			if err := BindIdentity(ctx, store, alice, p, &Identity{ID: "1", Handle: "new"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := BindIdentity(ctx, store, bob, p, &Identity{ID: "1"}); !errors.Is(err, ErrHasBound) {
+				t.Fatalf("bind bound identity: got %v, want ErrHasBound", err)
+			}
+			if err := BindIdentity(ctx, store, alice, p, &Identity{ID: "2", Handle: "second"}); err != nil {
+				t.Fatal(err)
+			}
+			linked, err := store.GetByAddress(ctx, alice)
+			if err != nil || len(linked) != 1 || linked[0].Subject != "2" || linked[0].Handle != "second" {
+				t.Fatalf("GetByAddress = %+v, %v", linked, err)
+			}
+			if _, err := LookupAddress(ctx, store, p, "1"); !errors.Is(err, ErrNotBound) {
+				t.Fatalf("lookup replaced identity: got %v, want ErrNotBound", err)
+			}
+			if addr, err := LookupAddress(ctx, store, p, "2"); err != nil || addr != alice {
+				t.Fatalf("LookupAddress = %q, %v", addr, err)
+			}
+
+			if err := UnbindIdentity(ctx, store, alice, p); err != nil {
+				t.Fatal(err)
+			}
+			if err := UnbindIdentity(ctx, store, alice, p); !errors.Is(err, ErrNotBound) {
+				t.Fatalf("unbind twice: got %v, want ErrNotBound", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package module
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/KNN3-Network/oauth-server/utils"
+	"go.uber.org/zap"
+)
+
+// ConsentScope 授权页面上的一项 scope, identity scope 带上地址绑定的账号, 没有绑定时为 nil
+type ConsentScope struct {
+	Scope   string   `json:"scope"`
+	Account *Account `json:"account,omitempty"`
+	// Granted 之前已经授权过
+	Granted bool `json:"granted"`
+}
+
+// ConsentPage 授权页面展示的内容. Ticket 放在页面中, Nonce 放在只有本服务能读的 cookie 中,
+// 提交授权结果时两者一起校验, 拿到页面内容的第三方不能代替用户同意
+type ConsentPage struct {
+	Request *AuthorizeRequest
+	Client  *utils.OAuthClient
+	Address string
+	Scopes  []ConsentScope
+	Ticket  string
+	Nonce   string
+}
+
+// consentTicket 授权页面提交的凭证, 把签名的授权请求、登录的地址和 cookie 中的 nonce 绑定在一起.
+// 只保存 nonce 的 sha256, 凭证泄露也不能伪造 cookie
+type consentTicket struct {
+	Request   string `json:"r"`
+	Address   string `json:"a"`
+	NonceHash string `json:"n"`
+	Expiry    int64  `json:"e"`
+}
+
+// GrantInfo 用户查看的一项授权
+type GrantInfo struct {
+	ClientID   string    `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Consent 用户 address 登录后打开授权页面. 已经授权过申请的全部 scope 且没有 prompt=consent 时
+// 直接签发授权码, 返回跳转回应用的地址; 否则返回授权页面的内容
+func (a *AuthServer) Consent(ctx context.Context, raw string, address string) (*ConsentPage, string, error) {
+	req, client, err := a.Describe(ctx, raw)
+	if err != nil {
+		return nil, "", err
+	}
+	var granted []string
+	grant, err := a.store.GetGrant(ctx, address, req.ClientID)
+	switch {
+	case err == nil:
+		granted = strings.Fields(grant.Scope)
+	case !errors.Is(err, utils.ErrGrantNotFound):
+		return nil, "", err
+	}
+	if grant != nil && req.Prompt != "consent" && len(intersectScopes(req.Scopes(), granted)) == len(req.Scopes()) {
+		redirect, err := a.Approve(ctx, raw, address, nil)
+		return nil, redirect, err
+	}
+
+	accounts, err := Bindings(ctx, a.store, a.providers, address, false)
+	if err != nil {
+		return nil, "", err
+	}
+	page := &ConsentPage{Request: req, Client: client, Address: address}
+	for _, scope := range req.Scopes() {
+		item := ConsentScope{Scope: scope, Granted: containsString(granted, scope)}
+		for i := range accounts {
+			if IdentityScope(accounts[i].Type) == scope {
+				item.Account = &accounts[i]
+			}
+		}
+		page.Scopes = append(page.Scopes, item)
+	}
+	if page.Nonce, err = utils.RandomToken(16); err != nil {
+		return nil, "", err
+	}
+	payload, err := json.Marshal(consentTicket{Request: raw, Address: address, NonceHash: utils.HashToken(page.Nonce), Expiry: req.Expiry})
+	if err != nil {
+		return nil, "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	page.Ticket = encoded + "." + a.flow.sign(purposeConsent, encoded)
+	return page, "", nil
+}
+
+// ParseConsent 校验授权页面提交的凭证和 cookie 中的 nonce, 返回授权请求和登录的地址. 每个凭证只能提交一次
+func (a *AuthServer) ParseConsent(ctx context.Context, ticket, nonce string) (string, string, error) {
+	encoded, sig, ok := strings.Cut(ticket, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(a.flow.sign(purposeConsent, encoded))) {
+		return "", "", ErrAuthorizeRequestInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", ErrAuthorizeRequestInvalid
+	}
+	t := &consentTicket{}
+	if err := json.Unmarshal(payload, t); err != nil || t.Request == "" || t.Address == "" || t.NonceHash == "" {
+		return "", "", ErrAuthorizeRequestInvalid
+	}
+	if nonce == "" || !hmac.Equal([]byte(utils.HashToken(nonce)), []byte(t.NonceHash)) {
+		return "", "", ErrAuthorizeRequestInvalid
+	}
+	if time.Now().Unix() > t.Expiry {
+		return "", "", ErrAuthorizeRequestExpired
+	}
+	fresh, err := a.flow.consumeNonce(ctx, purposeConsent+t.NonceHash, t.Expiry)
+	if err != nil {
+		return "", "", err
+	}
+	if !fresh {
+		a.logger.Warn("consent ticket replayed", zap.String("addr", t.Address))
+		return "", "", ErrAuthorizeRequestInvalid
+	}
+	return t.Request, t.Address, nil
+}
+
+// Grants 地址授权过的应用
+func (a *AuthServer) Grants(ctx context.Context, address string) ([]GrantInfo, error) {
+	grants, err := a.store.ListGrants(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	list := []GrantInfo{}
+	for _, grant := range grants {
+		info := GrantInfo{ClientID: grant.ClientID, Scopes: strings.Fields(grant.Scope), CreatedAt: grant.CreatedAt, UpdatedAt: grant.UpdatedAt}
+		client, err := a.store.GetClient(ctx, grant.ClientID)
+		if err != nil && !errors.Is(err, utils.ErrClientNotFound) {
+			return nil, err
+		}
+		if client != nil {
+			info.ClientName = client.Name
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+// RevokeGrant 撤销地址对应用的授权以及签发给应用的所有会话, 没有授权时返回 utils.ErrGrantNotFound
+func (a *AuthServer) RevokeGrant(ctx context.Context, address, clientID string) error {
+	if err := a.store.DeleteGrant(ctx, address, clientID); err != nil {
+		return err
+	}
+	revoked, err := a.sessions.RevokeClient(ctx, clientID, address)
+	if err != nil {
+		return err
+	}
+	a.logger.Info("consent revoked", zap.String("client_id", clientID), zap.String("addr", address), zap.Int("sessions", revoked))
+	return nil
+}
+
+// saveGrant 保存用户的授权. 已有授权中本次没有申请的 scope 保留, 申请的 scope 以本次同意的为准
+func (a *AuthServer) saveGrant(ctx context.Context, address string, req *AuthorizeRequest, approved []string) error {
+	scopes := approved
+	grant, err := a.store.GetGrant(ctx, address, req.ClientID)
+	switch {
+	case err == nil:
+		for _, scope := range strings.Fields(grant.Scope) {
+			if !containsString(req.Scopes(), scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	case !errors.Is(err, utils.ErrGrantNotFound):
+		return err
+	}
+	return a.store.SaveGrant(ctx, &utils.ConsentGrant{Addr: address, ClientID: req.ClientID, Scope: strings.Join(scopes, " ")})
+}
+
+// effectiveScope scope 与地址对应用当前授权的交集, 没有授权时返回 utils.ErrGrantNotFound
+func (a *AuthServer) effectiveScope(ctx context.Context, address, clientID, scope string) (string, error) {
+	grant, err := a.store.GetGrant(ctx, address, clientID)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(intersectScopes(strings.Fields(scope), strings.Fields(grant.Scope)), " "), nil
+}
+
+// intersectScopes scopes 中同时在 allowed 里的部分, 保持 scopes 的顺序
+func intersectScopes(scopes, allowed []string) []string {
+	result := []string{}
+	for _, scope := range scopes {
+		if containsString(allowed, scope) && !containsString(result, scope) {
+			result = append(result, scope)
+		}
+	}
+	return result
+}
+
+// BindingFilter 绑定查询接口按调用方过滤返回的账号: 地址本人看到全部, 第三方应用只看到地址授权过的平台,
+// 其他调用方在 private 时看不到任何账号. 为 nil 时不过滤
+type BindingFilter struct {
+	owner    string
+	clientID string
+	private  bool
+	// grants 第三方应用查询的地址 (小写) 授权过的 scope
+	grants map[string][]string
+}
+
+// NewBindingFilter owner 为本服务 jwt 中的地址, clientID 为第三方应用 access token 的 client_id, 都可以为空.
+// addrs 为要查询的地址, 第三方应用查询时预先加载这些地址的授权
+func (a *AuthServer) NewBindingFilter(ctx context.Context, owner, clientID string, private bool, addrs []string) (*BindingFilter, error) {
+	f := &BindingFilter{owner: strings.ToLower(owner), clientID: clientID, private: private, grants: map[string][]string{}}
+	if clientID == "" {
+		return f, nil
+	}
+	for start := 0; start < len(addrs); start += batchChunkSize {
+		end := start + batchChunkSize
+		if end > len(addrs) {
+			end = len(addrs)
+		}
+		grants, err := a.store.ListClientGrants(ctx, clientID, addrs[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for _, grant := range grants {
+			f.grants[strings.ToLower(grant.Addr)] = strings.Fields(grant.Scope)
+		}
+	}
+	return f, nil
+}
+
+// Allow 调用方能否看到 addr 绑定的该平台账号
+func (f *BindingFilter) Allow(addr, platformType string) bool {
+	if f == nil {
+		return true
+	}
+	addr = strings.ToLower(addr)
+	if f.clientID != "" {
+		return containsString(f.grants[addr], IdentityScope(platformType))
+	}
+	if f.owner != "" && f.owner == addr {
+		return true
+	}
+	return !f.private
+}
+
+// Accounts 过滤 addr 的账号
+func (f *BindingFilter) Accounts(addr string, accounts []Account) []Account {
+	if f == nil {
+		return accounts
+	}
+	list := []Account{}
+	for _, account := range accounts {
+		if f.Allow(addr, account.Type) {
+			list = append(list, account)
+		}
+	}
+	return list
+}
@@ -1,80 +1,131 @@
 package module
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"context"
 	"net/http"
 	"net/url"
-	"os"
+	"strings"
+	"time"
 
+	"github.com/KNN3-Network/oauth-server/config"
 	discord "github.com/bwmarrin/discordgo"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 )
 
-var clientID, clientSecret, redirectURI string
+type Discord struct {
+	oauthConfig *oauth2.Config
+	apiURL      string
+	client      *http.Client
+	logger      *zap.Logger
+}
+
+// discordToken discord token 接口的响应
+type discordToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Scope        string `json:"scope"`
+}
+
+func NewDiscord(cfg *config.Config, client *http.Client, logger *zap.Logger) *Discord {
+	return &Discord{
+		oauthConfig: &oauth2.Config{
+			ClientID:     cfg.Discord.ClientID,
+			ClientSecret: cfg.Discord.ClientSecret,
+			RedirectURL:  cfg.Discord.RedirectURL,
+			Scopes:       []string{"identify"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  cfg.Discord.Endpoint.AuthURL,
+				TokenURL: cfg.Discord.Endpoint.TokenURL,
+			},
+		},
+		apiURL: strings.TrimSuffix(cfg.Discord.Endpoint.APIURL, "/"),
+		client: client,
+		logger: logger,
+	}
+}
+
+func (*Discord) Type() string { return "discord" }
 
-func init() {
-	// err := godotenv.Load()
-	// if err != nil {
-	// 	log.Fatal("Error loading .env file")
-	// }
-	clientID = os.Getenv("DISCORD_ID")
-	clientSecret = os.Getenv("DISCORD_SECRET")
-	redirectURI = "https://knn3-gateway.knn3.xyz/oauth/discord"
+func (d *Discord) AuthCodeURL(client string, state string, challenge string) string {
+	return d.oauthConfig.AuthCodeURL(state, pkceAuthOptions(challenge)...)
+}
+
+func (*Discord) CallbackPath() string { return "/oauth/discord" }
+
+func (*Discord) Callback(c *gin.Context, flow *Flow) { flow.defaultCallback(c, "discord") }
+
+func (d *Discord) Exchange(ctx context.Context, code string, verifier string) (*oauth2.Token, error) {
+	return d.ExchangeCodeForToken(ctx, code, verifier)
+}
+
+func (d *Discord) FetchIdentity(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+	user, err := d.FetchUser(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	d.logger.Info("userInfo", zap.Any("user", user.ID))
+	d.logger.Info("discord username", zap.Any("username", user.Username))
+	d.logger.Info("discord avatar", zap.Any("user", user.Avatar))
+	return &Identity{ID: user.ID, Handle: user.Username, Name: user.Username, Metadata: map[string]interface{}{"avatar": user.AvatarURL("")}}, nil
 }
 
-func ExchangeCodeForToken(code string) (*oauth2.Token, error) {
+func (d *Discord) ExchangeCodeForToken(ctx context.Context, code string, verifier string) (*oauth2.Token, error) {
 	form := url.Values{}
-	form.Add("client_id", clientID)
-	form.Add("client_secret", clientSecret)
+	form.Add("client_id", d.oauthConfig.ClientID)
+	form.Add("client_secret", d.oauthConfig.ClientSecret)
 	form.Add("grant_type", "authorization_code")
 	form.Add("code", code)
-	form.Add("redirect_uri", redirectURI)
+	form.Add("redirect_uri", d.oauthConfig.RedirectURL)
+	if verifier != "" {
+		form.Add("code_verifier", verifier)
+	}
 
-	resp, err := http.PostForm("https://discordapp.com/api/oauth2/token", form)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.oauthConfig.Endpoint.TokenURL, strings.NewReader(form.Encode()))
 	if err != nil {
-		fmt.Println("err:", err)
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := d.client.Do(req)
 	if err != nil {
+		d.logger.Error("failed to exchange discord code:", zap.Error(err))
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	var token oauth2.Token
-	err = json.Unmarshal(body, &token)
-	if err != nil {
+	var token discordToken
+	if err := decodeResponse("discord", resp, &token); err != nil {
 		return nil, err
 	}
+	if token.AccessToken == "" {
+		return nil, &ProviderError{Provider: "discord", Status: resp.StatusCode, Code: "invalid_response", Message: "missing access_token"}
+	}
 
-	return &token, nil
+	result := &oauth2.Token{AccessToken: token.AccessToken, TokenType: token.TokenType, RefreshToken: token.RefreshToken}
+	if token.ExpiresIn > 0 {
+		result.Expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return result, nil
 }
 
-func FetchUser(token *oauth2.Token) (*discord.User, error) {
-	req, err := http.NewRequest("GET", "https://discordapp.com/api/users/@me", nil)
+func (d *Discord) FetchUser(ctx context.Context, token *oauth2.Token) (*discord.User, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.apiURL+"/users/@me", nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := d.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
 	var user discord.User
-	err = json.Unmarshal(body, &user)
-	if err != nil {
+	if err := decodeResponse("discord", resp, &user); err != nil {
 		return nil, err
 	}
 
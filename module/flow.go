@@ -0,0 +1,54 @@
+package module
+
+import (
+	"crypto/rand"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"go.uber.org/zap"
+)
+
+// Flow 授权流程中各平台共享的状态: state 的签名密钥和已经使用的 nonce、
+// PKCE 的 code_verifier、跳转白名单和前端 pass 页面
+type Flow struct {
+	logger *zap.Logger
+	// store 保存 PKCE 的 code_verifier 和已经使用的 nonce, 多个实例共享
+	store utils.NonceStore
+
+	stateSecret []byte
+
+	pkceProviders map[string]bool
+
+	// redirectAllowlist 每个 client 允许跳转的地址.
+	// 以 * 结尾的为前缀匹配, 其余为完整匹配
+	redirectAllowlist map[string][]string
+	// passURL 前端完成绑定的页面
+	passURL string
+}
+
+// NewFlow 使用配置创建授权流程. config.Load 要求配置 STATE_SECRET, 直接构造的配置 (如测试) 没有密钥时
+// 使用随机密钥, 签发的 state 只在当前进程内有效
+func NewFlow(cfg *config.Config, store utils.NonceStore, logger *zap.Logger) *Flow {
+	f := &Flow{
+		logger:            logger,
+		store:             store,
+		stateSecret:       []byte(cfg.OAuth.StateSecret),
+		pkceProviders:     map[string]bool{},
+		redirectAllowlist: cfg.OAuth.RedirectAllowlist,
+		passURL:           cfg.Server.PassURL,
+	}
+	if len(f.stateSecret) == 0 {
+		f.stateSecret = make([]byte, 32)
+		if _, err := rand.Read(f.stateSecret); err != nil {
+			panic(err)
+		}
+		logger.Warn("STATE_SECRET is empty, using a random secret")
+	}
+	// 默认开启 github,discord,gmail, stackexchange 不支持. 设置为 none 时全部关闭
+	for _, platformType := range cfg.OAuth.PKCEProviders {
+		f.pkceProviders[platformType] = true
+	}
+	logger.Info("pkce providers", zap.Any("providers", f.pkceProviders))
+	logger.Info("redirect allowlist", zap.Any("allowlist", f.redirectAllowlist))
+	return f
+}
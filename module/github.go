@@ -1,54 +1,111 @@
 package module
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
+	"strings"
 
+	"github.com/KNN3-Network/oauth-server/config"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/github"
 )
 
-var (
-	githubOauthConfig *oauth2.Config
-	transformer_url   string
-)
+type Github struct {
+	oauthConfig *oauth2.Config
+	apiURL      string
+	// transformerRedirectURL 带 source 的回调跳转到 transformer 前端
+	transformerRedirectURL string
+	apiToken               string
+	client                 *http.Client
+	logger                 *zap.Logger
+}
 
-var respData struct {
-	Token string `json:"token"`
-	Email string `json:"email"`
+// GithubUser GET /user 的响应, 只保留用到的字段
+type GithubUser struct {
+	ID        int64  `json:"id"`
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url"`
 }
 
-func init() {
-	// err := godotenv.Load()
-	// if err != nil {
-	// 	log.Fatal("Error loading .env file")
-	// }
-	transformer_url = os.Getenv("TRANSFORMER_URL")
-	githubOauthConfig = &oauth2.Config{
-		ClientID:     os.Getenv("CLIENT_ID"),
-		ClientSecret: os.Getenv("CLIENT_SECRET"),
-		RedirectURL:  os.Getenv("REDIRECT_URL"),
-		Scopes:       []string{"read:user", "user:email"}, // 请求用户信息和邮箱权限
-		Endpoint:     github.Endpoint,
+func NewGithub(cfg *config.Config, client *http.Client, logger *zap.Logger) *Github {
+	return &Github{
+		oauthConfig: &oauth2.Config{
+			ClientID:     cfg.Github.ClientID,
+			ClientSecret: cfg.Github.ClientSecret,
+			RedirectURL:  cfg.Github.RedirectURL,
+			Scopes:       []string{"read:user", "user:email"}, // 请求用户信息和邮箱权限
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  cfg.Github.Endpoint.AuthURL,
+				TokenURL: cfg.Github.Endpoint.TokenURL,
+			},
+		},
+		apiURL:                 strings.TrimSuffix(cfg.Github.Endpoint.APIURL, "/"),
+		transformerRedirectURL: cfg.Server.TransformerRedirectURL,
+		apiToken:               cfg.Github.APIToken,
+		client:                 client,
+		logger:                 logger,
 	}
 }
 
-func RequestGithubUserInfo(c *gin.Context, code string) (map[string]interface{}, error) {
-	// 使用OAuth配置对象中定义的Exchange方法，通过code获取access token
-	token, err := githubOauthConfig.Exchange(c, code)
+func (*Github) Type() string { return "github" }
+
+func (g *Github) AuthCodeURL(client string, state string, challenge string) string {
+	return g.oauthConfig.AuthCodeURL(state, pkceAuthOptions(challenge)...)
+}
+
+func (*Github) CallbackPath() string { return "/oauth/github" }
+
+// Exchange 使用OAuth配置对象中定义的Exchange方法，通过code获取access token
+func (g *Github) Exchange(ctx context.Context, code string, verifier string) (*oauth2.Token, error) {
+	token, err := g.oauthConfig.Exchange(withClient(ctx, g.client), code, pkceExchangeOptions(verifier)...)
+	return token, wrapProviderError("github", err)
+}
+
+func (g *Github) FetchIdentity(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+	user, err := g.RequestGithubUserInfo(ctx, token)
 	if err != nil {
-		logger.Error("failed to exchange token:", zap.Error(err))
-		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("获取token错误"))
 		return nil, err
 	}
-	client := githubOauthConfig.Client(c, token)
-	req, err := http.NewRequest("GET", "https://api.github.com/user", nil)
+	g.logger.Info("userInfo", zap.Any("user", user))
+	if user.ID == 0 || user.Login == "" {
+		return nil, &ProviderError{Provider: "github", Status: http.StatusOK, Code: "invalid_response", Message: "missing id or login"}
+	}
+	// login 可以改名, 改名后还可能被其他人注册, 绑定使用数字 id
+	return &Identity{
+		ID:       strconv.FormatInt(user.ID, 10),
+		Handle:   user.Login,
+		Name:     user.Name,
+		Metadata: map[string]interface{}{"avatar": user.AvatarURL},
+		LegacyID: user.Login,
+	}, nil
+}
+
+// Callback github oauth
+func (g *Github) Callback(c *gin.Context, flow *Flow) {
+	if _, ok := flow.verifyCallback(c, "github"); !ok {
+		return
+	}
+	code := c.Query("code")
+	source := c.Query("source")
+	g.logger.Info("github oauth认证", zap.String("code", code))
+	g.logger.Info("github oauth source", zap.String("source", source))
+	if source != "" {
+		// 拼接 transformer 地址 + source + ?type=github&code= + code
+		target := fmt.Sprintf("%s/%s?type=github&code=%s&state=%s", strings.TrimSuffix(g.transformerRedirectURL, "/"), source, code, url.QueryEscape(c.Query("state")))
+		c.Redirect(http.StatusTemporaryRedirect, target)
+	} else {
+		flow.passRedirect(c, "github")
+	}
+}
+
+func (g *Github) RequestGithubUserInfo(ctx context.Context, token *oauth2.Token) (*GithubUser, error) {
+	client := g.oauthConfig.Client(withClient(ctx, g.client), token)
+	req, err := http.NewRequestWithContext(ctx, "GET", g.apiURL+"/user", nil)
 	if err != nil {
 		return nil, fmt.Errorf("get user info request failed: %w", err)
 	}
@@ -60,68 +117,33 @@ func RequestGithubUserInfo(c *gin.Context, code string) (map[string]interface{},
 
 	defer resp.Body.Close()
 
-	var userInfo map[string]interface{}
-	if err := decodeResponse(resp, &userInfo); err != nil {
+	var user GithubUser
+	if err := decodeResponse("github", resp, &user); err != nil {
 		return nil, err
 	}
 
-	return userInfo, nil
+	return &user, nil
 }
 
-func GithubLogin(c *gin.Context, code string) {
-	defer func() {
-		if err := recover(); err != nil {
-			if e, ok := err.(error); ok {
-				logger.Error("failed to github login:", zap.Error(e))
-				c.AbortWithError(http.StatusBadRequest, fmt.Errorf("github登录错误"))
-			} else {
-				logger.Error("failed to github login:", zap.Any("error", err))
-				c.AbortWithError(http.StatusBadRequest, fmt.Errorf("github登录错误"))
-			}
-		}
-	}()
-	userInfo, err := RequestGithubUserInfo(c, code)
-	if err != nil {
-		logger.Error("failed to get user info:", zap.Error(err))
-		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("获取github用户信息错误"))
-		return
-	}
-	github := userInfo["login"].(string)
-	// 构造请求 URL
-	reqURL, err := url.Parse(transformer_url + "/api/users/thirdPartyLogin")
+// LookupUser 通过 login 查询 github 用户, 用于把旧的 login 绑定回填为数字 id
+func (g *Github) LookupUser(ctx context.Context, login string) (*GithubUser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", g.apiURL+"/users/"+url.PathEscape(login), nil)
 	if err != nil {
-		// 处理 URL 解析错误
-		fmt.Printf("Error parsing URL: %v\n", err)
-		return
-	}
-	// 构建请求体数据
-	requestBody := map[string]string{
-		"third_party_type": "github",
-		"third_party_id":   github,
+		return nil, err
 	}
-	jsonBody, err := json.Marshal(requestBody)
-	if err != nil {
-		// 处理请求体数据序列化错误
-		fmt.Printf("Error serializing request body: %v\n", err)
-		return
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if g.apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+g.apiToken)
 	}
-
-	// 发送 POST 请求
-	resp, err := http.Post(reqURL.String(), "application/json", bytes.NewBuffer(jsonBody))
+	resp, err := g.client.Do(req)
 	if err != nil {
-		// 处理请求错误
-		fmt.Printf("Error sending request: %v\n", err)
-		return
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
-		// 处理响应体解析错误
-		fmt.Printf("Error parsing response body: %v\n", err)
-		return
+	var user GithubUser
+	if err := decodeResponse("github", resp, &user); err != nil {
+		return nil, err
 	}
-	// 输出响应数据中的 JWT 字段
-	fmt.Printf("JWT: %s\n", respData.Token)
-	// 返回响应数据为 json, {github,jwt:respData.JWT}
-	c.JSON(http.StatusOK, gin.H{"github": github, "jwt": respData.Token})
+	return &user, nil
 }
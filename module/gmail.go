@@ -1,141 +1,255 @@
 package module
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
-	"os"
 	"strings"
 
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	gmail "google.golang.org/api/gmail/v1"
 )
 
-var (
+type Gmail struct {
 	oauthConfig *oauth2.Config
-	oauthState  = "random-string" // 可以使用随机生成的字符串
-
+	// apiURL gmail api 的 BasePath
+	apiURL string
+	// knexus 的 gmail 登录使用单独的 oauth 应用
 	oauthKnexusConfig *oauth2.Config
-)
+	// knexusAPI 用 gmail 换取 knexus access token 的接口
+	knexusAPI string
+	client    *http.Client
+	logger    *zap.Logger
+}
 
-var clientGamilID, clientGmailSecret, redirectGmailURI string
-
-func init() {
-	// err := godotenv.Load()
-	// if err != nil {
-	// 	log.Fatal("Error loading .env file")
-	// }
-	oauthConfig = &oauth2.Config{
-		ClientID:     os.Getenv("GMAIL_ID"),                       // 替换为实际的客户端ID
-		ClientSecret: os.Getenv("GMAIL_SECRET"),                   // 替换为实际的客户端密钥
-		RedirectURL:  "https://knn3-gateway.knn3.xyz/oauth/gmail", // 替换为实际的回调URL
+func NewGmail(cfg *config.Config, client *http.Client, logger *zap.Logger) *Gmail {
+	endpoint := oauth2.Endpoint{
+		AuthURL:   cfg.Gmail.Endpoint.AuthURL,
+		TokenURL:  cfg.Gmail.Endpoint.TokenURL,
+		AuthStyle: google.Endpoint.AuthStyle,
+	}
+	oauthConfig := &oauth2.Config{
+		ClientID:     cfg.Gmail.ClientID,
+		ClientSecret: cfg.Gmail.ClientSecret,
+		RedirectURL:  cfg.Gmail.RedirectURL,
 		Scopes: []string{
 			gmail.GmailReadonlyScope,
+			"openid", // id_token 中的 sub 作为绑定的账号 id
 		},
-		Endpoint: google.Endpoint,
+		Endpoint: endpoint,
 	}
 
 	logger.Info("gmail oauthConfig", zap.Any("url", oauthConfig))
 
-	oauthKnexusConfig = &oauth2.Config{
-		ClientID:     os.Getenv("KNEXUS_GMAIL_ID"),           // 替换为实际的客户端ID
-		ClientSecret: os.Getenv("KNEXUS_GMAIL_SECRET"),       // 替换为实际的客户端密钥
-		RedirectURL:  os.Getenv("KNEXUS_GMAIL_REDIRECT_URL"), // 替换为实际的回调URL
+	oauthKnexusConfig := &oauth2.Config{
+		ClientID:     cfg.Knexus.GmailClientID,
+		ClientSecret: cfg.Knexus.GmailClientSecret,
+		RedirectURL:  cfg.Knexus.GmailRedirectURL,
 		Scopes: []string{
 			gmail.GmailReadonlyScope,
+			"openid", // id_token 中的 sub 作为绑定的账号 id
 		},
-		Endpoint: google.Endpoint,
+		Endpoint: endpoint,
 	}
 
 	logger.Info("gmail oauthKnexusConfig", zap.Any("url", oauthKnexusConfig))
 
-	url := oauthKnexusConfig.AuthCodeURL("knexus$success=https://knexus.xyz$fail=https://knexus.xyz")
-	logger.Info("gmail oauth AuthCodeURL", zap.String("url", url))
+	return &Gmail{
+		oauthConfig:       oauthConfig,
+		oauthKnexusConfig: oauthKnexusConfig,
+		apiURL:            cfg.Gmail.Endpoint.APIURL,
+		knexusAPI:         cfg.Knexus.API,
+		client:            client,
+		logger:            logger,
+	}
+}
+
+func (*Gmail) Type() string { return "gmail" }
+
+// Mask 邮箱只保留首字母和域名, 如 a***@gmail.com. 账号 id 可以用来关联其他服务, 同样隐藏
+func (*Gmail) Mask(identity *Identity) *Identity {
+	masked := maskEmail(identity.Handle)
+	return &Identity{ID: masked, Handle: masked}
+}
+
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// AuthCodeURL knexus 的 gmail 登录使用单独的 oauth 应用
+func (g *Gmail) AuthCodeURL(client string, state string, challenge string) string {
+	if isKnexusClient(client) {
+		return g.oauthKnexusConfig.AuthCodeURL(state, pkceAuthOptions(challenge)...)
+	}
+	return g.oauthConfig.AuthCodeURL(state, pkceAuthOptions(challenge)...)
+}
 
+func isKnexusClient(client string) bool {
+	return client == "knexus" || client == "knexus_early"
 }
 
-func GetGmailProfile(code string) (*gmail.Profile, error) {
-	token, err := oauthConfig.Exchange(context.Background(), code)
+func (*Gmail) CallbackPath() string { return "/oauth/gmail" }
+
+func (g *Gmail) Exchange(ctx context.Context, code string, verifier string) (*oauth2.Token, error) {
+	token, err := g.oauthConfig.Exchange(withClient(ctx, g.client), code, pkceExchangeOptions(verifier)...)
+	return token, wrapProviderError("gmail", err)
+}
+
+func (g *Gmail) FetchIdentity(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+	sub, err := idTokenSubject(token)
 	if err != nil {
-		fmt.Println("err:", err)
 		return nil, err
 	}
-	client := oauthConfig.Client(context.Background(), token)
-	gmailService, err := gmail.New(client)
+	profile, err := g.profile(ctx, g.oauthConfig, token)
 	if err != nil {
-		fmt.Println("err:", err)
 		return nil, err
 	}
+	return &Identity{ID: sub, Handle: profile.EmailAddress, LegacyID: profile.EmailAddress}, nil
+}
 
-	profile, err := gmailService.Users.GetProfile("me").Do()
+// idTokenSubject 读取 token 响应中 id_token 的 sub.
+// id_token 是直接通过 TLS 从 google 的 token 接口拿到的, 按 OpenID Connect Core 3.1.3.7 可以不校验签名
+func idTokenSubject(token *oauth2.Token) (string, error) {
+	idToken, _ := token.Extra("id_token").(string)
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", &ProviderError{Provider: "gmail", Status: http.StatusOK, Code: "invalid_response", Message: "missing id_token"}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		fmt.Println("err:", err)
-		return nil, err
+		return "", &ProviderError{Provider: "gmail", Status: http.StatusOK, Code: "invalid_response", Message: "malformed id_token"}
 	}
-	return profile, nil
-
+	var claims struct {
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Sub == "" {
+		return "", &ProviderError{Provider: "gmail", Status: http.StatusOK, Code: "invalid_response", Message: "id_token without sub"}
+	}
+	return claims.Sub, nil
 }
 
-func GetGmailProfileByKnexus(code string) (*gmail.Profile, error) {
-	token, err := oauthKnexusConfig.Exchange(context.Background(), code)
-	if err != nil {
-		fmt.Println("err:", err)
-		return nil, err
+// Callback gmail oauth, state 的 client 为 knexus 时走 knexus 的 gmail 登录
+func (g *Gmail) Callback(c *gin.Context, flow *Flow) {
+	state, ok := flow.verifyCallback(c, "gmail")
+	if !ok {
+		return
 	}
-	client := oauthKnexusConfig.Client(context.Background(), token)
+	code := c.Query("code")
+	g.logger.Info("gmail oauth认证", zap.String("code", code), zap.String("client", state.Client))
+
+	// knexus gmail login
+	if isKnexusClient(state.Client) {
+		if !flow.AllowRedirect(state.Client, state.Success) || !flow.AllowRedirect(state.Client, state.Fail) {
+			g.logger.Error("gmail redirect not allowed", zap.String("success", state.Success), zap.String("fail", state.Fail))
+			redirectError(c)
+			return
+		}
+		verifier := ""
+		if flow.PKCEEnabled(g) {
+			var err error
+			if verifier, err = flow.takePKCEVerifier(c.Request.Context(), state); err != nil {
+				g.logger.Error("gmail pkce error:", zap.Error(err))
+				redirectError(c)
+				return
+			}
+		}
+		profile, err := g.GetGmailProfileByKnexus(c.Request.Context(), code, verifier)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("authorization error code"))
+			return
+		}
+
+		source := "normal"
+		if state.Client == "knexus_early" {
+			source = "early"
+		}
+
+		accessToken, err := g.GetAccessToken(c.Request.Context(), profile.EmailAddress, source)
+		if err != nil {
+			c.Redirect(http.StatusMovedPermanently, state.Fail)
+			return
+		}
+
+		c.Redirect(http.StatusMovedPermanently, appendQuery(state.Success, "j", base64.StdEncoding.EncodeToString([]byte(accessToken))))
+		return
+	}
+
+	flow.passRedirect(c, "gmail")
+}
+
+// profile 用 token 读取 gmail 账号信息
+func (g *Gmail) profile(ctx context.Context, config *oauth2.Config, token *oauth2.Token) (*gmail.Profile, error) {
+	client := config.Client(withClient(ctx, g.client), token)
 	gmailService, err := gmail.New(client)
 	if err != nil {
-		fmt.Println("err:", err)
+		g.logger.Error("failed to create gmail service:", zap.Error(err))
 		return nil, err
 	}
+	gmailService.BasePath = g.apiURL
 
-	profile, err := gmailService.Users.GetProfile("me").Do()
+	profile, err := gmailService.Users.GetProfile("me").Context(ctx).Do()
 	if err != nil {
-		fmt.Println("err:", err)
-		return nil, err
+		g.logger.Error("failed to get gmail profile:", zap.Error(err))
+		return nil, wrapProviderError("gmail", err)
 	}
 	return profile, nil
+}
 
+func (g *Gmail) GetGmailProfileByKnexus(ctx context.Context, code string, verifier string) (*gmail.Profile, error) {
+	token, err := g.oauthKnexusConfig.Exchange(withClient(ctx, g.client), code, pkceExchangeOptions(verifier)...)
+	if err != nil {
+		g.logger.Error("failed to exchange knexus gmail code:", zap.Error(err))
+		return nil, wrapProviderError("gmail", err)
+	}
+	return g.profile(ctx, g.oauthKnexusConfig, token)
 }
 
 // GetAccessToken GetAccessToken
 //
+//	@param ctx
 //	@param email
 //	@param source
 //	@return string
 //	@return error
-func GetAccessToken(email string, source string) (string, error) {
-	url := os.Getenv("KNEXUS_API")
-	method := "POST"
-
-	payload := strings.NewReader(`{"gmail": "` + email + `","type": "` + source + `"}`)
-
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, payload)
+func (g *Gmail) GetAccessToken(ctx context.Context, email string, source string) (string, error) {
+	payload, err := json.Marshal(map[string]string{"gmail": email, "type": source})
+	if err != nil {
+		return "", err
+	}
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.knexusAPI, bytes.NewReader(payload))
 	if err != nil {
-		fmt.Println("err:", err)
+		g.logger.Error("failed to create knexus request:", zap.Error(err))
 		return "", err
 	}
 	req.Header.Add("Content-Type", "application/json")
 
-	res, err := client.Do(req)
+	res, err := g.client.Do(req)
 	if err != nil {
-		fmt.Println("err:", err)
+		g.logger.Error("failed to request knexus access token:", zap.Error(err))
 		return "", err
 	}
 	defer res.Body.Close()
 
-	body, err := ioutil.ReadAll(res.Body)
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
 	if err != nil {
-		fmt.Println("err:", err)
+		g.logger.Error("failed to read knexus response:", zap.Error(err))
 		return "", err
 	}
-	fmt.Println(string(body))
-
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return "", newProviderError("knexus", res.StatusCode, body)
+	}
 	return string(body), nil
-
 }
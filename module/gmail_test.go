@@ -1,21 +1,37 @@
 package module
 
 import (
-	"log"
+	"context"
+	"net/http"
 	"testing"
 
-	"github.com/joho/godotenv"
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/fakeprovider"
+	"go.uber.org/zap"
 )
 
-func setup() {
-	err := godotenv.Load("~/Desktop/project/treasury/oauth-server/.env")
+func TestGetAccessToken(t *testing.T) {
+	fake := fakeprovider.New()
+	defer fake.Close()
+	cfg := config.Default()
+	fake.Configure(cfg, "http://oauth.test")
 
-	log.Print("setup")
+	token, err := NewGmail(cfg, http.DefaultClient, zap.NewNop()).GetAccessToken(context.Background(), "alice@gmail.com", "early")
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		t.Fatal(err)
+	}
+	if token != "knexus-early-alice@gmail.com" {
+		t.Fatalf("token = %q", token)
 	}
 }
 
-func TestGetAccessToken(t *testing.T) {
-	GetAccessToken()
+func TestMaskEmail(t *testing.T) {
+	for email, want := range map[string]string{
+		"alice@gmail.com": "a***@gmail.com",
+		"invalid":         "***",
+	} {
+		if got := maskEmail(email); got != want {
+			t.Errorf("maskEmail(%q) = %q, want %q", email, got, want)
+		}
+	}
 }
@@ -0,0 +1,189 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/KNN3-Network/oauth-server/utils"
+	"go.uber.org/zap"
+)
+
+// token_type_hint 和 IntrospectResponse.TokenType 的取值
+const (
+	TokenTypeAccessToken  = "access_token"
+	TokenTypeRefreshToken = "refresh_token"
+)
+
+// IntrospectResponse RFC 7662 的响应. 无效、过期、已撤销或调用方无权查看的 token 只返回 active=false
+type IntrospectResponse struct {
+	Active bool `json:"active"`
+	// Scope 第三方应用的 token 为当前仍然授权的 scope, 本服务自己的 jwt 为空
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Address   string `json:"address,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+	Sid       string `json:"sid,omitempty"`
+}
+
+// Introspect 供下游服务校验 token, 不需要持有签名密钥. 只有带 secret 的应用可以调用.
+// ResourceServer 可以校验本服务自己的 jwt 和签发给任意应用的 access token, 其他应用只能校验签发给自己的 token,
+// 以免任何一个 client_secret 都能查询所有用户的 token. 刷新令牌只对签发给调用方的返回 active
+func (a *AuthServer) Introspect(ctx context.Context, client *utils.OAuthClient, token, hint string) (*IntrospectResponse, error) {
+	if client.Public() {
+		return nil, oauthError(OAuthInvalidClient, "public client must not introspect tokens")
+	}
+	if token == "" {
+		return nil, oauthError(OAuthInvalidRequest, "token is required")
+	}
+	lookups := []func(context.Context, *utils.OAuthClient, string) (*IntrospectResponse, error){a.introspectAccessToken, a.introspectRefreshToken}
+	if hint == TokenTypeRefreshToken {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+	for _, lookup := range lookups {
+		resp, err := lookup(ctx, client, token)
+		if err != nil || resp.Active {
+			return resp, err
+		}
+	}
+	return &IntrospectResponse{}, nil
+}
+
+func (a *AuthServer) introspectAccessToken(ctx context.Context, client *utils.OAuthClient, token string) (*IntrospectResponse, error) {
+	claims, err := parseAccessToken(token)
+	if errors.Is(err, utils.ErrJwtRevocationCheck) {
+		return nil, err
+	}
+	if err != nil || (!client.ResourceServer && claims.ClientID != client.ClientID) {
+		return &IntrospectResponse{}, nil
+	}
+	resp := &IntrospectResponse{
+		Active:    true,
+		ClientID:  claims.ClientID,
+		TokenType: TokenTypeAccessToken,
+		Sub:       claims.Address,
+		Address:   claims.Address,
+		Iss:       claims.Issuer,
+		Jti:       claims.ID,
+		Sid:       claims.Sid,
+	}
+	if claims.ExpiresAt != nil {
+		resp.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		resp.Iat = claims.IssuedAt.Unix()
+	}
+	if claims.ClientID != "" {
+		// 用户撤销授权后应用的 access token 随即失效
+		scope, err := a.effectiveScope(ctx, claims.Address, claims.ClientID, claims.Scope)
+		if errors.Is(err, utils.ErrGrantNotFound) {
+			return &IntrospectResponse{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp.Scope = scope
+	}
+	return resp, nil
+}
+
+func (a *AuthServer) introspectRefreshToken(ctx context.Context, client *utils.OAuthClient, token string) (*IntrospectResponse, error) {
+	refresh, err := a.activeRefreshToken(ctx, token)
+	if err != nil || refresh == nil || refresh.ClientID != client.ClientID {
+		return &IntrospectResponse{}, err
+	}
+	scope, err := a.effectiveScope(ctx, refresh.Addr, refresh.ClientID, refresh.Scope)
+	if errors.Is(err, utils.ErrGrantNotFound) {
+		return &IntrospectResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &IntrospectResponse{
+		Active:    true,
+		Scope:     scope,
+		ClientID:  refresh.ClientID,
+		TokenType: TokenTypeRefreshToken,
+		Sub:       refresh.Addr,
+		Address:   refresh.Addr,
+		Exp:       refresh.ExpiresAt.Unix(),
+		Iat:       refresh.CreatedAt.Unix(),
+		Iss:       a.issuer,
+		Sid:       refresh.Family,
+	}, nil
+}
+
+// activeRefreshToken 查询未使用、未撤销也没有过期的刷新令牌, 不存在或已失效时返回 nil
+func (a *AuthServer) activeRefreshToken(ctx context.Context, token string) (*utils.RefreshToken, error) {
+	refresh, err := a.store.GetRefreshToken(ctx, utils.HashToken(token))
+	if errors.Is(err, utils.ErrRefreshTokenNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if refresh.UsedAt != nil || refresh.RevokedAt != nil || time.Now().After(refresh.ExpiresAt) {
+		return nil, nil
+	}
+	return refresh, nil
+}
+
+// Revoke RFC 7009 撤销签发给调用方的 token. 撤销刷新令牌时同时撤销它所属会话的 access token,
+// 撤销 access token 只让这一个 token 失效. 无效或已经失效的 token 按成功处理, 其他应用的 token 返回 unauthorized_client
+func (a *AuthServer) Revoke(ctx context.Context, client *utils.OAuthClient, token, hint string) error {
+	if token == "" {
+		return oauthError(OAuthInvalidRequest, "token is required")
+	}
+	revokes := []func(context.Context, *utils.OAuthClient, string) (bool, error){a.revokeRefreshToken, a.revokeAccessToken}
+	if hint == TokenTypeAccessToken {
+		revokes[0], revokes[1] = revokes[1], revokes[0]
+	}
+	for _, revoke := range revokes {
+		if found, err := revoke(ctx, client, token); found || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeRefreshToken 返回 token 是否为有效的刷新令牌
+func (a *AuthServer) revokeRefreshToken(ctx context.Context, client *utils.OAuthClient, token string) (bool, error) {
+	refresh, err := a.activeRefreshToken(ctx, token)
+	if err != nil || refresh == nil {
+		return false, err
+	}
+	if refresh.ClientID != client.ClientID {
+		return true, oauthError(OAuthUnauthorizedClient, "token was not issued to this client")
+	}
+	a.logger.Info("refresh token revoked", zap.String("client_id", client.ClientID), zap.String("family", refresh.Family))
+	return true, a.sessions.RevokeFamily(ctx, refresh.Family)
+}
+
+// revokeAccessToken 返回 token 是否为有效的 access token
+func (a *AuthServer) revokeAccessToken(ctx context.Context, client *utils.OAuthClient, token string) (bool, error) {
+	claims, err := parseAccessToken(token)
+	if errors.Is(err, utils.ErrJwtRevocationCheck) {
+		return false, err
+	}
+	if err != nil {
+		return false, nil
+	}
+	if claims.ClientID != client.ClientID {
+		return true, oauthError(OAuthUnauthorizedClient, "token was not issued to this client")
+	}
+	return true, a.sessions.RevokeAccessToken(ctx, claims)
+}
+
+// parseAccessToken 解析本服务自己的会话 jwt 或签发给第三方应用的 access token
+func parseAccessToken(token string) (*utils.Claims, error) {
+	claims, err := utils.JwtParse(token)
+	if errors.Is(err, utils.ErrJwtClientToken) {
+		return utils.JwtParseClient(token)
+	}
+	return claims, err
+}
@@ -0,0 +1,126 @@
+package module
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"go.uber.org/zap"
+)
+
+// ErrLoginUnsupported 登录后端不能识别该平台的账号
+var ErrLoginUnsupported = errors.New("login backend does not support identity")
+
+// LoginBackend 平台账号登录后签发会话
+type LoginBackend interface {
+	// Issue 为登录的账号签发 jwt, address 为账号绑定的地址, 没有绑定时为空
+	Issue(ctx context.Context, p Provider, identity *Identity, address string) (*Tokens, error)
+}
+
+// NewLoginBackend 创建登录后端, backend 为 cfg.Login.Backend 或 cfg.Login.V1Backend, transformer 以外由本服务签发会话
+func NewLoginBackend(backend string, cfg *config.Config, client *http.Client, sessions *Sessions, logger *zap.Logger) LoginBackend {
+	if backend == "transformer" {
+		return NewTransformerBackend(cfg, client, logger)
+	}
+	return &SessionBackend{sessions: sessions}
+}
+
+// SessionBackend 以账号绑定的地址开启本服务的会话, 账号没有绑定时返回 ErrNotBound
+type SessionBackend struct {
+	sessions *Sessions
+}
+
+func (b *SessionBackend) Issue(ctx context.Context, p Provider, identity *Identity, address string) (*Tokens, error) {
+	if address == "" {
+		return nil, ErrNotBound
+	}
+	return b.sessions.Issue(ctx, address)
+}
+
+// transformerUnsupported transformer 不能识别的平台. stackexchange 的 handle 是可以重复和修改的 display_name, 不能用来识别用户
+var transformerUnsupported = map[string]bool{"stackexchange": true}
+
+// TransformerBackend 交给 transformer 的第三方登录接口签发 jwt. transformer 以平台的 handle (github login) 识别用户,
+// 账号不需要在本服务绑定, 没有 handle 的账号和 transformerUnsupported 中的平台返回 ErrLoginUnsupported.
+// 签发的 jwt 由 transformer 管理, 没有刷新令牌
+type TransformerBackend struct {
+	url    string
+	client *http.Client
+	logger *zap.Logger
+}
+
+func NewTransformerBackend(cfg *config.Config, client *http.Client, logger *zap.Logger) *TransformerBackend {
+	return &TransformerBackend{
+		url:    strings.TrimSuffix(cfg.Server.TransformerURL, "/"),
+		client: client,
+		logger: logger,
+	}
+}
+
+func (t *TransformerBackend) Issue(ctx context.Context, p Provider, identity *Identity, address string) (*Tokens, error) {
+	if transformerUnsupported[p.Type()] {
+		return nil, fmt.Errorf("%w: %s", ErrLoginUnsupported, p.Type())
+	}
+	if identity.Handle == "" {
+		return nil, fmt.Errorf("%w: %s account has no handle", ErrLoginUnsupported, p.Type())
+	}
+	jsonBody, err := json.Marshal(map[string]string{
+		"third_party_type": p.Type(),
+		"third_party_id":   identity.Handle,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url+"/api/users/thirdPartyLogin", bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("transformer login: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var respData struct {
+		Token string `json:"token"`
+		Email string `json:"email"`
+	}
+	if err := decodeResponse("transformer", resp, &respData); err != nil {
+		return nil, err
+	}
+	if respData.Token == "" {
+		return nil, &ProviderError{Provider: "transformer", Status: resp.StatusCode, Code: "invalid_response", Message: "empty token"}
+	}
+	t.logger.Info("transformer login", zap.String("type", p.Type()), zap.String("handle", identity.Handle))
+	return &Tokens{AccessToken: respData.Token}, nil
+}
+
+// Session 登录的结果
+type Session struct {
+	Tokens
+	Address  string    `json:"address"`
+	Identity *Identity `json:"identity"`
+}
+
+// Login 用平台账号登录: 刷新绑定记录中的账号信息, 查询绑定的地址, 由 backend 签发 jwt
+func Login(ctx context.Context, store utils.BindingStore, backend LoginBackend, p Provider, identity *Identity) (*Session, error) {
+	if err := RefreshIdentity(ctx, store, p, identity); err != nil {
+		return nil, err
+	}
+	address, err := LookupAddress(ctx, store, p, identity.ID)
+	if err != nil && !errors.Is(err, ErrNotBound) {
+		return nil, err
+	}
+	tokens, err := backend.Issue(ctx, p, identity, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Tokens: *tokens, Address: address, Identity: identity}, nil
+}
@@ -0,0 +1,589 @@
+package module
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	// authorizeRequestTTL 用户在登录页面完成授权的时间
+	authorizeRequestTTL = 10 * time.Minute
+	// authorizationCodeTTL 授权码的有效期
+	authorizationCodeTTL = 5 * time.Minute
+)
+
+// 支持的 scope
+const (
+	ScopeOpenID        = "openid"
+	ScopeOfflineAccess = "offline_access"
+	// ScopeIdentityPrefix identity:<type> 允许应用读取地址绑定的该平台账号, 如 identity:github, 见 IdentityScope
+	ScopeIdentityPrefix = "identity:"
+)
+
+// IdentityScope 读取平台账号需要的 scope. gmail 账号以邮箱展示, scope 为 identity:email
+func IdentityScope(platformType string) string {
+	if platformType == "gmail" {
+		return ScopeIdentityPrefix + "email"
+	}
+	return ScopeIdentityPrefix + platformType
+}
+
+var (
+	ErrAuthorizeRequestInvalid = errors.New("authorize request invalid")
+	ErrAuthorizeRequestExpired = errors.New("authorize request expired")
+)
+
+// OAuth 错误码 (RFC 6749 4.1.2.1 / 5.2)
+const (
+	OAuthInvalidRequest          = "invalid_request"
+	OAuthInvalidClient           = "invalid_client"
+	OAuthInvalidGrant            = "invalid_grant"
+	OAuthUnauthorizedClient      = "unauthorized_client"
+	OAuthUnsupportedGrantType    = "unsupported_grant_type"
+	OAuthUnsupportedResponseType = "unsupported_response_type"
+	OAuthInvalidScope            = "invalid_scope"
+	OAuthAccessDenied            = "access_denied"
+	OAuthInvalidToken            = "invalid_token"
+	OAuthInsufficientScope       = "insufficient_scope"
+)
+
+// OAuthError 按 RFC 6749 返回给第三方应用的错误
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func oauthError(code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+// AuthorizeRequest 校验过的 /authorize 请求, 签名后交给登录页面, 用户同意后换成授权码
+type AuthorizeRequest struct {
+	ClientID    string `json:"client_id"`
+	RedirectURI string `json:"redirect_uri"`
+	Scope       string `json:"scope"`
+	State       string `json:"state,omitempty"`
+	Nonce       string `json:"nonce,omitempty"`
+	// CodeChallenge PKCE 的 S256 code_challenge
+	CodeChallenge string `json:"code_challenge,omitempty"`
+	// Prompt 为 consent 时即使已经授权过也展示授权页面
+	Prompt string `json:"prompt,omitempty"`
+	Expiry int64  `json:"exp"`
+}
+
+// Scopes 空格分隔的 scope
+func (r *AuthorizeRequest) Scopes() []string {
+	return strings.Fields(r.Scope)
+}
+
+// TokenResponse /token 的响应 (RFC 6749 5.1)
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+// IDTokenClaims id_token 的内容, sub 为钱包地址, 只包含 identity:<type> 授权过的平台账号
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce          string    `json:"nonce,omitempty"`
+	AuthTime       int64     `json:"auth_time,omitempty"`
+	WalletAddress  string    `json:"wallet_address"`
+	LinkedAccounts []Account `json:"linked_accounts"`
+}
+
+// UserInfo /userinfo 的响应
+type UserInfo struct {
+	Sub            string    `json:"sub"`
+	WalletAddress  string    `json:"wallet_address"`
+	LinkedAccounts []Account `json:"linked_accounts"`
+}
+
+// AuthServer 本服务作为 OAuth2/OIDC 授权服务器 ("Login with KNN3"), 为注册的第三方应用签发授权码、
+// access token 和 id_token. 用户在 LoginURL 页面用本服务的会话登录并同意授权
+type AuthServer struct {
+	issuer   string
+	loginURL string
+	// flow 签名授权请求, 与 oauth state 使用同一个密钥
+	flow      *Flow
+	store     utils.Store
+	sessions  *Sessions
+	providers *Registry
+	logger    *zap.Logger
+}
+
+func NewAuthServer(cfg *config.Config, flow *Flow, store utils.Store, sessions *Sessions, providers *Registry, logger *zap.Logger) *AuthServer {
+	return &AuthServer{
+		issuer:    strings.TrimSuffix(cfg.OIDC.Issuer, "/"),
+		loginURL:  cfg.OIDC.LoginURL,
+		flow:      flow,
+		store:     store,
+		sessions:  sessions,
+		providers: providers,
+		logger:    logger,
+	}
+}
+
+// RegisterClient 注册第三方应用, 返回只显示一次的 client_secret, public 为 true 时没有 client_secret.
+// redirect_uri 必须是不带 fragment 的绝对地址
+func RegisterClient(ctx context.Context, store utils.ClientStore, name string, redirectURIs []string, public bool) (*utils.OAuthClient, string, error) {
+	if name == "" || len(redirectURIs) == 0 {
+		return nil, "", errors.New("client name and redirect uris are required")
+	}
+	for _, redirectURI := range redirectURIs {
+		u, err := url.Parse(redirectURI)
+		if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+			return nil, "", fmt.Errorf("invalid redirect uri %q", redirectURI)
+		}
+	}
+	return createClient(ctx, store, &utils.OAuthClient{Name: name, RedirectURIs: redirectURIs}, public)
+}
+
+// RegisterResourceServer 注册用 /oauth/introspect 校验任意 token 的下游服务, 返回只显示一次的 client_secret
+func RegisterResourceServer(ctx context.Context, store utils.ClientStore, name string) (*utils.OAuthClient, string, error) {
+	if name == "" {
+		return nil, "", errors.New("resource server name is required")
+	}
+	return createClient(ctx, store, &utils.OAuthClient{Name: name, ResourceServer: true}, false)
+}
+
+// createClient 生成 client_id 和 client_secret 并保存
+func createClient(ctx context.Context, store utils.ClientStore, client *utils.OAuthClient, public bool) (*utils.OAuthClient, string, error) {
+	clientID, err := utils.RandomToken(16)
+	if err != nil {
+		return nil, "", err
+	}
+	client.ClientID = clientID
+	secret := ""
+	if !public {
+		if secret, err = utils.RandomToken(32); err != nil {
+			return nil, "", err
+		}
+		client.SecretHash = utils.HashToken(secret)
+	}
+	if err := store.CreateClient(ctx, client); err != nil {
+		return nil, "", err
+	}
+	return client, secret, nil
+}
+
+// Authorize 校验 /authorize 的参数. client_id 或 redirect_uri 无效时只返回错误, 不能跳转回应用;
+// 其他错误同时返回请求, 由调用方把错误跳转回 redirect_uri
+func (a *AuthServer) Authorize(ctx context.Context, params url.Values) (*AuthorizeRequest, error) {
+	client, err := a.store.GetClient(ctx, params.Get("client_id"))
+	if errors.Is(err, utils.ErrClientNotFound) {
+		return nil, oauthError(OAuthInvalidClient, "unknown client_id")
+	}
+	if err != nil {
+		return nil, err
+	}
+	redirectURI := params.Get("redirect_uri")
+	// 按注册的地址完整匹配
+	if !containsString(client.RedirectURIs, redirectURI) {
+		return nil, oauthError(OAuthInvalidRequest, "redirect_uri not registered")
+	}
+
+	req := &AuthorizeRequest{
+		ClientID:      client.ClientID,
+		RedirectURI:   redirectURI,
+		Scope:         strings.Join(strings.Fields(params.Get("scope")), " "),
+		State:         params.Get("state"),
+		Nonce:         params.Get("nonce"),
+		CodeChallenge: params.Get("code_challenge"),
+		Prompt:        params.Get("prompt"),
+		Expiry:        time.Now().Add(authorizeRequestTTL).Unix(),
+	}
+	if params.Get("response_type") != "code" {
+		return req, oauthError(OAuthUnsupportedResponseType, "only response_type=code is supported")
+	}
+	if err := a.checkScopes(req.Scopes()); err != nil {
+		return req, err
+	}
+	method := params.Get("code_challenge_method")
+	if req.CodeChallenge != "" && method != "S256" {
+		return req, oauthError(OAuthInvalidRequest, "code_challenge_method must be S256")
+	}
+	if req.CodeChallenge == "" && client.Public() {
+		return req, oauthError(OAuthInvalidRequest, "public clients must use PKCE")
+	}
+	return req, nil
+}
+
+// checkScopes 必须包含 openid, identity scope 必须对应已注册的平台
+func (a *AuthServer) checkScopes(scopes []string) error {
+	if !containsString(scopes, ScopeOpenID) {
+		return oauthError(OAuthInvalidScope, "openid scope is required")
+	}
+	supported := a.supportedScopes()
+	for _, scope := range scopes {
+		if !containsString(supported, scope) {
+			return oauthError(OAuthInvalidScope, "unknown scope "+scope)
+		}
+	}
+	return nil
+}
+
+// supportedScopes openid、offline_access 和已注册平台的 identity scope
+func (a *AuthServer) supportedScopes() []string {
+	scopes := []string{ScopeOpenID, ScopeOfflineAccess}
+	for _, p := range a.providers.List() {
+		scopes = append(scopes, IdentityScope(p.Type()))
+	}
+	return scopes
+}
+
+// LoginRedirect 登录页面的地址, 带上签名的授权请求
+func (a *AuthServer) LoginRedirect(req *AuthorizeRequest) (string, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return withQuery(a.loginURL, url.Values{"request": {encoded + "." + a.flow.sign(purposeAuthorize, encoded)}}), nil
+}
+
+// ParseRequest 校验登录页面带回的授权请求的签名和有效期
+func (a *AuthServer) ParseRequest(raw string) (*AuthorizeRequest, error) {
+	encoded, sig, ok := strings.Cut(raw, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(a.flow.sign(purposeAuthorize, encoded))) {
+		return nil, ErrAuthorizeRequestInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrAuthorizeRequestInvalid
+	}
+	req := &AuthorizeRequest{}
+	if err := json.Unmarshal(payload, req); err != nil || req.ClientID == "" {
+		return nil, ErrAuthorizeRequestInvalid
+	}
+	if time.Now().Unix() > req.Expiry {
+		return nil, ErrAuthorizeRequestExpired
+	}
+	return req, nil
+}
+
+// Describe 登录页面展示的授权请求: 应用和申请的 scope
+func (a *AuthServer) Describe(ctx context.Context, raw string) (*AuthorizeRequest, *utils.OAuthClient, error) {
+	req, err := a.ParseRequest(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := a.store.GetClient(ctx, req.ClientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return req, client, nil
+}
+
+// Approve 用户 address 同意授权, 保存授权并签发授权码, 返回跳转回应用的地址.
+// selected 为用户在授权页面勾选的 scope, 为 nil 时同意申请的全部 scope, openid 总是保留
+func (a *AuthServer) Approve(ctx context.Context, raw string, address string, selected []string) (string, error) {
+	req, err := a.ParseRequest(raw)
+	if err != nil {
+		return "", err
+	}
+	approved := req.Scopes()
+	if selected != nil {
+		approved = intersectScopes(approved, append([]string{ScopeOpenID}, selected...))
+	}
+	scope := strings.Join(approved, " ")
+	if err := a.saveGrant(ctx, address, req, approved); err != nil {
+		return "", err
+	}
+	code, err := utils.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	family, err := utils.RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = a.store.CreateAuthorizationCode(ctx, &utils.AuthorizationCode{
+		Hash:          utils.HashToken(code),
+		ClientID:      req.ClientID,
+		Addr:          address,
+		RedirectURI:   req.RedirectURI,
+		Scope:         scope,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		Family:        family,
+		AuthTime:      now,
+		ExpiresAt:     now.Add(authorizationCodeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	a.logger.Info("oauth client authorized", zap.String("client_id", req.ClientID), zap.String("addr", address), zap.String("scope", scope))
+	return withQuery(req.RedirectURI, url.Values{"code": {code}, "state": {req.State}}), nil
+}
+
+// Deny 用户拒绝授权, 返回带 access_denied 跳转回应用的地址
+func (a *AuthServer) Deny(raw string) (string, error) {
+	req, err := a.ParseRequest(raw)
+	if err != nil {
+		return "", err
+	}
+	return ErrorRedirect(req, oauthError(OAuthAccessDenied, "user denied the request")), nil
+}
+
+// ErrorRedirect 把错误跳转回应用的 redirect_uri
+func ErrorRedirect(req *AuthorizeRequest, err *OAuthError) string {
+	params := url.Values{"error": {err.Code}, "state": {req.State}}
+	if err.Description != "" {
+		params.Set("error_description", err.Description)
+	}
+	return withQuery(req.RedirectURI, params)
+}
+
+// AuthenticateClient 校验 client_id 和 client_secret, 公开客户端不能带 client_secret
+func (a *AuthServer) AuthenticateClient(ctx context.Context, clientID, secret string) (*utils.OAuthClient, error) {
+	client, err := a.store.GetClient(ctx, clientID)
+	if errors.Is(err, utils.ErrClientNotFound) {
+		return nil, oauthError(OAuthInvalidClient, "unknown client_id")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if client.Public() {
+		if secret != "" {
+			return nil, oauthError(OAuthInvalidClient, "public client must not send client_secret")
+		}
+		return client, nil
+	}
+	if !hmac.Equal([]byte(utils.HashToken(secret)), []byte(client.SecretHash)) {
+		return nil, oauthError(OAuthInvalidClient, "client authentication failed")
+	}
+	return client, nil
+}
+
+// Exchange authorization_code 授权: 校验授权码、redirect_uri 和 PKCE, 签发 access token 和 id_token,
+// 申请了 offline_access 时同时签发刷新令牌. 授权码被重复使用时撤销用它换取的会话
+func (a *AuthServer) Exchange(ctx context.Context, client *utils.OAuthClient, code, redirectURI, verifier string) (*TokenResponse, error) {
+	authCode, err := a.store.UseAuthorizationCode(ctx, utils.HashToken(code))
+	if errors.Is(err, utils.ErrAuthorizationCodeNotFound) {
+		return nil, oauthError(OAuthInvalidGrant, "invalid authorization code")
+	}
+	if errors.Is(err, utils.ErrAuthorizationCodeUsed) {
+		a.logger.Warn("authorization code reused, revoke session", zap.String("client_id", authCode.ClientID), zap.String("family", authCode.Family))
+		if err := a.sessions.RevokeFamily(ctx, authCode.Family); err != nil {
+			return nil, err
+		}
+		return nil, oauthError(OAuthInvalidGrant, "authorization code already used")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if authCode.ClientID != client.ClientID || time.Now().After(authCode.ExpiresAt) {
+		return nil, oauthError(OAuthInvalidGrant, "invalid authorization code")
+	}
+	if authCode.RedirectURI != redirectURI {
+		return nil, oauthError(OAuthInvalidGrant, "redirect_uri mismatch")
+	}
+	if authCode.CodeChallenge != "" && !verifyPKCE(verifier, authCode.CodeChallenge) {
+		return nil, oauthError(OAuthInvalidGrant, "code_verifier mismatch")
+	}
+
+	// 换取 token 之前用户可能已经撤销授权
+	scope, err := a.effectiveScope(ctx, authCode.Addr, client.ClientID, authCode.Scope)
+	if errors.Is(err, utils.ErrGrantNotFound) {
+		return nil, oauthError(OAuthInvalidGrant, "consent revoked")
+	}
+	if err != nil {
+		return nil, err
+	}
+	grant := Grant{Address: authCode.Addr, ClientID: client.ClientID, Scope: scope}
+	// 先签 id_token, 签名失败时不会留下应用拿不到的刷新令牌
+	idToken, err := a.idToken(ctx, grant, authCode.Nonce, authCode.AuthTime)
+	if err != nil {
+		return nil, err
+	}
+	scopes := strings.Fields(grant.Scope)
+	tokens, err := a.sessions.IssueClient(ctx, grant, authCode.Family, containsString(scopes, ScopeOfflineAccess))
+	if err != nil {
+		return nil, err
+	}
+	return a.tokenResponse(tokens, grant, idToken), nil
+}
+
+// Refresh refresh_token 授权, 轮换刷新令牌并签发新的 access token 和 id_token.
+// 返回的 scope 为刷新令牌的 scope 与当前授权的交集
+func (a *AuthServer) Refresh(ctx context.Context, client *utils.OAuthClient, refreshToken string) (*TokenResponse, error) {
+	tokens, grant, err := a.sessions.RefreshClient(ctx, client.ClientID, refreshToken)
+	if errors.Is(err, ErrRefreshTokenInvalid) || errors.Is(err, utils.ErrRefreshTokenReused) {
+		return nil, oauthError(OAuthInvalidGrant, "invalid refresh token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	grant.Scope, err = a.effectiveScope(ctx, grant.Address, grant.ClientID, grant.Scope)
+	if errors.Is(err, utils.ErrGrantNotFound) {
+		// 撤销授权时已经撤销了刷新令牌, 这里处理并发的刷新
+		if _, err := a.sessions.RevokeClient(ctx, grant.ClientID, grant.Address); err != nil {
+			return nil, err
+		}
+		return nil, oauthError(OAuthInvalidGrant, "consent revoked")
+	}
+	if err != nil {
+		return nil, err
+	}
+	idToken, err := a.idToken(ctx, *grant, "", time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return a.tokenResponse(tokens, *grant, idToken), nil
+}
+
+func (a *AuthServer) tokenResponse(tokens *Tokens, grant Grant, idToken string) *TokenResponse {
+	return &TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    tokens.ExpiresIn,
+		RefreshToken: tokens.RefreshToken,
+		IDToken:      idToken,
+		Scope:        grant.Scope,
+	}
+}
+
+// idToken 用签名私钥签发 id_token, aud 为 client_id
+func (a *AuthServer) idToken(ctx context.Context, grant Grant, nonce string, authTime time.Time) (string, error) {
+	accounts, err := a.linkedAccounts(ctx, grant.Address, grant.Scope)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := &IDTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    a.issuer,
+			Subject:   grant.Address,
+			Audience:  jwt.ClaimStrings{grant.ClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(utils.JwtAccessTTL())),
+		},
+		Nonce:          nonce,
+		WalletAddress:  grant.Address,
+		LinkedAccounts: accounts,
+	}
+	if !authTime.IsZero() {
+		claims.AuthTime = authTime.Unix()
+	}
+	return utils.SignIDToken(claims)
+}
+
+// UserInfo access token 对应的用户信息, 只能使用签发给第三方应用的 access token.
+// 平台账号按 access token 的 scope 与当前授权的交集返回, 撤销授权后 access token 立即失效
+func (a *AuthServer) UserInfo(ctx context.Context, claims *utils.Claims) (*UserInfo, error) {
+	scope, err := a.effectiveScope(ctx, claims.Address, claims.ClientID, claims.Scope)
+	if errors.Is(err, utils.ErrGrantNotFound) {
+		return nil, oauthError(OAuthInvalidToken, "consent revoked")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !containsString(strings.Fields(scope), ScopeOpenID) {
+		return nil, oauthError(OAuthInsufficientScope, "openid scope is required")
+	}
+	accounts, err := a.linkedAccounts(ctx, claims.Address, scope)
+	if err != nil {
+		return nil, err
+	}
+	return &UserInfo{Sub: claims.Address, WalletAddress: claims.Address, LinkedAccounts: accounts}, nil
+}
+
+// linkedAccounts 地址绑定的平台账号中 scope 授权过的部分
+func (a *AuthServer) linkedAccounts(ctx context.Context, address, scope string) ([]Account, error) {
+	accounts, err := Bindings(ctx, a.store, a.providers, address, false)
+	if err != nil {
+		return nil, err
+	}
+	scopes := strings.Fields(scope)
+	consented := []Account{}
+	for _, account := range accounts {
+		if containsString(scopes, IdentityScope(account.Type)) {
+			consented = append(consented, account)
+		}
+	}
+	return consented, nil
+}
+
+// Discovery /.well-known/openid-configuration
+func (a *AuthServer) Discovery() map[string]interface{} {
+	return map[string]interface{}{
+		"issuer":                                        a.issuer,
+		"authorization_endpoint":                        a.issuer + "/authorize",
+		"token_endpoint":                                a.issuer + "/token",
+		"userinfo_endpoint":                             a.issuer + "/userinfo",
+		"introspection_endpoint":                        a.issuer + "/oauth/introspect",
+		"revocation_endpoint":                           a.issuer + "/oauth/revoke",
+		"jwks_uri":                                      a.issuer + "/.well-known/jwks.json",
+		"response_types_supported":                      []string{"code"},
+		"grant_types_supported":                         []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":                       []string{"public"},
+		"id_token_signing_alg_values_supported":         []string{utils.SigningAlgorithm()},
+		"scopes_supported":                              a.supportedScopes(),
+		"token_endpoint_auth_methods_supported":         []string{"client_secret_basic", "client_secret_post", "none"},
+		"introspection_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"revocation_endpoint_auth_methods_supported":    []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":              []string{"S256"},
+		"claims_supported":                              []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "wallet_address", "linked_accounts"},
+	}
+}
+
+// verifyPKCE code_verifier 的 S256 与 code_challenge 一致
+func verifyPKCE(verifier, challenge string) bool {
+	if verifier == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return hmac.Equal([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge))
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// withQuery 在 rawURL 原有的 query 上追加参数, 空值不追加
+func withQuery(rawURL string, params url.Values) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	for key, values := range params {
+		for _, value := range values {
+			if value != "" {
+				query.Add(key, value)
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
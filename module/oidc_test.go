@@ -0,0 +1,129 @@
+package module
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"go.uber.org/zap"
+)
+
+func TestClientStore(t *testing.T) {
+	stores := map[string]func(t *testing.T) utils.Store{
+		"memory": func(t *testing.T) utils.Store { return utils.NewMemoryStore() },
+		"sqlite": func(t *testing.T) utils.Store { return utils.NewGormStore(testSqliteDB(t)) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+			cfg := config.Default()
+			cfg.JWT.Secret = "secret"
+			utils.ConfigureJwt(cfg.JWT)
+			t.Cleanup(func() { utils.ConfigureJwt(config.JWTConfig{}) })
+			sessions := NewSessions(cfg, store, zap.NewNop())
+			auth := NewAuthServer(cfg, NewFlow(cfg, store, zap.NewNop()), store, sessions, NewRegistry(), zap.NewNop())
+
+			if _, _, err := RegisterClient(ctx, store, "Demo", []string{"/cb"}, false); err == nil {
+				t.Fatal("relative redirect uri accepted")
+			}
+			uris := []string{"https://demo.test/cb", "http://localhost:3000/cb"}
+			client, secret, err := RegisterClient(ctx, store, "Demo", uris, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.GetClient(ctx, client.ClientID)
+			if err != nil || !reflect.DeepEqual([]string(got.RedirectURIs), uris) || got.Public() {
+				t.Fatalf("get client: %+v %v", got, err)
+			}
+			if _, err := store.GetClient(ctx, "unknown"); !errors.Is(err, utils.ErrClientNotFound) {
+				t.Fatalf("unknown client: %v", err)
+			}
+			if _, err := auth.AuthenticateClient(ctx, client.ClientID, secret); err != nil {
+				t.Fatalf("authenticate: %v", err)
+			}
+			var oauthErr *OAuthError
+			if _, err := auth.AuthenticateClient(ctx, client.ClientID, ""); !errors.As(err, &oauthErr) || oauthErr.Code != OAuthInvalidClient {
+				t.Fatalf("authenticate without secret: %v", err)
+			}
+
+			err = store.CreateAuthorizationCode(ctx, &utils.AuthorizationCode{
+				Hash: utils.HashToken("code"), ClientID: client.ClientID, Addr: "0x0000000000000000000000000000000000000001",
+				RedirectURI: uris[0], Family: "family", AuthTime: time.Now(), ExpiresAt: time.Now().Add(time.Minute),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code, err := store.UseAuthorizationCode(ctx, utils.HashToken("code")); err != nil || code.UsedAt == nil {
+				t.Fatalf("use code: %+v %v", code, err)
+			}
+			if code, err := store.UseAuthorizationCode(ctx, utils.HashToken("code")); !errors.Is(err, utils.ErrAuthorizationCodeUsed) || code.Family != "family" {
+				t.Fatalf("reuse code: %+v %v", code, err)
+			}
+			if _, err := store.UseAuthorizationCode(ctx, utils.HashToken("unknown")); !errors.Is(err, utils.ErrAuthorizationCodeNotFound) {
+				t.Fatalf("unknown code: %v", err)
+			}
+
+			// 没有配置签名私钥, id_token 签名失败时不签发刷新令牌
+			if err := store.SaveGrant(ctx, &utils.ConsentGrant{Addr: "0x0000000000000000000000000000000000000001", ClientID: client.ClientID, Scope: "openid offline_access"}); err != nil {
+				t.Fatal(err)
+			}
+			err = store.CreateAuthorizationCode(ctx, &utils.AuthorizationCode{
+				Hash: utils.HashToken("offline"), ClientID: client.ClientID, Addr: "0x0000000000000000000000000000000000000001", Scope: "openid offline_access",
+				RedirectURI: uris[0], Family: "offline", AuthTime: time.Now(), ExpiresAt: time.Now().Add(time.Minute),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := auth.Exchange(ctx, client, "offline", uris[0], ""); !errors.Is(err, utils.ErrNoSigningKey) {
+				t.Fatalf("exchange without signing key: %v", err)
+			}
+			if families, err := store.RevokeRefreshTokens(ctx, "offline", ""); err != nil || len(families) != 0 {
+				t.Fatalf("refresh token issued before id_token: %v %v", families, err)
+			}
+
+			// 应用的刷新令牌不能在本服务的 /auth/refresh 使用
+			tokens, err := sessions.IssueClient(ctx, Grant{Address: "0x0000000000000000000000000000000000000001", ClientID: client.ClientID, Scope: "openid"}, "family", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := sessions.Refresh(ctx, tokens.RefreshToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+				t.Fatalf("client refresh token used as first-party: %v", err)
+			}
+			if _, err := utils.JwtDecode(tokens.AccessToken); !errors.Is(err, utils.ErrJwtClientToken) {
+				t.Fatalf("client access token decoded as first-party: %v", err)
+			}
+		})
+	}
+}
+
+func TestSignPurpose(t *testing.T) {
+	cfg := config.Default()
+	flow := NewFlow(cfg, utils.NewMemoryStore(), zap.NewNop())
+	auth := NewAuthServer(cfg, flow, utils.NewMemoryStore(), nil, NewRegistry(), zap.NewNop())
+
+	payload, _ := json.Marshal(AuthorizeRequest{ClientID: "demo", RedirectURI: "https://demo.test/cb", Scope: ScopeOpenID, Expiry: time.Now().Add(time.Minute).Unix()})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	if _, err := auth.ParseRequest(encoded + "." + flow.sign(purposeAuthorize, encoded)); err != nil {
+		t.Fatalf("authorize request rejected: %v", err)
+	}
+	// 同一个密钥为其他用途签的内容不能当成授权请求
+	for _, purpose := range []string{purposeState, purposeConsent, ""} {
+		if _, err := auth.ParseRequest(encoded + "." + flow.sign(purpose, encoded)); !errors.Is(err, ErrAuthorizeRequestInvalid) {
+			t.Errorf("authorize request signed for %q: %v", purpose, err)
+		}
+	}
+	_, state, err := flow.NewState("github", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.ParseRequest(state); !errors.Is(err, ErrAuthorizeRequestInvalid) {
+		t.Errorf("oauth state accepted as authorize request: %v", err)
+	}
+}
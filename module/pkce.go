@@ -0,0 +1,75 @@
+package module
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/KNN3-Network/oauth-server/utils"
+	"golang.org/x/oauth2"
+)
+
+var ErrPKCEVerifierMissing = errors.New("pkce code_verifier missing")
+
+// pkceNoncePrefix code_verifier 在 NonceStore 中的前缀, 后面是 state 的 nonce
+const pkceNoncePrefix = "pkce."
+
+// PKCEEnabled 该平台的授权流程是否使用 PKCE (RFC 7636)
+func (f *Flow) PKCEEnabled(p Provider) bool {
+	return f.pkceProviders[p.Type()]
+}
+
+// newPKCE 生成 code_verifier 和对应的 S256 code_challenge
+func newPKCE() (verifier string, challenge string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(buf)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// savePKCEVerifier 保存 state 对应的 code_verifier, 与 state 同时过期.
+// 保存在共享的 store 中, 回调和 /oauth/bind 可以由其他实例处理
+func (f *Flow) savePKCEVerifier(ctx context.Context, state *State, verifier string) error {
+	return f.store.CreateNonce(ctx, &utils.FlowNonce{
+		Nonce:     pkceNoncePrefix + state.Nonce,
+		Value:     verifier,
+		ExpiresAt: time.Unix(state.Expiry, 0),
+	})
+}
+
+// takePKCEVerifier 取出 state 对应的 code_verifier, 只能取一次
+func (f *Flow) takePKCEVerifier(ctx context.Context, state *State) (string, error) {
+	nonce, err := f.store.TakeNonce(ctx, pkceNoncePrefix+state.Nonce)
+	if errors.Is(err, utils.ErrNonceNotFound) {
+		return "", ErrPKCEVerifierMissing
+	}
+	if err != nil {
+		return "", err
+	}
+	return nonce.Value, nil
+}
+
+// pkceAuthOptions 授权链接上的 code_challenge 参数
+func pkceAuthOptions(challenge string) []oauth2.AuthCodeOption {
+	if challenge == "" {
+		return nil
+	}
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", challenge),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+}
+
+// pkceExchangeOptions 换取 token 时的 code_verifier 参数
+func pkceExchangeOptions(verifier string) []oauth2.AuthCodeOption {
+	if verifier == "" {
+		return nil
+	}
+	return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("code_verifier", verifier)}
+}
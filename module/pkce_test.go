@@ -0,0 +1,52 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"go.uber.org/zap"
+)
+
+func TestPKCEVerifierShared(t *testing.T) {
+	stores := map[string]func(t *testing.T) utils.Store{
+		"memory": func(t *testing.T) utils.Store { return utils.NewMemoryStore() },
+		"sqlite": func(t *testing.T) utils.Store { return utils.NewGormStore(testSqliteDB(t)) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+			cfg := config.Default()
+			cfg.OAuth.StateSecret = "state-secret"
+			// 两个实例共享 store
+			first, second := NewFlow(cfg, store, zap.NewNop()), NewFlow(cfg, store, zap.NewNop())
+
+			state, _, err := first.NewState("github", "", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := first.savePKCEVerifier(ctx, state, "verifier"); err != nil {
+				t.Fatal(err)
+			}
+			if verifier, err := second.takePKCEVerifier(ctx, state); err != nil || verifier != "verifier" {
+				t.Fatalf("take verifier on another instance: %q %v", verifier, err)
+			}
+			// 只能取一次
+			if _, err := first.takePKCEVerifier(ctx, state); !errors.Is(err, ErrPKCEVerifierMissing) {
+				t.Fatalf("take verifier twice: %v", err)
+			}
+
+			// 与 state 同时过期
+			state.Nonce, state.Expiry = "expired", state.Expiry-int64(stateTTL.Seconds())-1
+			if err := first.savePKCEVerifier(ctx, state, "verifier"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := second.takePKCEVerifier(ctx, state); !errors.Is(err, ErrPKCEVerifierMissing) {
+				t.Fatalf("take expired verifier: %v", err)
+			}
+		})
+	}
+}
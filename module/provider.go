@@ -0,0 +1,180 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// Identity 第三方平台返回的标准化用户信息
+type Identity struct {
+	ID       string                 `json:"id"`                 // 平台内不可变的账号 id, 绑定以此为准
+	Handle   string                 `json:"handle,omitempty"`   // 平台内的用户名, 如 github login
+	Name     string                 `json:"name,omitempty"`     // 展示名称
+	Metadata map[string]interface{} `json:"metadata,omitempty"` // 头像等其他信息
+	// LegacyID 以前绑定使用的标识 (github login、gmail 邮箱), 用于识别还没有回填的旧记录
+	LegacyID string `json:"-"`
+}
+
+// Provider 一个可以绑定到钱包地址的第三方 oauth 平台
+type Provider interface {
+	// Type 平台类型, 对应请求体中的 type 字段
+	Type() string
+	// Exchange 通过回调拿到的 code 换取 access token, verifier 为 PKCE 的 code_verifier, 不使用时为空
+	Exchange(ctx context.Context, code string, verifier string) (*oauth2.Token, error)
+	// FetchIdentity 通过 access token 获取平台用户信息
+	FetchIdentity(ctx context.Context, token *oauth2.Token) (*Identity, error)
+	// AuthCodeURL 生成授权链接, client 为发起授权的应用, challenge 为 PKCE 的 S256 code_challenge, 不使用时为空
+	AuthCodeURL(client string, state string, challenge string) string
+	// CallbackPath oauth 回调的路由
+	CallbackPath() string
+	// Callback 处理平台的 oauth 回调
+	Callback(c *gin.Context, flow *Flow)
+}
+
+// MaskedProvider 账号信息属于隐私的平台, 未认证的调用方只能看到脱敏后的信息
+type MaskedProvider interface {
+	Provider
+	Mask(identity *Identity) *Identity
+}
+
+// DefaultProviders 使用配置创建所有内置平台, 共用 client (由 httpclient.New 创建, 带超时、重试和熔断)
+func DefaultProviders(cfg *config.Config, client *http.Client, logger *zap.Logger) []Provider {
+	return []Provider{
+		NewDiscord(cfg, client, logger),
+		NewGithub(cfg, client, logger),
+		NewGmail(cfg, client, logger),
+		NewStackoverflow(cfg, client, logger),
+	}
+}
+
+// withClient 让 oauth2 的 Exchange 和 Client 使用 client 发送请求
+func withClient(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, client)
+}
+
+// Registry 按 type 索引的平台
+type Registry struct {
+	providers map[string]Provider
+}
+
+// NewRegistry 注册平台, type 重复时 panic
+func NewRegistry(providers ...Provider) *Registry {
+	r := &Registry{providers: map[string]Provider{}}
+	for _, p := range providers {
+		if _, ok := r.providers[p.Type()]; ok {
+			panic(fmt.Sprintf("module: provider %q already registered", p.Type()))
+		}
+		r.providers[p.Type()] = p
+	}
+	return r
+}
+
+// Get 根据 type 获取已注册的平台
+func (r *Registry) Get(platformType string) (Provider, bool) {
+	p, ok := r.providers[platformType]
+	return p, ok
+}
+
+// List 返回所有已注册的平台, 按 type 排序
+func (r *Registry) List() []Provider {
+	list := make([]Provider, 0, len(r.providers))
+	for _, p := range r.providers {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Type() < list[j].Type() })
+	return list
+}
+
+// Authorize 用 code 换取 token 并获取平台用户信息.
+// 平台开启 PKCE 时 state 为授权链接上签发的 state, 用来取回 code_verifier
+func (f *Flow) Authorize(ctx context.Context, p Provider, code string, state string) (*Identity, error) {
+	verifier := ""
+	if f.PKCEEnabled(p) {
+		s, err := f.ParseState(state, p.Type())
+		if err != nil {
+			return nil, fmt.Errorf("%s pkce state: %w", p.Type(), err)
+		}
+		if verifier, err = f.takePKCEVerifier(ctx, s); err != nil {
+			return nil, fmt.Errorf("%s pkce state: %w", p.Type(), err)
+		}
+	}
+	token, err := p.Exchange(ctx, code, verifier)
+	if err != nil {
+		return nil, fmt.Errorf("%s exchange token: %w", p.Type(), err)
+	}
+	identity, err := p.FetchIdentity(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("%s fetch identity: %w", p.Type(), err)
+	}
+	if identity.ID == "" {
+		return nil, fmt.Errorf("%s fetch identity: empty id", p.Type())
+	}
+	return identity, nil
+}
+
+// ErrRedirectNotAllowed 跳转地址不在 client 的白名单中
+var ErrRedirectNotAllowed = errors.New("redirect target not allowed")
+
+// AuthCodeURL 签发 state 并生成平台的授权链接
+func (f *Flow) AuthCodeURL(ctx context.Context, p Provider, client, success, fail string) (string, error) {
+	for _, target := range []string{success, fail} {
+		if target != "" && !f.AllowRedirect(client, target) {
+			return "", ErrRedirectNotAllowed
+		}
+	}
+	state, raw, err := f.NewState(p.Type(), client, success, fail)
+	if err != nil {
+		return "", err
+	}
+	challenge := ""
+	if f.PKCEEnabled(p) {
+		verifier := ""
+		if verifier, challenge, err = newPKCE(); err != nil {
+			return "", err
+		}
+		if err := f.savePKCEVerifier(ctx, state, verifier); err != nil {
+			return "", err
+		}
+	}
+	return p.AuthCodeURL(client, raw, challenge), nil
+}
+
+// verifyCallback 校验回调里的 code 和 state, 失败时中断请求
+func (f *Flow) verifyCallback(c *gin.Context, platformType string) (*State, bool) {
+	if c.Query("code") == "" {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("No authorization code provided."))
+		return nil, false
+	}
+	state, err := f.VerifyState(c.Request.Context(), c.Query("state"), platformType)
+	if err != nil {
+		f.logger.Error(platformType+" oauth state error:", zap.Error(err))
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("authorization error state"))
+		return nil, false
+	}
+	return state, true
+}
+
+// defaultCallback 校验 state 后把 code 转交给前端 pass 页面
+func (f *Flow) defaultCallback(c *gin.Context, platformType string) {
+	if _, ok := f.verifyCallback(c, platformType); !ok {
+		return
+	}
+	f.logger.Info(platformType+" oauth认证", zap.String("code", c.Query("code")))
+
+	f.passRedirect(c, platformType)
+}
+
+// passRedirect 把 code 转交给前端 pass 页面完成绑定.
+// state 需要随 code 一起提交到 /oauth/bind, 用来取回 PKCE 的 code_verifier
+func (f *Flow) passRedirect(c *gin.Context, platformType string) {
+	c.Redirect(http.StatusTemporaryRedirect, f.passURL+"?type="+platformType+"&code="+c.Query("code")+"&state="+url.QueryEscape(c.Query("state")))
+}
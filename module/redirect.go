@@ -0,0 +1,56 @@
+package module
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AllowRedirect 判断 target 是否在 client 的跳转白名单中
+func (f *Flow) AllowRedirect(client, target string) bool {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+		return false
+	}
+	for _, pattern := range f.redirectAllowlist[client] {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(target, prefix) && originBoundary(prefix, target) {
+				return true
+			}
+		} else if target == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// originBoundary 前缀只有 origin 时, 防止 https://knexus.xyz 匹配到 https://knexus.xyz.evil.com
+func originBoundary(prefix, target string) bool {
+	if strings.Count(prefix, "/") > 2 {
+		return true
+	}
+	rest := target[len(prefix):]
+	return rest == "" || strings.ContainsAny(rest[:1], "/?#")
+}
+
+// redirectError 跳转地址不在白名单时展示的默认错误页
+func redirectError(c *gin.Context) {
+	c.Data(http.StatusBadRequest, "text/html; charset=utf-8", []byte(
+		"<!DOCTYPE html><html><head><title>Authorization failed</title></head>"+
+			"<body><p>Authorization failed: redirect target is not allowed.</p></body></html>"))
+	c.Abort()
+}
+
+// appendQuery 在跳转地址后追加参数
+func appendQuery(target, key, value string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
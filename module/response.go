@@ -0,0 +1,114 @@
+package module
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// maxErrorBody 读取平台错误响应的最大长度
+const maxErrorBody = 64 << 10
+
+// ProviderError 平台接口返回的错误, 如 token 过期、code 无效、限流
+type ProviderError struct {
+	Provider string
+	// Status 平台返回的 http 状态码, 响应格式错误时为 200
+	Status int
+	// Code 平台的错误码: oauth 的 error、discord 的 code、stackexchange 的 error_name 等
+	Code    string
+	Message string
+}
+
+func (e *ProviderError) Error() string {
+	msg := fmt.Sprintf("%s: status %d", e.Provider, e.Status)
+	if e.Code != "" {
+		msg += " " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Temporary 平台限流或故障, 稍后重试可能成功
+func (e *ProviderError) Temporary() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= http.StatusInternalServerError
+}
+
+// errorBody 各平台错误响应中的字段:
+// oauth 标准的 {"error","error_description"}, github 的 {"message"},
+// discord 的 {"message","code"}, stackexchange 的 {"error_id","error_name","error_message"}
+type errorBody struct {
+	Error            string          `json:"error"`
+	ErrorDescription string          `json:"error_description"`
+	Message          string          `json:"message"`
+	Code             json.RawMessage `json:"code"`
+	ErrorID          int             `json:"error_id"`
+	ErrorName        string          `json:"error_name"`
+	ErrorMessage     string          `json:"error_message"`
+}
+
+// newProviderError 从平台的错误响应体中提取错误码和信息, 无法解析时使用原始内容
+func newProviderError(provider string, status int, body []byte) *ProviderError {
+	e := &ProviderError{Provider: provider, Status: status}
+	var b errorBody
+	if err := json.Unmarshal(body, &b); err != nil {
+		if len(body) > 200 {
+			body = body[:200]
+		}
+		e.Message = string(body)
+		return e
+	}
+	switch {
+	case b.ErrorID != 0:
+		e.Code, e.Message = b.ErrorName, b.ErrorMessage
+		if e.Code == "" {
+			e.Code = strconv.Itoa(b.ErrorID)
+		}
+	case b.Error != "":
+		e.Code, e.Message = b.Error, b.ErrorDescription
+	default:
+		e.Message = b.Message
+		if len(b.Code) > 0 && string(b.Code) != "null" {
+			var code interface{}
+			json.Unmarshal(b.Code, &code)
+			e.Code = fmt.Sprint(code)
+		}
+	}
+	return e
+}
+
+// decodeResponse 2xx 时把响应体解析到 v, 否则返回 *ProviderError
+func decodeResponse(provider string, resp *http.Response, v interface{}) error {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return newProviderError(provider, resp.StatusCode, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return &ProviderError{Provider: provider, Status: resp.StatusCode, Code: "invalid_response", Message: err.Error()}
+	}
+	return nil
+}
+
+// wrapProviderError 把 oauth2 和 google api 的错误转换为 *ProviderError, 其他错误原样返回
+func wrapProviderError(provider string, err error) error {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return newProviderError(provider, retrieveErr.Response.StatusCode, retrieveErr.Body)
+	}
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		e := &ProviderError{Provider: provider, Status: googleErr.Code, Message: googleErr.Message}
+		if len(googleErr.Errors) > 0 {
+			e.Code = googleErr.Errors[0].Reason
+		}
+		return e
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+func TestNewProviderError(t *testing.T) {
+	cases := []struct {
+		body string
+		want ProviderError
+	}{
+		{`{"error":"invalid_grant","error_description":"bad code"}`, ProviderError{Code: "invalid_grant", Message: "bad code"}},
+		{`{"message":"401: Unauthorized","code":0}`, ProviderError{Code: "0", Message: "401: Unauthorized"}},
+		{`{"message":"Bad credentials","documentation_url":"https://docs.github.com"}`, ProviderError{Message: "Bad credentials"}},
+		{`{"error_id":502,"error_name":"throttle_violation","error_message":"too many requests"}`, ProviderError{Code: "throttle_violation", Message: "too many requests"}},
+		{`<html>bad gateway</html>`, ProviderError{Message: "<html>bad gateway</html>"}},
+	}
+	for _, tc := range cases {
+		got := newProviderError("test", http.StatusBadRequest, []byte(tc.body))
+		if got.Code != tc.want.Code || got.Message != tc.want.Message {
+			t.Errorf("%s: got code %q message %q", tc.body, got.Code, got.Message)
+		}
+	}
+}
+
+func TestStackoverflowMalformedResponse(t *testing.T) {
+	for _, body := range []string{`{"items":[]}`, `{"items":[{"display_name":"x"}]}`, `{"error_id":403,"error_name":"access_denied"}`, `not json`} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		cfg := config.Default()
+		cfg.Stackoverflow.Endpoint.APIURL = server.URL
+		_, err := NewStackoverflow(cfg, http.DefaultClient, zap.NewNop()).FetchIdentity(context.Background(), &oauth2.Token{AccessToken: "token"})
+		server.Close()
+		var providerErr *ProviderError
+		if !errors.As(err, &providerErr) {
+			t.Errorf("%s: err = %v, want *ProviderError", body, err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"go.uber.org/zap"
+)
+
+// ErrRefreshTokenInvalid 刷新令牌不存在、已过期或已撤销
+var ErrRefreshTokenInvalid = errors.New("refresh token invalid")
+
+// refreshTokenBytes 刷新令牌的随机字节数
+const refreshTokenBytes = 32
+
+// Tokens 签发给客户端的 jwt 和刷新令牌
+type Tokens struct {
+	AccessToken  string `json:"jwt"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// ExpiresIn jwt 的有效期, 单位为秒
+	ExpiresIn int `json:"expires_in,omitempty"`
+}
+
+// Sessions 签发、轮换和撤销本服务的会话. 每次登录开启一个会话 (刷新令牌的 family),
+// 刷新时轮换出新的刷新令牌, 旧令牌再次使用时整个会话失效
+type Sessions struct {
+	store      utils.SessionStore
+	refreshTTL time.Duration
+	logger     *zap.Logger
+}
+
+func NewSessions(cfg *config.Config, store utils.SessionStore, logger *zap.Logger) *Sessions {
+	return &Sessions{
+		store:      store,
+		refreshTTL: time.Duration(cfg.JWT.RefreshTTL) * time.Second,
+		logger:     logger,
+	}
+}
+
+// Grant 会话的归属. 本服务自己的会话只有 Address, 第三方应用的会话带 ClientID 和授权的 Scope
+type Grant struct {
+	Address  string
+	ClientID string
+	Scope    string
+}
+
+// Issue 为 address 开启新的会话
+func (s *Sessions) Issue(ctx context.Context, address string) (*Tokens, error) {
+	family, err := utils.RandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	return s.issue(ctx, Grant{Address: address}, family, true)
+}
+
+// IssueClient 为第三方应用开启会话 family, offline 为 false 时只签发 access token
+func (s *Sessions) IssueClient(ctx context.Context, grant Grant, family string, offline bool) (*Tokens, error) {
+	return s.issue(ctx, grant, family, offline)
+}
+
+func (s *Sessions) issue(ctx context.Context, grant Grant, family string, withRefresh bool) (*Tokens, error) {
+	tokens := &Tokens{ExpiresIn: int(utils.JwtAccessTTL() / time.Second)}
+	if withRefresh {
+		refreshToken, err := utils.RandomToken(refreshTokenBytes)
+		if err != nil {
+			return nil, err
+		}
+		err = s.store.CreateRefreshToken(ctx, &utils.RefreshToken{
+			Hash:      utils.HashToken(refreshToken),
+			Family:    family,
+			Addr:      grant.Address,
+			ClientID:  grant.ClientID,
+			Scope:     grant.Scope,
+			ExpiresAt: time.Now().Add(s.refreshTTL),
+		})
+		if err != nil {
+			return nil, err
+		}
+		tokens.RefreshToken = refreshToken
+	}
+	var accessToken string
+	var err error
+	if grant.ClientID == "" {
+		accessToken, err = utils.JwtEncodeSession(grant.Address, family)
+	} else {
+		accessToken, err = utils.JwtEncodeClient(grant.Address, family, grant.ClientID, grant.Scope)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tokens.AccessToken = accessToken
+	return tokens, nil
+}
+
+// Refresh 用刷新令牌换取新的 jwt 和刷新令牌. 令牌已经轮换过时撤销整个会话并返回 utils.ErrRefreshTokenReused
+func (s *Sessions) Refresh(ctx context.Context, refreshToken string) (*Tokens, error) {
+	tokens, _, err := s.refresh(ctx, "", refreshToken)
+	return tokens, err
+}
+
+// RefreshClient 第三方应用 clientID 用刷新令牌换取新的 access token, 返回会话的授权.
+// 其他应用或本服务签发的刷新令牌返回 ErrRefreshTokenInvalid
+func (s *Sessions) RefreshClient(ctx context.Context, clientID string, refreshToken string) (*Tokens, *Grant, error) {
+	return s.refresh(ctx, clientID, refreshToken)
+}
+
+func (s *Sessions) refresh(ctx context.Context, clientID string, refreshToken string) (*Tokens, *Grant, error) {
+	token, err := s.store.UseRefreshToken(ctx, utils.HashToken(refreshToken))
+	if errors.Is(err, utils.ErrRefreshTokenNotFound) {
+		return nil, nil, ErrRefreshTokenInvalid
+	}
+	if errors.Is(err, utils.ErrRefreshTokenReused) {
+		s.logger.Warn("refresh token reused, revoke session", zap.String("addr", token.Addr), zap.String("family", token.Family))
+		if err := s.revokeFamily(ctx, token.Family); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, utils.ErrRefreshTokenReused
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if token.ClientID != clientID {
+		// 令牌被其他应用拿到, 已经标记为使用, 原应用再次刷新时按重放撤销整个会话
+		s.logger.Warn("refresh token used by another client", zap.String("client_id", clientID), zap.String("family", token.Family))
+		return nil, nil, ErrRefreshTokenInvalid
+	}
+	if token.RevokedAt != nil || time.Now().After(token.ExpiresAt) {
+		return nil, nil, ErrRefreshTokenInvalid
+	}
+	grant := &Grant{Address: token.Addr, ClientID: token.ClientID, Scope: token.Scope}
+	tokens, err := s.issue(ctx, *grant, token.Family, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tokens, grant, nil
+}
+
+// Logout 撤销 jwt 和它所属的会话. all 为 true 时撤销地址的所有会话和之前签发的所有 jwt
+func (s *Sessions) Logout(ctx context.Context, claims *utils.Claims, all bool) error {
+	if err := s.RevokeAccessToken(ctx, claims); err != nil {
+		return err
+	}
+	if claims.Sid != "" {
+		if err := s.revokeFamily(ctx, claims.Sid); err != nil {
+			return err
+		}
+	}
+	if !all {
+		return nil
+	}
+	families, err := s.store.RevokeRefreshTokens(ctx, "", claims.Address)
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if err := s.revokeFamily(ctx, family); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	// iat 精确到秒, 按秒撤销不在会话中的 jwt, 以免退出后马上登录签发的 jwt 也失效.
+	// 其他服务签发的 jwt 有效期未知, 按刷新令牌的有效期保留
+	return s.store.Revoke(ctx, &utils.Revocation{Kind: utils.RevokeAddress, Value: claims.Address, RevokedAt: now.Truncate(time.Second), ExpiresAt: now.Add(s.refreshTTL)})
+}
+
+// RevokeAccessToken 把单个 jwt 的 jti 加入撤销列表, 保留到 jwt 过期, 没有 jti 的 jwt 不处理
+func (s *Sessions) RevokeAccessToken(ctx context.Context, claims *utils.Claims) error {
+	if claims.ID == "" {
+		return nil
+	}
+	now := time.Now()
+	expiresAt := now.Add(utils.JwtAccessTTL())
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	return s.store.Revoke(ctx, &utils.Revocation{Kind: utils.RevokeJTI, Value: claims.ID, RevokedAt: now, ExpiresAt: expiresAt})
+}
+
+// RevokeClient 撤销 address 签发给第三方应用 clientID 的所有会话, 返回撤销的会话数
+func (s *Sessions) RevokeClient(ctx context.Context, clientID, address string) (int, error) {
+	families, err := s.store.RevokeClientRefreshTokens(ctx, clientID, address)
+	if err != nil {
+		return 0, err
+	}
+	for _, family := range families {
+		if err := s.revokeFamily(ctx, family); err != nil {
+			return 0, err
+		}
+	}
+	return len(families), nil
+}
+
+// RevokeFamily 撤销会话的刷新令牌和已经签发的 jwt
+func (s *Sessions) RevokeFamily(ctx context.Context, family string) error {
+	return s.revokeFamily(ctx, family)
+}
+
+func (s *Sessions) revokeFamily(ctx context.Context, family string) error {
+	if _, err := s.store.RevokeRefreshTokens(ctx, family, ""); err != nil {
+		return err
+	}
+	now := time.Now()
+	return s.store.Revoke(ctx, &utils.Revocation{Kind: utils.RevokeFamily, Value: family, RevokedAt: now, ExpiresAt: now.Add(utils.JwtAccessTTL())})
+}
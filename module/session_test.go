@@ -0,0 +1,89 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"go.uber.org/zap"
+)
+
+func TestSessions(t *testing.T) {
+	stores := map[string]func(t *testing.T) utils.Store{
+		"memory": func(t *testing.T) utils.Store { return utils.NewMemoryStore() },
+		"sqlite": func(t *testing.T) utils.Store { return utils.NewGormStore(testSqliteDB(t)) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+			cfg := config.Default()
+			cfg.JWT.Secret = "secret"
+			utils.ConfigureJwt(cfg.JWT)
+			utils.ConfigureRevocations(store)
+			t.Cleanup(func() {
+				utils.ConfigureJwt(config.JWTConfig{})
+				utils.ConfigureRevocations(nil)
+			})
+			sessions := NewSessions(cfg, store, zap.NewNop())
+			address := "0x0000000000000000000000000000000000000001"
+
+			first, err := sessions.Issue(ctx, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := sessions.Refresh(ctx, first.RefreshToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := utils.JwtDecode(second.AccessToken); err != nil {
+				t.Fatalf("refreshed jwt rejected: %v", err)
+			}
+			if _, err := sessions.Refresh(ctx, "unknown"); !errors.Is(err, ErrRefreshTokenInvalid) {
+				t.Fatalf("unknown refresh token: %v", err)
+			}
+
+			// 旧的刷新令牌再次使用, 整个会话失效
+			other, _ := sessions.Issue(ctx, address)
+			if _, err := sessions.Refresh(ctx, first.RefreshToken); !errors.Is(err, utils.ErrRefreshTokenReused) {
+				t.Fatalf("reused refresh token: %v", err)
+			}
+			if _, err := sessions.Refresh(ctx, second.RefreshToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+				t.Fatalf("refresh token of revoked session: %v", err)
+			}
+			for _, token := range []string{first.AccessToken, second.AccessToken} {
+				if _, err := utils.JwtDecode(token); !errors.Is(err, utils.ErrJwtRevoked) {
+					t.Fatalf("jwt of revoked session: %v", err)
+				}
+			}
+			if _, err := utils.JwtDecode(other.AccessToken); err != nil {
+				t.Fatalf("jwt of other session rejected: %v", err)
+			}
+
+			// 退出所有会话
+			claims, err := utils.JwtParse(other.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sessions.Logout(ctx, claims, true); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := utils.JwtDecode(other.AccessToken); !errors.Is(err, utils.ErrJwtRevoked) {
+				t.Fatalf("jwt after logout: %v", err)
+			}
+			if _, err := sessions.Refresh(ctx, other.RefreshToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+				t.Fatalf("refresh after logout: %v", err)
+			}
+			// 退出后马上登录不受影响
+			next, err := sessions.Issue(ctx, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := utils.JwtDecode(next.AccessToken); err != nil {
+				t.Fatalf("jwt issued after logout rejected: %v", err)
+			}
+		})
+	}
+}
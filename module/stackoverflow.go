@@ -1,138 +1,116 @@
 package module
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 
-	"github.com/KNN3-Network/oauth-server/utils"
+	"github.com/KNN3-Network/oauth-server/config"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/stackoverflow"
 )
 
-var logger = utils.Logger
-
-var (
-	stackoverflowConfig *oauth2.Config
-)
-
-// init
-func init() {
+type Stackoverflow struct {
+	oauthConfig *oauth2.Config
+	apiURL      string
+	appsKey     string
+	client      *http.Client
+	logger      *zap.Logger
+}
 
-	stackoverflowConfig = &oauth2.Config{
-		ClientID:     os.Getenv("STACKOVERFLOW_CLIENT_ID"),
-		ClientSecret: os.Getenv("STACKOVERFLOW_CLIENT_SECRET"),
-		RedirectURL:  os.Getenv("STACKOVERFLOW_REDIRECT_URL"),
+func NewStackoverflow(cfg *config.Config, client *http.Client, logger *zap.Logger) *Stackoverflow {
+	oauthConfig := &oauth2.Config{
+		ClientID:     cfg.Stackoverflow.ClientID,
+		ClientSecret: cfg.Stackoverflow.ClientSecret,
+		RedirectURL:  cfg.Stackoverflow.RedirectURL,
 		Scopes:       []string{}, // https://api.stackexchange.com/docs/authentication#scope
-		Endpoint:     stackoverflow.Endpoint,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  cfg.Stackoverflow.Endpoint.AuthURL,
+			TokenURL: cfg.Stackoverflow.Endpoint.TokenURL,
+		},
 	}
 
-	logger.Info("Stackoverflow oauth config", zap.Any("stackoverflowConfig", &stackoverflowConfig))
+	logger.Info("Stackoverflow oauth config", zap.Any("stackoverflowConfig", oauthConfig))
 
+	return &Stackoverflow{
+		oauthConfig: oauthConfig,
+		apiURL:      strings.TrimSuffix(cfg.Stackoverflow.Endpoint.APIURL, "/"),
+		appsKey:     cfg.Stackoverflow.AppsKey,
+		client:      client,
+		logger:      logger,
+	}
 }
 
-type Stackoverflow struct{}
-
-// AuthCodeURL
-//
-//	@receiver sf
-//	@param c
-func (sf Stackoverflow) AuthCodeURL(c *gin.Context) {
-	url := stackoverflowConfig.AuthCodeURL("state")
-	logger.Info("Stackoverflow oauth AuthCodeURL", zap.String("url", url))
+func (*Stackoverflow) Type() string { return "stackexchange" }
 
-	c.JSON(http.StatusOK, gin.H{
-		"url": url,
-	})
+func (sf *Stackoverflow) AuthCodeURL(client string, state string, challenge string) string {
+	return sf.oauthConfig.AuthCodeURL(state, pkceAuthOptions(challenge)...)
 }
 
-// CallBack //
+func (*Stackoverflow) CallbackPath() string { return "/oauth/stackoverflow/" }
+
+// Callback //
 //
 //	@receiver sf
 //	@param c
-func (sf Stackoverflow) CallBack(c *gin.Context) {
-	code := c.Query("code")
-	if code == "" {
-		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("No authorization code provided."))
-		return
-	}
-	logger.Info("stackoverflow oauth", zap.String("code", code))
-
-	c.Redirect(http.StatusTemporaryRedirect, "https://topscore.social/pass?type=stackexchange&code="+code)
+func (sf *Stackoverflow) Callback(c *gin.Context, flow *Flow) {
+	flow.defaultCallback(c, "stackexchange")
 }
 
-// Bind
+// Exchange
 //
 //	@receiver sf
-//	@param c
+//	@param ctx
 //	@param code
-//	@param address
-func (sf Stackoverflow) Bind(c *gin.Context, code string, address string) {
+//	@param verifier
+//	@return *oauth2.Token
+//	@return error
+func (sf *Stackoverflow) Exchange(ctx context.Context, code string, verifier string) (*oauth2.Token, error) {
+	sf.logger.Info("Stackoverflow CallBack", zap.String("code", code))
 
-	logger.Info("Stackoverflow CallBack", zap.String("code", code))
+	token, err := sf.oauthConfig.Exchange(withClient(ctx, sf.client), code, pkceExchangeOptions(verifier)...)
+	sf.logger.Info("Stackoverflow token", zap.Any("token", token))
+	return token, wrapProviderError("stackexchange", err)
+}
 
-	// get token
-	token, err := stackoverflowConfig.Exchange(c, code)
+// StackexchangeUser /me 返回的账号, 只保留用到的字段
+type StackexchangeUser struct {
+	AccountID    int64  `json:"account_id"`
+	UserID       int64  `json:"user_id"`
+	DisplayName  string `json:"display_name"`
+	ProfileImage string `json:"profile_image"`
+	Link         string `json:"link"`
+}
 
-	logger.Info("Stackoverflow token", zap.Any("token", token))
-	if err != nil {
-		logger.Error("Stackoverflow failed to exchange token:", zap.Error(err))
-		// Redirect error page
-		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("error code"))
-		return
-	}
+// stackexchangeResponse stackexchange api 的响应外层, 出错时带 error_id
+type stackexchangeResponse struct {
+	Items        []StackexchangeUser `json:"items"`
+	ErrorID      int                 `json:"error_id"`
+	ErrorName    string              `json:"error_name"`
+	ErrorMessage string              `json:"error_message"`
+}
 
-	client := stackoverflowConfig.Client(c, token)
-	userInfo, err := sf.UserInfo(client, token.AccessToken)
+// FetchIdentity
+//
+//	@receiver sf
+//	@param ctx
+//	@param token
+//	@return *Identity
+//	@return error
+func (sf *Stackoverflow) FetchIdentity(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+	client := sf.oauthConfig.Client(withClient(ctx, sf.client), token)
+	user, err := sf.UserInfo(ctx, client, token.AccessToken)
 	if err != nil {
-		logger.Error("failed to get user info:", zap.Error(err))
-		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("error userInfo"))
-		return
-	}
-	// logger.Info("Stackoverflow userInfo", zap.Any("userInfo", &userInfo))
-
-	logger.Info("Stackoverflow userInfo", zap.Any("userInfo", userInfo))
-
-	// get stackexchange id
-	stackexchangeId := userInfo["items"].([]interface{})[0].(map[string]interface{})["account_id"].(float64)
-	exchangeName := userInfo["items"].([]interface{})[0].(map[string]interface{})["display_name"].(string)
-
-	logger.Info("Stackoverflow stackexchangeId", zap.Float64("stackexchangeId", stackexchangeId))
-
-	db := utils.GetDB()
-
-	addr := utils.OauthBind{}
-	result := db.Model(&utils.OauthBind{}).Where("exchange = ?", stackexchangeId).First(&addr)
-	if addr != (utils.OauthBind{}) {
-		logger.Error("stackoverflow has bound:", zap.Error(result.Error))
-		c.JSON(http.StatusOK, gin.H{"data": "stackoverflow has bound"})
-		return
+		return nil, err
 	}
 
-	bind := utils.OauthBind{}
-	result = db.Model(&utils.OauthBind{}).Where("addr = ?", address).First(&bind)
-	// check address
-	if bind != (utils.OauthBind{}) {
-		result = db.Model(&bind).Where("addr = ?", address).Updates(map[string]interface{}{"exchange": stackexchangeId, "exchange_name": exchangeName})
-		if result.Error != nil {
-			logger.Error("failed to update address:", zap.Error(result.Error))
-			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("stackexchange update error"))
-			return
-		}
-	} else {
-		result = db.Model(&utils.OauthBind{}).Create(&utils.OauthBind{Addr: address, Exchange: strconv.FormatFloat(stackexchangeId, 'f', -1, 64), ExchangeName: exchangeName})
-		if result.Error != nil {
-			logger.Error("failed to insert oauth_bind:", zap.Error(result.Error))
-			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("insert error"))
-			return
-		}
-	}
-	c.JSON(http.StatusOK, gin.H{"data": "success"})
+	sf.logger.Info("Stackoverflow userInfo", zap.Any("userInfo", user))
 
+	// stackexchange 没有用户名, display_name 作为 handle 展示, 每次登录时刷新
+	return &Identity{ID: strconv.FormatInt(user.AccountID, 10), Handle: user.DisplayName, Name: user.DisplayName, Metadata: map[string]interface{}{"avatar": user.ProfileImage, "link": user.Link}}, nil
 }
 
 /*
@@ -172,26 +150,26 @@ func (sf Stackoverflow) Bind(c *gin.Context, code string, address string) {
 // UserInfo
 //
 //	@receiver sf
+//	@param ctx
 //	@param client
 //	@param accessToken
-//	@return map[string]interface{}
+//	@return *StackexchangeUser
 //	@return error
-func (sf Stackoverflow) UserInfo(client *http.Client, accessToken string) (map[string]interface{}, error) {
+func (sf *Stackoverflow) UserInfo(ctx context.Context, client *http.Client, accessToken string) (*StackexchangeUser, error) {
 
-	req, err := http.NewRequest("GET", "https://api.stackexchange.com/2.3/me", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", sf.apiURL+"/me", nil)
+	if err != nil {
+		return nil, fmt.Errorf("get user info request failed: %w", err)
+	}
 
 	q := req.URL.Query()
-	q.Add("key", os.Getenv("STACKOVERFLOW_APPS_KEY"))
+	q.Add("key", sf.appsKey)
 	q.Add("site", "stackoverflow")
 	q.Add("access_token", accessToken)
 
 	req.URL.RawQuery = q.Encode()
 
-	logger.Info("Stackoverflow oauth req.URL.String", zap.String("url", req.URL.String()))
-
-	if err != nil {
-		return nil, fmt.Errorf("get user info request failed: %w", err)
-	}
+	sf.logger.Info("Stackoverflow oauth req.URL.String", zap.String("url", req.URL.String()))
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -200,29 +178,16 @@ func (sf Stackoverflow) UserInfo(client *http.Client, accessToken string) (map[s
 
 	defer resp.Body.Close()
 
-	logger.Info("Stackoverflow Body", zap.Any("Body", resp.Body))
-	var userInfo map[string]interface{}
-	if err := decodeResponse(resp, &userInfo); err != nil {
+	var body stackexchangeResponse
+	if err := decodeResponse("stackexchange", resp, &body); err != nil {
 		return nil, err
 	}
-
-	return userInfo, nil
-
-}
-
-// decodeResponse
-//
-//	@param resp
-//	@param v
-//	@return error
-func decodeResponse(resp *http.Response, v interface{}) error {
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	if body.ErrorID != 0 {
+		return nil, &ProviderError{Provider: "stackexchange", Status: resp.StatusCode, Code: body.ErrorName, Message: body.ErrorMessage}
 	}
-
-	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
-		return fmt.Errorf("failed to decode response body: %w", err)
+	if len(body.Items) == 0 || body.Items[0].AccountID == 0 {
+		return nil, &ProviderError{Provider: "stackexchange", Status: resp.StatusCode, Code: "invalid_response", Message: "no account in items"}
 	}
 
-	return nil
+	return &body.Items[0], nil
 }
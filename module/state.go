@@ -0,0 +1,122 @@
+package module
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/KNN3-Network/oauth-server/utils"
+	"go.uber.org/zap"
+)
+
+// stateTTL state 的有效期, 超过后回调会被拒绝
+const stateTTL = 10 * time.Minute
+
+var (
+	ErrStateInvalid  = errors.New("oauth state invalid")
+	ErrStateExpired  = errors.New("oauth state expired")
+	ErrStateReplayed = errors.New("oauth state replayed")
+)
+
+// State 签名后放在 oauth 授权链接里的 state, 回调时校验
+type State struct {
+	Nonce    string `json:"n"`
+	Provider string `json:"p"`
+	Client   string `json:"c,omitempty"` // 发起授权的应用, 如 knexus / knexus_early
+	Success  string `json:"s,omitempty"` // 成功后的跳转地址
+	Fail     string `json:"f,omitempty"` // 失败后的跳转地址
+	Expiry   int64  `json:"e"`
+}
+
+// NewState 签发一个 state, 编码格式为 base64(payload).base64(hmac)
+func (f *Flow) NewState(provider, client, success, fail string) (*State, string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	state := &State{
+		Nonce:    base64.RawURLEncoding.EncodeToString(nonce),
+		Provider: provider,
+		Client:   client,
+		Success:  success,
+		Fail:     fail,
+		Expiry:   time.Now().Add(stateTTL).Unix(),
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return nil, "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return state, encoded + "." + f.sign(purposeState, encoded), nil
+}
+
+// ParseState 校验签名、平台和有效期, 不消费 nonce
+func (f *Flow) ParseState(raw string, provider string) (*State, error) {
+	encoded, sig, ok := strings.Cut(raw, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(f.sign(purposeState, encoded))) {
+		return nil, ErrStateInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrStateInvalid
+	}
+	state := &State{}
+	if err := json.Unmarshal(payload, state); err != nil || state.Nonce == "" {
+		return nil, ErrStateInvalid
+	}
+	if state.Provider != provider {
+		return nil, ErrStateInvalid
+	}
+	if time.Now().Unix() > state.Expiry {
+		return nil, ErrStateExpired
+	}
+	return state, nil
+}
+
+// VerifyState 在 ParseState 的基础上消费 nonce, 同一个 state 不能再次回调
+func (f *Flow) VerifyState(ctx context.Context, raw string, provider string) (*State, error) {
+	state, err := f.ParseState(raw, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	fresh, err := f.consumeNonce(ctx, purposeState+state.Nonce, state.Expiry)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		f.logger.Warn("oauth state replayed", zap.String("provider", provider), zap.String("nonce", state.Nonce))
+		return nil, ErrStateReplayed
+	}
+	return state, nil
+}
+
+// consumeNonce 在共享的 store 中记录 nonce 已经使用, 保留到 expiry, 其他实例同样拒绝重放. 已经使用过时返回 false
+func (f *Flow) consumeNonce(ctx context.Context, nonce string, expiry int64) (bool, error) {
+	err := f.store.CreateNonce(ctx, &utils.FlowNonce{Nonce: nonce, ExpiresAt: time.Unix(expiry, 0)})
+	if errors.Is(err, utils.ErrNonceExists) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 签名的用途, 作为 HMAC 输入的前缀. oauth state、授权请求和授权页面的凭证使用同一个密钥, 不能互相冒充
+const (
+	purposeState     = "state."
+	purposeAuthorize = "authz."
+	purposeConsent   = "consent."
+)
+
+// sign 以 purpose 为前缀计算 encoded 的 HMAC
+func (f *Flow) sign(purpose, encoded string) string {
+	mac := hmac.New(sha256.New, f.stateSecret)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
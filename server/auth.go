@@ -0,0 +1,124 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/KNN3-Network/oauth-server/module"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func (s *Server) siweNonce(c *gin.Context) {
+	nonce, err := utils.SiweNonce(c.Request.Context(), s.store)
+	if err != nil {
+		s.logger.Error("failed to issue siwe nonce:", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+	ok(c, gin.H{"nonce": nonce}, gin.H{"nonce": nonce})
+}
+
+func (s *Server) siweVerify(c *gin.Context) {
+	var requestBody utils.RequestSiweBody
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	if requestBody.Message == "" || requestBody.Signature == "" {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, nil)
+		return
+	}
+	address, err := utils.VerifySiwe(c.Request.Context(), s.store, requestBody.Message, requestBody.Signature, s.cfg.Server.SiweDomain)
+	if errors.Is(err, utils.ErrSiweNonceCheck) {
+		s.logger.Error("failed to verify siwe:", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to verify siwe:", zap.Error(err))
+		fail(c, http.StatusUnauthorized, CodeInvalidSignature, nil)
+		return
+	}
+	tokens, err := s.sessions.Issue(c.Request.Context(), address)
+	if err != nil {
+		s.logger.Error("failed to issue session:", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+	data := gin.H{"address": address, "jwt": tokens.AccessToken, "refresh_token": tokens.RefreshToken, "expires_in": tokens.ExpiresIn}
+	ok(c, gin.H{"data": data}, data)
+}
+
+// refresh 用刷新令牌换取新的 jwt, 旧的刷新令牌随即失效
+func (s *Server) refresh(c *gin.Context) {
+	var requestBody utils.RequestRefreshBody
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	if requestBody.RefreshToken == "" {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, nil)
+		return
+	}
+	tokens, err := s.sessions.Refresh(c.Request.Context(), requestBody.RefreshToken)
+	switch {
+	case errors.Is(err, module.ErrRefreshTokenInvalid):
+		fail(c, http.StatusUnauthorized, CodeInvalidRefreshToken, nil)
+		return
+	case errors.Is(err, utils.ErrRefreshTokenReused):
+		fail(c, http.StatusUnauthorized, CodeRefreshTokenReused, nil)
+		return
+	case err != nil:
+		s.logger.Error("failed to refresh session:", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+	ok(c, gin.H{"data": tokens}, tokens)
+}
+
+// logout 撤销请求中的 jwt 和它所属的会话, all 为 true 时撤销地址的所有会话
+func (s *Server) logout(c *gin.Context) {
+	var requestBody utils.RequestLogoutBody
+	// 请求体可以为空
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&requestBody); err != nil {
+			fail(c, http.StatusBadRequest, CodeInvalidRequest, err)
+			return
+		}
+	}
+	token := requestBody.JWT
+	if token == "" {
+		token = bearerToken(c)
+	}
+	if token == "" {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, nil)
+		return
+	}
+	claims, err := utils.JwtParse(token)
+	if err != nil {
+		s.jwtError(c, err)
+		return
+	}
+	if err := s.sessions.Logout(c.Request.Context(), claims, requestBody.All); err != nil {
+		s.logger.Error("failed to logout:", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+	s.logger.Info("logout", zap.String("address", claims.Address), zap.Bool("all", requestBody.All))
+	data := gin.H{"address": claims.Address, "all": requestBody.All}
+	ok(c, gin.H{"data": data}, data)
+}
+
+func (s *Server) jwks(c *gin.Context) {
+	jwks, err := utils.PublicJWKS()
+	if err != nil {
+		s.logger.Error("failed to load jwks:", zap.Error(err))
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("jwks error"))
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, jwks)
+}
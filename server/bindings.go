@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/KNN3-Network/oauth-server/module"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// mimeNDJSON 批量查询按行输出的格式
+const mimeNDJSON = "application/x-ndjson"
+
+func (s *Server) bindings(c *gin.Context) {
+	// 存储中的地址都是小写, checksum 格式的地址同样可以查询
+	address, valid := utils.NormalizeAddress(c.Param("addr"))
+	if !valid {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, fmt.Errorf("invalid address %q", c.Param("addr")))
+		return
+	}
+	// 只有地址本人才能看到隐私平台的完整账号
+	owner := strings.EqualFold(bearerAddress(c), address)
+	accounts, err := module.Bindings(c, s.store, s.providers, address, !owner)
+	if err != nil {
+		s.logger.Error("failed to query bindings:", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+	filter, err := s.bindingFilter(c, []string{address})
+	if err != nil {
+		s.logger.Error("failed to load consent grants:", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+	data := gin.H{"addr": address, "accounts": filter.Accounts(address, accounts)}
+	ok(c, gin.H{"data": data}, data)
+}
+
+func (s *Server) batchBindings(c *gin.Context) {
+	var requestBody utils.RequestBatchBody
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	if len(requestBody.Addrs) == 0 || len(requestBody.Addrs) > maxBatchAddrs {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, nil)
+		return
+	}
+	var provider module.Provider
+	if requestBody.PlatformType != "" {
+		var found bool
+		if provider, found = s.providers.Get(requestBody.PlatformType); !found {
+			fail(c, http.StatusBadRequest, CodeUnsupportedPlatform, nil)
+			return
+		}
+	}
+
+	// 存储中的地址都是小写, 重复的地址只返回一次
+	addrs, err := normalizeAddrs(requestBody.Addrs)
+	if err != nil {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	filter, err := s.bindingFilter(c, addrs)
+	if err != nil {
+		s.logger.Error("failed to load consent grants:", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+
+	// Accept 优先 application/x-ndjson 时每行一个地址, 否则返回 JSON 数组. v2 的数组放在 data 中
+	ndjson := c.NegotiateFormat(gin.MIMEJSON, mimeNDJSON) == mimeNDJSON
+	if ndjson {
+		c.Header("Content-Type", mimeNDJSON)
+	} else {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+	}
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	written := 0
+	envelope := isV2(c) && !ndjson
+	if envelope {
+		prefix, _ := json.Marshal(Response{Code: CodeOK, Message: CodeOK.Message(requestLang(c))})
+		// 去掉结尾的 "null}", 数组作为 data 流式输出
+		c.Writer.Write(prefix[:len(prefix)-len("null}")])
+	}
+	if !ndjson {
+		c.Writer.WriteString("[")
+	}
+	err = module.BatchBindings(c, s.store, s.providers, addrs, provider, func(b *module.AddressBindings) error {
+		// 过滤后没有账号的地址不返回
+		if b.Accounts = filter.Accounts(b.Addr, b.Accounts); len(b.Accounts) == 0 {
+			return nil
+		}
+		if !ndjson && written > 0 {
+			c.Writer.WriteString(",")
+		}
+		written++
+		if err := encoder.Encode(b); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		// 已经开始输出, 只能中断响应
+		s.logger.Error("failed to batch query bindings:", zap.Error(err))
+		c.Abort()
+		return
+	}
+	if !ndjson {
+		c.Writer.WriteString("]")
+	}
+	if envelope {
+		c.Writer.WriteString("}")
+	}
+}
+
+// normalizeAddrs 把地址转成小写并去重, 保持请求中的顺序. 有不合法的地址时返回错误
+func normalizeAddrs(addrs []string) ([]string, error) {
+	seen := make(map[string]bool, len(addrs))
+	normalized := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		address, ok := utils.NormalizeAddress(addr)
+		if !ok {
+			return nil, fmt.Errorf("invalid address %q", addr)
+		}
+		if !seen[address] {
+			seen[address] = true
+			normalized = append(normalized, address)
+		}
+	}
+	return normalized, nil
+}
+
+func (s *Server) lookup(c *gin.Context) {
+	platformType := c.Query("type")
+	id := c.Query("id")
+	if platformType == "" || id == "" {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, nil)
+		return
+	}
+	provider, found := s.providers.Get(platformType)
+	if !found {
+		fail(c, http.StatusBadRequest, CodeUnsupportedPlatform, nil)
+		return
+	}
+	address, err := module.LookupAddress(c, s.store, provider, id)
+	if err == nil {
+		// 调用方看不到的绑定按没有绑定返回
+		var filter *module.BindingFilter
+		if filter, err = s.bindingFilter(c, []string{address}); err == nil && !filter.Allow(address, platformType) {
+			err = module.ErrNotBound
+		}
+	}
+	if errors.Is(err, module.ErrNotBound) {
+		if !isV2(c) {
+			c.JSON(http.StatusNotFound, gin.H{"data": nil})
+			return
+		}
+		fail(c, http.StatusNotFound, CodeIdentityNotBound, nil)
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to lookup address:", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+	data := gin.H{"addr": address, "type": platformType, "id": id}
+	ok(c, gin.H{"data": data}, data)
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/KNN3-Network/oauth-server/module"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// consentCookie 打开授权页面时设置的 cookie, 保存授权凭证对应的 nonce
+const consentCookie = "knn3_consent"
+
+// consentTemplate 服务端渲染的授权页面, 勾选的 scope 和凭证提交到 /authorize/decision
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+</head>
+<body>
+{{if .Error}}
+<h1>{{.Title}}</h1>
+<p>{{.Error}}</p>
+{{else}}
+<form method="post" action="/authorize/decision">
+<h1>{{.Title}}</h1>
+<p>{{.Address}}</p>
+<ul>
+{{range .Scopes}}<li><label><input type="checkbox" name="scope" value="{{.Scope}}" checked{{if .Required}} disabled{{end}}> {{.Label}}{{if .Detail}} <small>{{.Detail}}</small>{{end}}</label></li>
+{{end}}</ul>
+<p><small>{{.Redirect}}</small></p>
+<input type="hidden" name="consent" value="{{.Ticket}}">
+<button type="submit" name="action" value="deny">{{.Deny}}</button>
+<button type="submit" name="action" value="approve">{{.Approve}}</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// consentTexts 授权页面的英文和中文文案
+var consentTexts = map[string][2]string{
+	"title":         {"%s wants to access your KNN3 account", "%s 请求访问你的 KNN3 账号"},
+	"redirect":      {"You will be redirected to %s", "授权后将跳转到 %s"},
+	"approve":       {"Allow", "同意"},
+	"deny":          {"Cancel", "拒绝"},
+	"error":         {"Authorization failed", "授权失败"},
+	"invalid":       {"The authorization request is invalid or has expired, please go back to the app and try again.", "授权请求无效或已过期, 请返回应用重试。"},
+	"not_linked":    {"not linked", "未绑定"},
+	"openid":        {"Know your wallet address", "获取你的钱包地址"},
+	"offline":       {"Stay signed in", "保持登录"},
+	"identity":      {"See your linked %s account", "查看你绑定的 %s 账号"},
+	"identity_mail": {"See your linked email", "查看你绑定的邮箱"},
+}
+
+type consentScopeView struct {
+	Scope    string
+	Label    string
+	Detail   string
+	Required bool
+}
+
+type consentView struct {
+	Lang     string
+	Title    string
+	Error    string
+	Address  string
+	Scopes   []consentScopeView
+	Redirect string
+	Ticket   string
+	Approve  string
+	Deny     string
+}
+
+// consent 登录页面以表单提交 request 和 jwt, 已经授权过时直接跳转回应用, 否则渲染授权页面
+func (s *Server) consent(c *gin.Context) {
+	lang := requestLang(c)
+	address, err := utils.JwtDecode(c.PostForm("jwt"))
+	if err != nil {
+		s.logger.Error("failed to decode jwt:", zap.Error(err))
+		s.renderConsent(c, http.StatusUnauthorized, consentView{Error: localize(lang, consentTexts["invalid"])})
+		return
+	}
+	page, redirect, err := s.auth.Consent(c.Request.Context(), c.PostForm("request"), address)
+	if err != nil {
+		s.consentError(c, err)
+		return
+	}
+	if redirect != "" {
+		c.Redirect(http.StatusSeeOther, redirect)
+		return
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     consentCookie,
+		Value:    page.Nonce,
+		Path:     "/authorize",
+		Expires:  time.Unix(page.Request.Expiry, 0),
+		Secure:   strings.HasPrefix(s.cfg.OIDC.Issuer, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	view := consentView{
+		Title:   fmt.Sprintf(localize(lang, consentTexts["title"]), page.Client.Name),
+		Address: page.Address,
+		Ticket:  page.Ticket,
+		Approve: localize(lang, consentTexts["approve"]),
+		Deny:    localize(lang, consentTexts["deny"]),
+	}
+	if u, err := url.Parse(page.Request.RedirectURI); err == nil {
+		view.Redirect = fmt.Sprintf(localize(lang, consentTexts["redirect"]), u.Host)
+	}
+	for _, scope := range page.Scopes {
+		view.Scopes = append(view.Scopes, scopeView(lang, scope))
+	}
+	s.renderConsent(c, http.StatusOK, view)
+}
+
+// consentDecision 授权页面提交的结果, 跳转回应用. 凭证必须和打开页面时设置的 cookie 一起提交
+func (s *Server) consentDecision(c *gin.Context) {
+	nonce, _ := c.Cookie(consentCookie)
+	http.SetCookie(c.Writer, &http.Cookie{Name: consentCookie, Path: "/authorize", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	raw, address, err := s.auth.ParseConsent(c.Request.Context(), c.PostForm("consent"), nonce)
+	if err != nil {
+		s.consentError(c, err)
+		return
+	}
+	var redirect string
+	if c.PostForm("action") == "approve" {
+		// 取消勾选全部 scope 时只同意 openid
+		selected := c.PostFormArray("scope")
+		if selected == nil {
+			selected = []string{}
+		}
+		redirect, err = s.auth.Approve(c.Request.Context(), raw, address, selected)
+	} else {
+		redirect, err = s.auth.Deny(raw)
+	}
+	if err != nil {
+		s.consentError(c, err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, redirect)
+}
+
+func (s *Server) consentError(c *gin.Context, err error) {
+	lang := requestLang(c)
+	status := http.StatusBadRequest
+	if !errors.Is(err, module.ErrAuthorizeRequestInvalid) && !errors.Is(err, module.ErrAuthorizeRequestExpired) &&
+		!errors.Is(err, utils.ErrClientNotFound) {
+		s.logger.Error("failed to handle consent:", zap.Error(err))
+		status = http.StatusInternalServerError
+	}
+	s.renderConsent(c, status, consentView{Error: localize(lang, consentTexts["invalid"])})
+}
+
+// renderConsent 授权页面不允许被嵌入其他页面, 也不缓存
+func (s *Server) renderConsent(c *gin.Context, status int, view consentView) {
+	lang := requestLang(c)
+	view.Lang = "en"
+	if localize(lang, [2]string{"en", "zh"}) == "zh" {
+		view.Lang = "zh"
+	}
+	if view.Error != "" {
+		view.Title = localize(lang, consentTexts["error"])
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	if err := consentTemplate.Execute(c.Writer, view); err != nil {
+		s.logger.Error("failed to render consent page:", zap.Error(err))
+	}
+}
+
+// scopeView 授权页面上一项 scope 的文案, identity scope 带上绑定的账号
+func scopeView(lang string, scope module.ConsentScope) consentScopeView {
+	view := consentScopeView{Scope: scope.Scope}
+	switch {
+	case scope.Scope == module.ScopeOpenID:
+		view.Label = localize(lang, consentTexts["openid"])
+		view.Required = true
+	case scope.Scope == module.ScopeOfflineAccess:
+		view.Label = localize(lang, consentTexts["offline"])
+	case scope.Scope == module.IdentityScope("gmail"):
+		view.Label = localize(lang, consentTexts["identity_mail"])
+	default:
+		view.Label = fmt.Sprintf(localize(lang, consentTexts["identity"]), strings.TrimPrefix(scope.Scope, module.ScopeIdentityPrefix))
+	}
+	if strings.HasPrefix(scope.Scope, module.ScopeIdentityPrefix) {
+		view.Detail = localize(lang, consentTexts["not_linked"])
+		if scope.Account != nil {
+			view.Detail = scope.Account.Handle
+			if view.Detail == "" {
+				view.Detail = scope.Account.ID
+			}
+		}
+	}
+	return view
+}
+
+// grants 地址授权过的第三方应用
+func (s *Server) grants(c *gin.Context) {
+	address, err := utils.JwtDecode(bearerToken(c))
+	if err != nil {
+		s.jwtError(c, err)
+		return
+	}
+	grants, err := s.auth.Grants(c.Request.Context(), address)
+	if err != nil {
+		s.logger.Error("failed to list grants:", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+	ok(c, gin.H{"data": grants}, grants)
+}
+
+// revokeGrant 撤销对第三方应用的授权, 应用已经拿到的 token 随即失效
+func (s *Server) revokeGrant(c *gin.Context) {
+	var requestBody utils.RequestRevokeGrantBody
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	token := requestBody.JWT
+	if token == "" {
+		token = bearerToken(c)
+	}
+	if token == "" || requestBody.ClientID == "" {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, nil)
+		return
+	}
+	address, err := utils.JwtDecode(token)
+	if err != nil {
+		s.jwtError(c, err)
+		return
+	}
+	err = s.auth.RevokeGrant(c.Request.Context(), address, requestBody.ClientID)
+	if errors.Is(err, utils.ErrGrantNotFound) {
+		fail(c, http.StatusNotFound, CodeGrantNotFound, nil)
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to revoke grant:", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+	data := gin.H{"address": address, "client_id": requestBody.ClientID}
+	ok(c, gin.H{"data": data}, data)
+}
@@ -0,0 +1,405 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/fakeprovider"
+	"github.com/KNN3-Network/oauth-server/httpclient"
+	"github.com/KNN3-Network/oauth-server/module"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	e2eAlice = "0x0000000000000000000000000000000000000001"
+	e2eBob   = "0x0000000000000000000000000000000000000002"
+)
+
+// newE2E 使用内置平台和模拟的平台服务创建服务
+func newE2E(t *testing.T) (http.Handler, *fakeprovider.Server) {
+	return newE2EWithStore(t, utils.NewMemoryStore())
+}
+
+// newE2EWithStore configure 在指向模拟平台之后修改配置
+func newE2EWithStore(t *testing.T, store utils.Store, configure ...func(*config.Config)) (http.Handler, *fakeprovider.Server) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	fake := fakeprovider.New()
+	t.Cleanup(fake.Close)
+
+	cfg := config.Default()
+	cfg.JWT.Secret = "secret"
+	cfg.Server.PassURL = "https://pass.test/bind"
+	cfg.OAuth.RedirectAllowlist = config.Allowlist{"knexus": {"https://knexus.xyz/*"}}
+	fake.Configure(cfg, "http://oauth.test")
+	for _, f := range configure {
+		f(cfg)
+	}
+	logger := zap.NewNop()
+	client := httpclient.New(cfg.HTTP, logger).HTTPClient()
+	return New(cfg, store, module.DefaultProviders(cfg, client, logger), client, logger), fake
+}
+
+func get(h http.Handler, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+// authorize 获取授权链接并在模拟平台上同意授权, 返回平台跳回本服务的回调地址
+func authorize(t *testing.T, h http.Handler, fake *fakeprovider.Server, query string, user fakeprovider.User) string {
+	t.Helper()
+	w := get(h, "/oauth/authcodeurl?"+query)
+	if w.Code != http.StatusOK {
+		t.Fatalf("authcodeurl %s: %d %s", query, w.Code, w.Body)
+	}
+	var body struct {
+		URL string `json:"url"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	callback, err := fake.Authorize(body.URL, user)
+	if err != nil {
+		t.Fatalf("authorize %s: %v", body.URL, err)
+	}
+	u, _ := url.Parse(callback)
+	return u.RequestURI()
+}
+
+// callback 请求回调, 返回跳转到 pass 页面带上的 code 和 state
+func callback(t *testing.T, h http.Handler, target string) (code, state string) {
+	t.Helper()
+	w := get(h, target)
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("callback %s: %d %s", target, w.Code, w.Body)
+	}
+	u, _ := url.Parse(w.Header().Get("Location"))
+	if !strings.HasPrefix(u.String(), "https://pass.test/bind?") {
+		t.Fatalf("callback redirected to %s", u)
+	}
+	return u.Query().Get("code"), u.Query().Get("state")
+}
+
+func TestE2EBind(t *testing.T) {
+	store := utils.NewMemoryStore()
+	h, fake := newE2EWithStore(t, store)
+	alice, _ := utils.JwtEncode(e2eAlice)
+	bob, _ := utils.JwtEncode(e2eBob)
+
+	cases := []struct {
+		platformType string
+		query        string
+		user         fakeprovider.User
+		id           string
+		handle       string
+	}{
+		{"github", "type=github", fakeprovider.User{ID: "583231", Login: "octocat", Name: "The Octocat"}, "583231", "octocat"},
+		{"discord", "type=discord", fakeprovider.User{ID: "80351110224678912", Login: "nelly"}, "80351110224678912", "nelly"},
+		{"gmail", "type=gmail", fakeprovider.User{ID: "109876543210987654321", Email: "alice@gmail.com"}, "109876543210987654321", "alice@gmail.com"},
+		{"stackexchange", "type=stackexchange", fakeprovider.User{ID: "1234567", Login: "alice"}, "1234567", "alice"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.platformType, func(t *testing.T) {
+			code, state := callback(t, h, authorize(t, h, fake, tc.query, tc.user))
+			w := postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: alice, Code: code, State: state, PlatformType: tc.platformType})
+			if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"success"`)) {
+				t.Fatalf("bind: %d %s", w.Code, w.Body)
+			}
+			w = get(h, "/oauth/lookup?type="+tc.platformType+"&id="+url.QueryEscape(tc.id))
+			if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(e2eAlice)) {
+				t.Fatalf("lookup: %d %s", w.Code, w.Body)
+			}
+			linked, err := store.GetByIdentity(context.Background(), tc.platformType, tc.id)
+			if err != nil || linked.Handle != tc.handle {
+				t.Fatalf("binding handle: %+v %v, want %q", linked, err, tc.handle)
+			}
+			// lookup 只接受账号 id, 不再接受 login 和邮箱
+			if tc.handle != tc.id {
+				if w = get(h, "/oauth/lookup?type="+tc.platformType+"&id="+url.QueryEscape(tc.handle)); w.Code != http.StatusNotFound {
+					t.Fatalf("lookup by handle: %d %s", w.Code, w.Body)
+				}
+			}
+
+			// 同一个平台账号不能再绑定到其他地址
+			code, state = callback(t, h, authorize(t, h, fake, tc.query, tc.user))
+			w = postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: bob, Code: code, State: state, PlatformType: tc.platformType})
+			if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"false"`)) {
+				t.Fatalf("bind bound account: %d %s", w.Code, w.Body)
+			}
+
+			// code 只能使用一次
+			w = postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: bob, Code: code, State: state, PlatformType: tc.platformType})
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("bind with used code: %d %s", w.Code, w.Body)
+			}
+
+			// 平台拒绝 code
+			_, state = callback(t, h, authorize(t, h, fake, tc.query, tc.user))
+			w = postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: bob, Code: "bogus", State: state, PlatformType: tc.platformType})
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("bind with bogus code: %d %s", w.Code, w.Body)
+			}
+
+			// 平台用户信息接口故障
+			broken := tc.user
+			broken.ProfileStatus = http.StatusInternalServerError
+			code, state = callback(t, h, authorize(t, h, fake, tc.query, broken))
+			w = postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: bob, Code: code, State: state, PlatformType: tc.platformType})
+			if w.Code != http.StatusBadGateway {
+				t.Fatalf("bind with broken profile: %d %s", w.Code, w.Body)
+			}
+
+			// token 失效等平台拒绝的请求
+			broken.ProfileStatus = http.StatusUnauthorized
+			code, state = callback(t, h, authorize(t, h, fake, tc.query, broken))
+			w = postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: bob, Code: code, State: state, PlatformType: tc.platformType})
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("bind with rejected token: %d %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+// 还以 login 绑定的旧记录: 其他地址不能再绑定, 登录时换成数字 id 并刷新 handle
+func TestE2ELegacyGithubBinding(t *testing.T) {
+	store := utils.NewMemoryStore()
+	ctx := context.Background()
+	if err := store.Upsert(ctx, &utils.LinkedIdentity{Addr: e2eAlice, Provider: "github", Subject: "octocat", Handle: "octocat"}); err != nil {
+		t.Fatal(err)
+	}
+	h, fake := newE2EWithStore(t, store)
+	user := fakeprovider.User{ID: "583231", Login: "octocat", Name: "The Octocat"}
+
+	bob, _ := utils.JwtEncode(e2eBob)
+	code, state := callback(t, h, authorize(t, h, fake, "type=github", user))
+	w := postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: bob, Code: code, State: state, PlatformType: "github"})
+	if !bytes.Contains(w.Body.Bytes(), []byte(`"false"`)) {
+		t.Fatalf("bind legacy bound account: %d %s", w.Code, w.Body)
+	}
+
+	code, state = callback(t, h, authorize(t, h, fake, "type=github", user))
+	w = postJSON(t, h, "/oauth/login", utils.RequestLoginBody{Code: code, State: state, PlatformType: "github"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	linked, err := store.GetByIdentity(ctx, "github", "583231")
+	if err != nil || !strings.EqualFold(linked.Addr, e2eAlice) || linked.DisplayName != "The Octocat" {
+		t.Fatalf("login should refresh legacy binding, got %+v %v", linked, err)
+	}
+}
+
+// 多实例部署: 授权链接、回调和绑定由不同的实例处理, PKCE 的 code_verifier、已经使用的 state 和 SIWE 的 nonce 保存在共享的 store 中
+func TestE2EMultiInstance(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fake := fakeprovider.New()
+	t.Cleanup(fake.Close)
+	cfg := config.Default()
+	cfg.JWT.Secret = "secret"
+	cfg.OAuth.StateSecret = "state-secret"
+	cfg.Server.PassURL = "https://pass.test/bind"
+	cfg.Server.SiweDomain = "knn3.xyz"
+	fake.Configure(cfg, "http://oauth.test")
+	store := utils.NewMemoryStore()
+	newInstance := func() http.Handler {
+		logger := zap.NewNop()
+		client := httpclient.New(cfg.HTTP, logger).HTTPClient()
+		return New(cfg, store, module.DefaultProviders(cfg, client, logger), client, logger)
+	}
+	first, second := newInstance(), newInstance()
+
+	alice, _ := utils.JwtEncode(e2eAlice)
+	for _, platformType := range []string{"github", "discord", "gmail"} {
+		user := fakeprovider.User{ID: "1001", Login: "alice", Email: "alice@gmail.com"}
+		target := authorize(t, first, fake, "type="+platformType, user)
+		code, state := callback(t, second, target)
+		// 其他实例同样拒绝重放的回调
+		if w := get(first, target); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s callback replayed on another instance: %d", platformType, w.Code)
+		}
+		w := postJSON(t, second, "/oauth/bind", utils.RequestBody{JWT: alice, Code: code, State: state, PlatformType: platformType})
+		if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"success"`)) {
+			t.Fatalf("%s bind on another instance: %d %s", platformType, w.Code, w.Body)
+		}
+	}
+
+	// SIWE 的 nonce 由一个实例签发, 另一个实例校验, 只能使用一次
+	var nonce struct {
+		Nonce string `json:"nonce"`
+	}
+	json.Unmarshal(get(first, "/auth/siwe/nonce").Body.Bytes(), &nonce)
+	message := fmt.Sprintf("knn3.xyz wants you to sign in with your Ethereum account:\n%s\n\nURI: https://knn3.xyz\nVersion: 1\nChain ID: 1\nNonce: %s\nIssued At: %s",
+		siweAddress, nonce.Nonce, time.Now().UTC().Format(time.RFC3339))
+	body := utils.RequestSiweBody{Message: message, Signature: siweSign(message)}
+	if w := postJSON(t, second, "/auth/siwe/verify", body); w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(siweAddress)) {
+		t.Fatalf("siwe verify on another instance: %d %s", w.Code, w.Body)
+	}
+	if w := postJSON(t, first, "/auth/siwe/verify", body); w.Code != http.StatusUnauthorized {
+		t.Fatalf("siwe nonce replayed: %d %s", w.Code, w.Body)
+	}
+}
+
+// 私钥 0x4646...46 对应的地址
+const siweAddress = "0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F"
+
+// siweSign 以 siweAddress 的私钥对消息做 personal_sign
+func siweSign(message string) string {
+	key, _ := hex.DecodeString("4646464646464646464646464646464646464646464646464646464646464646")
+	h := sha3.NewLegacyKeccak256()
+	fmt.Fprintf(h, "\x19Ethereum Signed Message:\n%d%s", len(message), message)
+	compact := ecdsa.SignCompact(secp256k1.PrivKeyFromBytes(key), h.Sum(nil), false)
+	// [27+recid][r][s] 转成以太坊的 [r][s][v]
+	return "0x" + hex.EncodeToString(append(compact[1:], compact[0]))
+}
+
+func TestE2EStackexchangeEmptyItems(t *testing.T) {
+	h, fake := newE2E(t)
+	alice, _ := utils.JwtEncode(e2eAlice)
+	code, state := callback(t, h, authorize(t, h, fake, "type=stackexchange", fakeprovider.User{Login: "nobody"}))
+	w := postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: alice, Code: code, State: state, PlatformType: "stackexchange"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("bind without stackexchange account: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestE2ECallbackErrors(t *testing.T) {
+	h, fake := newE2E(t)
+	for _, query := range []string{"type=github", "type=discord", "type=gmail", "type=stackexchange"} {
+		target := authorize(t, h, fake, query, fakeprovider.User{ID: "1", Login: "alice", Email: "alice@gmail.com"})
+		u, _ := url.Parse(target)
+
+		// 没有 code
+		missing := *u
+		q := missing.Query()
+		q.Del("code")
+		missing.RawQuery = q.Encode()
+		if w := get(h, missing.RequestURI()); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s callback without code: %d", query, w.Code)
+		}
+
+		// 篡改 state
+		tampered := *u
+		q = tampered.Query()
+		q.Set("state", q.Get("state")+"x")
+		tampered.RawQuery = q.Encode()
+		if w := get(h, tampered.RequestURI()); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s callback with tampered state: %d", query, w.Code)
+		}
+
+		// state 只能回调一次
+		callback(t, h, target)
+		if w := get(h, target); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s replayed callback: %d", query, w.Code)
+		}
+	}
+}
+
+func TestE2ELogin(t *testing.T) {
+	h, fake := newE2E(t)
+	alice, _ := utils.JwtEncode(e2eAlice)
+
+	cases := []struct {
+		platformType string
+		user         fakeprovider.User
+	}{
+		{"github", fakeprovider.User{ID: "583231", Login: "octocat"}},
+		{"discord", fakeprovider.User{ID: "80351110224678912", Login: "nelly"}},
+		{"gmail", fakeprovider.User{ID: "109876543210987654321", Email: "alice@gmail.com"}},
+		{"stackexchange", fakeprovider.User{ID: "1234567", Login: "alice"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.platformType, func(t *testing.T) {
+			// 没有绑定的账号不能登录
+			code, state := callback(t, h, authorize(t, h, fake, "type="+tc.platformType, tc.user))
+			w := postJSON(t, h, "/v2/oauth/login", utils.RequestLoginBody{Code: code, State: state, PlatformType: tc.platformType})
+			if w.Code != http.StatusNotFound || !bytes.Contains(w.Body.Bytes(), []byte(CodeIdentityNotBound)) {
+				t.Fatalf("login before bind: %d %s", w.Code, w.Body)
+			}
+
+			code, state = callback(t, h, authorize(t, h, fake, "type="+tc.platformType, tc.user))
+			w = postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: alice, Code: code, State: state, PlatformType: tc.platformType})
+			if w.Code != http.StatusOK {
+				t.Fatalf("bind: %d %s", w.Code, w.Body)
+			}
+
+			code, state = callback(t, h, authorize(t, h, fake, "type="+tc.platformType, tc.user))
+			w = postJSON(t, h, "/v2/oauth/login", utils.RequestLoginBody{Code: code, State: state, PlatformType: tc.platformType})
+			var resp struct {
+				Data module.Session `json:"data"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if w.Code != http.StatusOK || resp.Data.Address != e2eAlice || resp.Data.Identity == nil || resp.Data.Identity.ID != tc.user.ID {
+				t.Fatalf("login: %d %s", w.Code, w.Body)
+			}
+			if address, err := utils.JwtDecode(resp.Data.AccessToken); err != nil || address != e2eAlice {
+				t.Fatalf("session jwt: %q %v", address, err)
+			}
+
+			w = postJSON(t, h, "/oauth/login", utils.RequestLoginBody{Code: "bogus", State: state, PlatformType: tc.platformType})
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("login with bogus code: %d %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestE2ETransformerLogin(t *testing.T) {
+	h, fake := newE2E(t)
+	user := fakeprovider.User{ID: "583231", Login: "octocat"}
+
+	// v1 默认交给 transformer, transformer 自己识别用户, 账号不需要绑定
+	code, state := callback(t, h, authorize(t, h, fake, "type=github", user))
+	w := postJSON(t, h, "/oauth/login", utils.RequestLoginBody{Code: code, State: state, PlatformType: "github"})
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"github":"octocat"`)) || !bytes.Contains(w.Body.Bytes(), []byte(`"jwt":"transformer-github-octocat"`)) {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	// v2 默认由本服务签发会话, 没有绑定的账号不能登录
+	code, state = callback(t, h, authorize(t, h, fake, "type=github", user))
+	w = postJSON(t, h, "/v2/oauth/login", utils.RequestLoginBody{Code: code, State: state, PlatformType: "github"})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("v2 login without binding: %d %s", w.Code, w.Body)
+	}
+
+	// stackexchange 的 handle 是 display_name, transformer 不能用来识别用户
+	h, fake = newE2EWithStore(t, utils.NewMemoryStore(), func(cfg *config.Config) {
+		cfg.Login.Backend = "transformer"
+	})
+	code, state = callback(t, h, authorize(t, h, fake, "type=stackexchange", fakeprovider.User{ID: "1001", Login: "Alice"}))
+	w = postJSON(t, h, "/v2/oauth/login", utils.RequestLoginBody{Code: code, State: state, PlatformType: "stackexchange"})
+	if w.Code != http.StatusBadRequest || !bytes.Contains(w.Body.Bytes(), []byte(CodeUnsupportedPlatform)) {
+		t.Fatalf("stackexchange login: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestE2EKnexusGmail(t *testing.T) {
+	h, fake := newE2E(t)
+	query := "type=gmail&client=knexus&success=" + url.QueryEscape("https://knexus.xyz/ok") + "&fail=" + url.QueryEscape("https://knexus.xyz/fail")
+	w := get(h, authorize(t, h, fake, query, fakeprovider.User{Email: "alice@gmail.com"}))
+	if w.Code != http.StatusMovedPermanently {
+		t.Fatalf("knexus callback: %d %s", w.Code, w.Body)
+	}
+	u, _ := url.Parse(w.Header().Get("Location"))
+	token, _ := base64.StdEncoding.DecodeString(u.Query().Get("j"))
+	if !strings.HasPrefix(u.String(), "https://knexus.xyz/ok?") || string(token) != "knexus-normal-alice@gmail.com" {
+		t.Fatalf("knexus callback redirected to %s", u)
+	}
+
+	w = get(h, "/oauth/authcodeurl?type=gmail&client=knexus&success="+url.QueryEscape("https://evil.example/ok"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("authcodeurl with disallowed redirect: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// introspect RFC 7662, 下游服务用应用的 client_id 和 client_secret 校验 token, 不需要持有签名密钥
+func (s *Server) introspect(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	client, basic, err := s.authenticateClient(c)
+	if err != nil {
+		s.oauthError(c, err, basic)
+		return
+	}
+	resp, err := s.auth.Introspect(c.Request.Context(), client, c.PostForm("token"), c.PostForm("token_type_hint"))
+	if err != nil {
+		s.oauthError(c, err, basic)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// revoke RFC 7009, 应用撤销签发给自己的 access token 或刷新令牌, 无效的 token 同样返回 200
+func (s *Server) revoke(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	client, basic, err := s.authenticateClient(c)
+	if err != nil {
+		s.oauthError(c, err, basic)
+		return
+	}
+	if err := s.auth.Revoke(c.Request.Context(), client, c.PostForm("token"), c.PostForm("token_type_hint")); err != nil {
+		s.oauthError(c, err, basic)
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/KNN3-Network/oauth-server/module"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func (s *Server) bind(c *gin.Context) {
+	var requestBody utils.RequestBody
+	// 将请求体中的 JSON 数据绑定到结构体
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		// 处理绑定错误
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	jwt := requestBody.JWT
+	code := requestBody.Code
+	platformType := requestBody.PlatformType
+	if jwt == "" || code == "" || platformType == "" {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, nil)
+		return
+	}
+	provider, found := s.providers.Get(platformType)
+	if !found {
+		fail(c, http.StatusBadRequest, CodeUnsupportedPlatform, nil)
+		return
+	}
+	address, err := utils.JwtDecode(jwt)
+	s.logger.Info("JwtDecode address", zap.Any("address", address))
+
+	if err != nil {
+		s.jwtError(c, err)
+		return
+	}
+	identity, err := s.flow.Authorize(c.Request.Context(), provider, code, requestBody.State)
+	if err != nil {
+		s.authorizeError(c, platformType, err)
+		return
+	}
+	err = module.BindIdentity(c, s.store, address, provider, identity)
+	if errors.Is(err, module.ErrHasBound) {
+		s.logger.Error(platformType+" has bound:", zap.String("subject", identity.ID))
+		// v1 以 200 {"data":"false"} 表示已被绑定
+		if !isV2(c) {
+			c.JSON(http.StatusOK, gin.H{"data": "false"})
+			return
+		}
+		fail(c, http.StatusConflict, CodeIdentityAlreadyBound, nil)
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to save linked_identity:", zap.Error(err))
+		fail(c, http.StatusBadRequest, CodeInternalError, nil)
+		return
+	}
+	ok(c, gin.H{"data": "success"}, gin.H{"addr": address, "type": platformType, "id": identity.ID, "handle": identity.Handle})
+}
+
+func (s *Server) unbind(c *gin.Context) {
+	var requestBody utils.RequestBody
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	platformType := requestBody.PlatformType
+	if requestBody.JWT == "" || platformType == "" {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, nil)
+		return
+	}
+	provider, found := s.providers.Get(platformType)
+	if !found {
+		fail(c, http.StatusBadRequest, CodeUnsupportedPlatform, nil)
+		return
+	}
+	address, err := utils.JwtDecode(requestBody.JWT)
+	if err != nil {
+		s.jwtError(c, err)
+		return
+	}
+	err = module.UnbindIdentity(c, s.store, address, provider)
+	if err != nil && !errors.Is(err, module.ErrNotBound) {
+		s.logger.Error("failed to unbind "+platformType+":", zap.Error(err))
+		fail(c, http.StatusBadRequest, CodeInternalError, nil)
+		return
+	}
+	s.logger.Info("unbind", zap.String("address", address), zap.String("type", platformType), zap.Bool("unbound", err == nil))
+	data := gin.H{"addr": address, "type": platformType, "unbound": err == nil}
+	ok(c, gin.H{"data": data}, data)
+}
+
+// login 用任一平台账号登录, 返回 jwt、账号绑定的地址和平台账号信息
+func (s *Server) login(c *gin.Context) {
+	var requestBody utils.RequestLoginBody
+	// 将请求体中的 JSON 数据绑定到结构体
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		// 处理绑定错误
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	code := requestBody.Code
+	platformType := requestBody.PlatformType
+	if code == "" || platformType == "" {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, nil)
+		return
+	}
+	provider, found := s.providers.Get(platformType)
+	if !found {
+		fail(c, http.StatusBadRequest, CodeUnsupportedPlatform, nil)
+		return
+	}
+	identity, err := s.flow.Authorize(c.Request.Context(), provider, code, requestBody.State)
+	if err != nil {
+		s.authorizeError(c, platformType, err)
+		return
+	}
+	backend := s.loginBackend
+	if !isV2(c) {
+		backend = s.v1LoginBackend
+	}
+	session, err := module.Login(c.Request.Context(), s.store, backend, provider, identity)
+	if errors.Is(err, module.ErrNotBound) {
+		s.logger.Info(platformType+" login without binding", zap.String("subject", identity.ID))
+		fail(c, http.StatusNotFound, CodeIdentityNotBound, nil)
+		return
+	}
+	if errors.Is(err, module.ErrLoginUnsupported) {
+		s.logger.Info(platformType+" login not supported by backend", zap.String("subject", identity.ID))
+		fail(c, http.StatusBadRequest, CodeUnsupportedPlatform, nil)
+		return
+	}
+	if err != nil {
+		s.logger.Error(platformType+" login failed:", zap.Error(err))
+		if providerUnavailable(err) {
+			fail(c, http.StatusBadGateway, CodeProviderUnavailable, nil)
+			return
+		}
+		fail(c, http.StatusBadRequest, CodeLoginFailed, nil)
+		return
+	}
+	s.logger.Info(platformType+" login", zap.String("address", session.Address), zap.String("subject", identity.ID))
+	// v1 保留原有的 {"<type>": handle, "jwt": ...}
+	ok(c, gin.H{platformType: identity.Handle, "jwt": session.AccessToken, "refresh_token": session.RefreshToken, "expires_in": session.ExpiresIn, "address": session.Address, "identity": session.Identity}, session)
+}
+
+// authCodeURL 返回带签名 state 的授权链接, client/success/fail 会写进 state 在回调时使用
+func (s *Server) authCodeURL(c *gin.Context, platformType string) {
+	provider, found := s.providers.Get(platformType)
+	if !found {
+		fail(c, http.StatusBadRequest, CodeUnsupportedPlatform, nil)
+		return
+	}
+	url, err := s.flow.AuthCodeURL(c.Request.Context(), provider, c.Query("client"), c.Query("success"), c.Query("fail"))
+	if errors.Is(err, module.ErrRedirectNotAllowed) {
+		fail(c, http.StatusBadRequest, CodeRedirectNotAllowed, nil)
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to issue oauth state:", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+	s.logger.Info(platformType+" oauth AuthCodeURL", zap.String("url", url))
+
+	ok(c, gin.H{"url": url}, gin.H{"url": url})
+}
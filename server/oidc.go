@@ -0,0 +1,191 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/KNN3-Network/oauth-server/module"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func (s *Server) openidConfiguration(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, s.auth.Discovery())
+}
+
+// authorize 第三方应用的授权入口. client_id 或 redirect_uri 无效时直接返回 400, 其他错误跳转回应用,
+// 校验通过后跳转到登录页面
+func (s *Server) authorize(c *gin.Context) {
+	req, err := s.auth.Authorize(c.Request.Context(), c.Request.URL.Query())
+	var oauthErr *module.OAuthError
+	switch {
+	case err == nil:
+	case !errors.As(err, &oauthErr):
+		s.logger.Error("failed to authorize:", zap.Error(err))
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	case req == nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, oauthErr)
+		return
+	default:
+		c.Redirect(http.StatusFound, module.ErrorRedirect(req, oauthErr))
+		return
+	}
+	redirect, err := s.auth.LoginRedirect(req)
+	if err != nil {
+		s.logger.Error("failed to sign authorize request:", zap.Error(err))
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// authorizeRequest 登录页面展示的应用名称和申请的 scope
+func (s *Server) authorizeRequest(c *gin.Context) {
+	req, client, err := s.auth.Describe(c.Request.Context(), c.Query("request"))
+	if err != nil {
+		s.authorizeRequestError(c, err)
+		return
+	}
+	data := gin.H{
+		"client_id":    client.ClientID,
+		"client_name":  client.Name,
+		"redirect_uri": req.RedirectURI,
+		"scopes":       req.Scopes(),
+	}
+	ok(c, gin.H{"data": data}, data)
+}
+
+// authorizeApprove 用户在登录页面同意或拒绝授权, 返回跳转回应用的地址
+func (s *Server) authorizeApprove(c *gin.Context) {
+	var requestBody utils.RequestAuthorizeBody
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	if requestBody.Request == "" || (!requestBody.Deny && requestBody.JWT == "") {
+		fail(c, http.StatusBadRequest, CodeInvalidRequest, nil)
+		return
+	}
+	var redirect string
+	var err error
+	if requestBody.Deny {
+		redirect, err = s.auth.Deny(requestBody.Request)
+	} else {
+		address, jwtErr := utils.JwtDecode(requestBody.JWT)
+		if jwtErr != nil {
+			s.jwtError(c, jwtErr)
+			return
+		}
+		redirect, err = s.auth.Approve(c.Request.Context(), requestBody.Request, address, requestBody.Scopes)
+	}
+	if err != nil {
+		s.authorizeRequestError(c, err)
+		return
+	}
+	data := gin.H{"redirect": redirect}
+	ok(c, gin.H{"data": data}, data)
+}
+
+func (s *Server) authorizeRequestError(c *gin.Context, err error) {
+	if errors.Is(err, module.ErrAuthorizeRequestInvalid) || errors.Is(err, module.ErrAuthorizeRequestExpired) ||
+		errors.Is(err, utils.ErrClientNotFound) {
+		fail(c, http.StatusBadRequest, CodeInvalidAuthorize, nil)
+		return
+	}
+	s.logger.Error("failed to handle authorize request:", zap.Error(err))
+	fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+}
+
+// token 第三方应用换取 token, 支持 client_secret_basic 和 client_secret_post, 公开客户端只带 client_id
+func (s *Server) token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, basic, err := s.authenticateClient(c)
+	if err != nil {
+		s.oauthError(c, err, basic)
+		return
+	}
+
+	var resp *module.TokenResponse
+	switch c.PostForm("grant_type") {
+	case "authorization_code":
+		resp, err = s.auth.Exchange(c.Request.Context(), client, c.PostForm("code"), c.PostForm("redirect_uri"), c.PostForm("code_verifier"))
+	case "refresh_token":
+		resp, err = s.auth.Refresh(c.Request.Context(), client, c.PostForm("refresh_token"))
+	default:
+		err = &module.OAuthError{Code: module.OAuthUnsupportedGrantType}
+	}
+	if err != nil {
+		s.oauthError(c, err, basic)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// authenticateClient 按 client_secret_basic 或 client_secret_post 认证应用, basic 表示使用了 basic 认证
+func (s *Server) authenticateClient(c *gin.Context) (*utils.OAuthClient, bool, error) {
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// RFC 6749 2.3.1: basic 认证中的 client_id 和 client_secret 先做 form 编码
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+	client, err := s.auth.AuthenticateClient(c.Request.Context(), clientID, secret)
+	return client, basic, err
+}
+
+// userinfo 第三方应用用 access token 读取地址和授权过的平台账号
+func (s *Server) userinfo(c *gin.Context) {
+	token := bearerToken(c)
+	if token == "" {
+		token = c.PostForm("access_token")
+	}
+	claims, err := utils.JwtParseClient(token)
+	if err != nil {
+		if errors.Is(err, utils.ErrJwtRevocationCheck) {
+			s.oauthError(c, err, false)
+			return
+		}
+		s.oauthError(c, &module.OAuthError{Code: module.OAuthInvalidToken, Description: err.Error()}, false)
+		return
+	}
+	info, err := s.auth.UserInfo(c.Request.Context(), claims)
+	if err != nil {
+		s.oauthError(c, err, false)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// oauthError 按 RFC 6749/6750 返回错误, 非 OAuthError 的内部错误返回 500 server_error
+func (s *Server) oauthError(c *gin.Context, err error, basic bool) {
+	var oauthErr *module.OAuthError
+	if !errors.As(err, &oauthErr) {
+		s.logger.Error("oauth server error:", zap.Error(err))
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	status := http.StatusBadRequest
+	switch oauthErr.Code {
+	case module.OAuthInvalidClient:
+		status = http.StatusUnauthorized
+		if basic {
+			c.Header("WWW-Authenticate", `Basic realm="token"`)
+		}
+	case module.OAuthInvalidToken:
+		status = http.StatusUnauthorized
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+	case module.OAuthInsufficientScope:
+		status = http.StatusForbidden
+		c.Header("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+	}
+	c.AbortWithStatusJSON(status, oauthErr)
+}
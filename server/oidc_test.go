@@ -0,0 +1,510 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/fakeprovider"
+	"github.com/KNN3-Network/oauth-server/module"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newOIDC 开启授权服务器, 使用临时生成的 ES256 签名私钥
+func newOIDC(t *testing.T, store utils.Store, configure ...func(*config.Config)) (http.Handler, *fakeprovider.Server) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { utils.ConfigureJwt(config.JWTConfig{}) })
+	return newE2EWithStore(t, store, func(cfg *config.Config) {
+		cfg.JWT.SigningKey = file
+		cfg.OIDC.Issuer = "https://oauth.test"
+		cfg.OIDC.LoginURL = "https://knn3.test/authorize"
+		for _, f := range configure {
+			f(cfg)
+		}
+	})
+}
+
+func postForm(h http.Handler, path string, form url.Values, user, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func bearerGet(h http.Handler, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// approve 走完 /authorize 和登录页面的授权, 返回跳回应用的地址
+func approve(t *testing.T, h http.Handler, query url.Values, jwt string) *url.URL {
+	t.Helper()
+	w := get(h, "/authorize?"+query.Encode())
+	login, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || login.Host != "knn3.test" {
+		t.Fatalf("authorize: %d %s %s", w.Code, login, w.Body)
+	}
+	w = postJSON(t, h, "/oauth/authorize/approve", utils.RequestAuthorizeBody{Request: login.Query().Get("request"), JWT: jwt})
+	var resp struct {
+		Data struct {
+			Redirect string `json:"redirect"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", w.Code, w.Body)
+	}
+	redirect, _ := url.Parse(resp.Data.Redirect)
+	return redirect
+}
+
+func TestE2EOIDC(t *testing.T) {
+	store := utils.NewMemoryStore()
+	h, fake := newOIDC(t, store)
+	client, secret, err := module.RegisterClient(context.Background(), store, "Demo", []string{"https://demo.test/cb"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := utils.JwtEncode(e2eAlice)
+
+	// alice 绑定 github 和 discord, 应用只申请 github
+	for platformType, user := range map[string]fakeprovider.User{
+		"github":  {ID: "583231", Login: "octocat"},
+		"discord": {ID: "80351110224678912", Login: "nelly"},
+	} {
+		code, state := callback(t, h, authorize(t, h, fake, "type="+platformType, user))
+		if w := postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: alice, Code: code, State: state, PlatformType: platformType}); w.Code != http.StatusOK {
+			t.Fatalf("bind %s: %d %s", platformType, w.Code, w.Body)
+		}
+	}
+
+	w := get(h, "/.well-known/openid-configuration")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"jwks_uri":"https://oauth.test/.well-known/jwks.json"`) ||
+		!strings.Contains(w.Body.String(), `"ES256"`) {
+		t.Fatalf("discovery: %d %s", w.Code, w.Body)
+	}
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {client.ClientID},
+		"redirect_uri":  {"https://demo.test/cb"},
+		"scope":         {"openid identity:github offline_access"},
+		"state":         {"xyz"},
+		"nonce":         {"n-1"},
+	}
+
+	// 未注册的 redirect_uri 不跳转
+	bad := url.Values{}
+	for k, v := range query {
+		bad[k] = v
+	}
+	bad.Set("redirect_uri", "https://evil.test/cb")
+	if w := get(h, "/authorize?"+bad.Encode()); w.Code != http.StatusBadRequest || w.Header().Get("Location") != "" {
+		t.Fatalf("unregistered redirect_uri: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	// 其他错误跳转回应用
+	bad.Set("redirect_uri", "https://demo.test/cb")
+	bad.Set("scope", "identity:github")
+	if w := get(h, "/authorize?"+bad.Encode()); w.Code != http.StatusFound ||
+		!strings.HasPrefix(w.Header().Get("Location"), "https://demo.test/cb?error=invalid_scope") {
+		t.Fatalf("missing openid: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	verifier := "verifier-0123456789-0123456789-0123456789"
+	sum := sha256.Sum256([]byte(verifier))
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:]))
+	query.Set("code_challenge_method", "S256")
+
+	w = get(h, "/authorize?"+query.Encode())
+	login, _ := url.Parse(w.Header().Get("Location"))
+	w = get(h, "/v2/oauth/authorize/request?request="+url.QueryEscape(login.Query().Get("request")))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"client_name":"Demo"`) {
+		t.Fatalf("authorize request: %d %s", w.Code, w.Body)
+	}
+
+	redirect := approve(t, h, query, alice)
+	code := redirect.Query().Get("code")
+	if redirect.Host != "demo.test" || code == "" || redirect.Query().Get("state") != "xyz" {
+		t.Fatalf("approve redirect: %s", redirect)
+	}
+
+	exchange := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://demo.test/cb"}, "code_verifier": {verifier}}
+	if w := postForm(h, "/token", exchange, client.ClientID, "wrong"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "invalid_client") {
+		t.Fatalf("wrong secret: %d %s", w.Code, w.Body)
+	}
+	w = postForm(h, "/token", exchange, client.ClientID, secret)
+	var tokens module.TokenResponse
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" || tokens.RefreshToken == "" || tokens.IDToken == "" {
+		t.Fatalf("token: %d %s", w.Code, w.Body)
+	}
+
+	// id_token 可以用 JWKS 校验, 只包含授权过的 github
+	var jwks utils.JWKS
+	json.Unmarshal(get(h, "/.well-known/jwks.json").Body.Bytes(), &jwks)
+	claims := &module.IDTokenClaims{}
+	_, err = jwt.ParseWithClaims(tokens.IDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwks.Keys[0].PublicKey()
+	}, jwt.WithIssuer("https://oauth.test"), jwt.WithAudience(client.ClientID))
+	if err != nil {
+		t.Fatalf("id_token: %v", err)
+	}
+	if claims.Subject != e2eAlice || claims.WalletAddress != e2eAlice || claims.Nonce != "n-1" ||
+		len(claims.LinkedAccounts) != 1 || claims.LinkedAccounts[0].Type != "github" {
+		t.Fatalf("id_token claims: %+v", claims)
+	}
+
+	w = bearerGet(h, "/userinfo", tokens.AccessToken)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"wallet_address":"`+e2eAlice+`"`) ||
+		!strings.Contains(w.Body.String(), "octocat") || strings.Contains(w.Body.String(), "nelly") {
+		t.Fatalf("userinfo: %d %s", w.Code, w.Body)
+	}
+	// 本服务自己的 jwt 不能读 userinfo, 应用的 access token 也不能调用本服务的接口
+	if w := bearerGet(h, "/userinfo", alice); w.Code != http.StatusUnauthorized {
+		t.Fatalf("userinfo with first-party jwt: %d %s", w.Code, w.Body)
+	}
+	if w := postJSON(t, h, "/v2/oauth/unbind", utils.RequestBody{JWT: tokens.AccessToken, PlatformType: "github"}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unbind with client token: %d %s", w.Code, w.Body)
+	}
+
+	w = postForm(h, "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}}, client.ClientID, secret)
+	var refreshed module.TokenResponse
+	json.Unmarshal(w.Body.Bytes(), &refreshed)
+	if w.Code != http.StatusOK || refreshed.RefreshToken == "" || refreshed.Scope != tokens.Scope {
+		t.Fatalf("refresh: %d %s", w.Code, w.Body)
+	}
+
+	// 授权码重复使用时撤销用它换取的会话
+	if w := postForm(h, "/token", exchange, client.ClientID, secret); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Fatalf("code reuse: %d %s", w.Code, w.Body)
+	}
+	if w := bearerGet(h, "/userinfo", refreshed.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("userinfo after code reuse: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestE2EOIDCPublicClient(t *testing.T) {
+	store := utils.NewMemoryStore()
+	h, _ := newOIDC(t, store)
+	client, secret, err := module.RegisterClient(context.Background(), store, "SPA", []string{"https://spa.test/cb"}, true)
+	if err != nil || secret != "" {
+		t.Fatalf("register public client: %q %v", secret, err)
+	}
+	alice, _ := utils.JwtEncode(e2eAlice)
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {client.ClientID},
+		"redirect_uri":  {"https://spa.test/cb"},
+		"scope":         {"openid"},
+	}
+
+	// 公开客户端必须使用 PKCE
+	if w := get(h, "/authorize?"+query.Encode()); !strings.Contains(w.Header().Get("Location"), "error=invalid_request") {
+		t.Fatalf("public client without pkce: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	verifier := "public-verifier-0123456789-0123456789"
+	sum := sha256.Sum256([]byte(verifier))
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:]))
+	query.Set("code_challenge_method", "S256")
+	code := approve(t, h, query, alice).Query().Get("code")
+
+	exchange := url.Values{"grant_type": {"authorization_code"}, "client_id": {client.ClientID}, "code": {code}, "redirect_uri": {"https://spa.test/cb"}}
+	if w := postForm(h, "/token", exchange, "", ""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Fatalf("missing code_verifier: %d %s", w.Code, w.Body)
+	}
+
+	// 没有 offline_access 不签发刷新令牌
+	code = approve(t, h, query, alice).Query().Get("code")
+	exchange.Set("code", code)
+	exchange.Set("code_verifier", verifier)
+	w := postForm(h, "/token", exchange, "", "")
+	var tokens module.TokenResponse
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	if w.Code != http.StatusOK || tokens.AccessToken == "" || tokens.RefreshToken != "" {
+		t.Fatalf("public token: %d %s", w.Code, w.Body)
+	}
+}
+
+// bindAccounts 为 address 绑定平台账号
+func bindAccounts(t *testing.T, h http.Handler, fake *fakeprovider.Server, jwt string, users map[string]fakeprovider.User) {
+	t.Helper()
+	for platformType, user := range users {
+		code, state := callback(t, h, authorize(t, h, fake, "type="+platformType, user))
+		if w := postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: jwt, Code: code, State: state, PlatformType: platformType}); w.Code != http.StatusOK {
+			t.Fatalf("bind %s: %d %s", platformType, w.Code, w.Body)
+		}
+	}
+}
+
+var consentTicketRegexp = regexp.MustCompile(`name="consent" value="([^"]+)"`)
+
+// decide 带上授权页面设置的 cookie 提交授权结果
+func decide(h http.Handler, page *httptest.ResponseRecorder, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/authorize/decision", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range page.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestE2EConsent(t *testing.T) {
+	store := utils.NewMemoryStore()
+	h, fake := newOIDC(t, store)
+	client, secret, err := module.RegisterClient(context.Background(), store, "Demo", []string{"https://demo.test/cb"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := utils.JwtEncode(e2eAlice)
+	bindAccounts(t, h, fake, alice, map[string]fakeprovider.User{
+		"github": {ID: "583231", Login: "octocat"},
+		"gmail":  {ID: "109876543210987654321", Email: "alice@gmail.com"},
+	})
+
+	loginRequest := func(scope string) string {
+		query := url.Values{"response_type": {"code"}, "client_id": {client.ClientID}, "redirect_uri": {"https://demo.test/cb"}, "scope": {scope}, "state": {"s"}}
+		w := get(h, "/authorize?"+query.Encode())
+		login, _ := url.Parse(w.Header().Get("Location"))
+		if w.Code != http.StatusFound || login.Host != "knn3.test" {
+			t.Fatalf("authorize %s: %d %s", scope, w.Code, login)
+		}
+		return login.Query().Get("request")
+	}
+
+	// 授权页面列出申请的 scope 和绑定的账号
+	w := postForm(h, "/authorize/consent", url.Values{"request": {loginRequest("openid identity:github identity:email")}, "jwt": {alice}}, "", "")
+	if w.Code != http.StatusOK || w.Header().Get("X-Frame-Options") != "DENY" ||
+		!strings.Contains(w.Body.String(), "Demo") || !strings.Contains(w.Body.String(), "octocat") || !strings.Contains(w.Body.String(), "alice@gmail.com") {
+		t.Fatalf("consent page: %d %s", w.Code, w.Body)
+	}
+	ticket := consentTicketRegexp.FindStringSubmatch(w.Body.String())[1]
+	page := w
+
+	// 凭证必须和打开页面时设置的 cookie 一起提交
+	if w := postForm(h, "/authorize/decision", url.Values{"consent": {ticket}, "action": {"approve"}}, "", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("decision without cookie: %d %s", w.Code, w.Body)
+	}
+	// 只同意 github
+	w = decide(h, page, url.Values{"consent": {ticket}, "action": {"approve"}, "scope": {"identity:github"}})
+	redirect, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusSeeOther || redirect.Host != "demo.test" || redirect.Query().Get("code") == "" {
+		t.Fatalf("decision: %d %s", w.Code, redirect)
+	}
+	// 凭证只能提交一次
+	if w := decide(h, page, url.Values{"consent": {ticket}, "action": {"approve"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("replayed decision: %d %s", w.Code, w.Body)
+	}
+	exchange := url.Values{"grant_type": {"authorization_code"}, "code": {redirect.Query().Get("code")}, "redirect_uri": {"https://demo.test/cb"}}
+	var tokens module.TokenResponse
+	json.Unmarshal(postForm(h, "/token", exchange, client.ClientID, secret).Body.Bytes(), &tokens)
+	if tokens.Scope != "openid identity:github" {
+		t.Fatalf("token scope: %+v", tokens)
+	}
+	w = bearerGet(h, "/userinfo", tokens.AccessToken)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "octocat") || strings.Contains(w.Body.String(), "gmail") {
+		t.Fatalf("userinfo: %d %s", w.Code, w.Body)
+	}
+
+	// 应用读取绑定数据时只能看到授权过的平台, 匿名查询保持公开
+	if w := bearerGet(h, "/oauth/bindings/"+e2eAlice, tokens.AccessToken); !strings.Contains(w.Body.String(), "octocat") || strings.Contains(w.Body.String(), "gmail") {
+		t.Fatalf("bindings with client token: %d %s", w.Code, w.Body)
+	}
+	if w := get(h, "/oauth/bindings/"+e2eAlice); !strings.Contains(w.Body.String(), "gmail") {
+		t.Fatalf("anonymous bindings: %d %s", w.Code, w.Body)
+	}
+	if w := bearerGet(h, "/oauth/lookup?type=gmail&id=109876543210987654321", tokens.AccessToken); w.Code != http.StatusNotFound {
+		t.Fatalf("lookup ungranted platform: %d %s", w.Code, w.Body)
+	}
+	if w := bearerGet(h, "/oauth/lookup?type=github&id=583231", tokens.AccessToken); w.Code != http.StatusOK {
+		t.Fatalf("lookup granted platform: %d %s", w.Code, w.Body)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/bindings/batch", strings.NewReader(`{"addrs":["`+e2eAlice+`","`+e2eBob+`"]}`))
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "octocat") || strings.Contains(w.Body.String(), "gmail") {
+		t.Fatalf("batch with client token: %d %s", w.Code, w.Body)
+	}
+
+	// 已经授权过的 scope 不再展示授权页面
+	w = postForm(h, "/authorize/consent", url.Values{"request": {loginRequest("openid identity:github")}, "jwt": {alice}}, "", "")
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), "https://demo.test/cb?code=") {
+		t.Fatalf("consent with existing grant: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	// 拒绝授权
+	w = postForm(h, "/authorize/consent", url.Values{"request": {loginRequest("openid identity:email")}, "jwt": {alice}}, "", "")
+	ticket = consentTicketRegexp.FindStringSubmatch(w.Body.String())[1]
+	w = decide(h, w, url.Values{"consent": {ticket}, "action": {"deny"}})
+	if w.Code != http.StatusSeeOther || !strings.Contains(w.Header().Get("Location"), "error=access_denied") {
+		t.Fatalf("deny: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := postForm(h, "/authorize/decision", url.Values{"consent": {"forged.ticket"}, "action": {"approve"}}, "", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("forged ticket: %d", w.Code)
+	}
+
+	w = bearerGet(h, "/v2/oauth/grants", alice)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"client_name":"Demo"`) || !strings.Contains(w.Body.String(), `"scopes":["openid","identity:github"]`) {
+		t.Fatalf("grants: %d %s", w.Code, w.Body)
+	}
+
+	// 撤销授权后应用的 token 立即失效
+	if w := postJSON(t, h, "/v2/oauth/grants/revoke", utils.RequestRevokeGrantBody{JWT: alice, ClientID: client.ClientID}); w.Code != http.StatusOK {
+		t.Fatalf("revoke grant: %d %s", w.Code, w.Body)
+	}
+	if w := bearerGet(h, "/userinfo", tokens.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("userinfo after revoke: %d %s", w.Code, w.Body)
+	}
+	if w := bearerGet(h, "/oauth/bindings/"+e2eAlice, tokens.AccessToken); strings.Contains(w.Body.String(), "octocat") {
+		t.Fatalf("bindings after revoke: %d %s", w.Code, w.Body)
+	}
+	if w := postJSON(t, h, "/v2/oauth/grants/revoke", utils.RequestRevokeGrantBody{JWT: alice, ClientID: client.ClientID}); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), string(CodeGrantNotFound)) {
+		t.Fatalf("revoke missing grant: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestE2EPrivateBindings(t *testing.T) {
+	h, fake := newOIDC(t, utils.NewMemoryStore(), func(cfg *config.Config) {
+		cfg.OIDC.PrivateBindings = true
+	})
+	alice, _ := utils.JwtEncode(e2eAlice)
+	bob, _ := utils.JwtEncode(e2eBob)
+	bindAccounts(t, h, fake, alice, map[string]fakeprovider.User{"github": {ID: "583231", Login: "octocat"}})
+
+	if w := bearerGet(h, "/oauth/bindings/"+e2eAlice, alice); !strings.Contains(w.Body.String(), "octocat") {
+		t.Fatalf("owner bindings: %d %s", w.Code, w.Body)
+	}
+	for name, token := range map[string]string{"anonymous": "", "other address": bob} {
+		if w := bearerGet(h, "/oauth/bindings/"+e2eAlice, token); strings.Contains(w.Body.String(), "octocat") {
+			t.Fatalf("%s bindings: %d %s", name, w.Code, w.Body)
+		}
+		if w := bearerGet(h, "/oauth/lookup?type=github&id=583231", token); w.Code != http.StatusNotFound {
+			t.Fatalf("%s lookup: %d %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestE2EIntrospection(t *testing.T) {
+	store := utils.NewMemoryStore()
+	h, _ := newOIDC(t, store)
+	ctx := context.Background()
+	demo, demoSecret, _ := module.RegisterClient(ctx, store, "Demo", []string{"https://demo.test/cb"}, false)
+	api, apiSecret, _ := module.RegisterResourceServer(ctx, store, "API")
+	other, otherSecret, _ := module.RegisterClient(ctx, store, "Other", []string{"https://other.test/cb"}, false)
+	public, _, _ := module.RegisterClient(ctx, store, "Mobile", []string{"https://mobile.test/cb"}, true)
+	alice, _ := utils.JwtEncode(e2eAlice)
+
+	query := url.Values{"response_type": {"code"}, "client_id": {demo.ClientID}, "redirect_uri": {"https://demo.test/cb"}, "scope": {"openid offline_access"}}
+	exchange := url.Values{"grant_type": {"authorization_code"}, "code": {approve(t, h, query, alice).Query().Get("code")}, "redirect_uri": {"https://demo.test/cb"}}
+	var tokens module.TokenResponse
+	json.Unmarshal(postForm(h, "/token", exchange, demo.ClientID, demoSecret).Body.Bytes(), &tokens)
+
+	introspect := func(token, hint, user, password string) (*httptest.ResponseRecorder, module.IntrospectResponse) {
+		w := postForm(h, "/oauth/introspect", url.Values{"token": {token}, "token_type_hint": {hint}}, user, password)
+		var resp module.IntrospectResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp
+	}
+
+	if w, _ := introspect(tokens.AccessToken, "", "", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("introspect without client: %d %s", w.Code, w.Body)
+	}
+	if w, _ := introspect(tokens.AccessToken, "", public.ClientID, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("introspect by public client: %d %s", w.Code, w.Body)
+	}
+	// 下游服务可以校验签发给其他应用的 access token 和本服务自己的 jwt
+	if w, resp := introspect(tokens.AccessToken, "", api.ClientID, apiSecret); w.Code != http.StatusOK || !resp.Active ||
+		resp.ClientID != demo.ClientID || resp.Address != e2eAlice || resp.Scope != "openid offline_access" ||
+		resp.TokenType != module.TokenTypeAccessToken || resp.Exp == 0 {
+		t.Fatalf("introspect access token: %d %s", w.Code, w.Body)
+	}
+	if _, resp := introspect(alice, "", api.ClientID, apiSecret); !resp.Active || resp.ClientID != "" || resp.Address != e2eAlice {
+		t.Fatalf("introspect first-party jwt: %+v", resp)
+	}
+	// 普通应用只能校验签发给自己的 token
+	if _, resp := introspect(tokens.AccessToken, "", demo.ClientID, demoSecret); !resp.Active || resp.ClientID != demo.ClientID {
+		t.Fatalf("introspect own access token: %+v", resp)
+	}
+	for name, token := range map[string]string{"other client's token": tokens.AccessToken, "first-party jwt": alice} {
+		if w, resp := introspect(token, "", other.ClientID, otherSecret); w.Code != http.StatusOK || resp.Active || w.Body.String() != `{"active":false}` {
+			t.Fatalf("introspect %s by ordinary client: %d %s", name, w.Code, w.Body)
+		}
+	}
+	if w, resp := introspect("not-a-token", "", api.ClientID, apiSecret); w.Code != http.StatusOK || resp.Active || w.Body.String() != `{"active":false}` {
+		t.Fatalf("introspect invalid token: %d %s", w.Code, w.Body)
+	}
+	// 刷新令牌只有持有它的应用可以查看
+	if _, resp := introspect(tokens.RefreshToken, "refresh_token", api.ClientID, apiSecret); resp.Active {
+		t.Fatalf("introspect other client's refresh token: %+v", resp)
+	}
+	if _, resp := introspect(tokens.RefreshToken, "", demo.ClientID, demoSecret); !resp.Active || resp.TokenType != module.TokenTypeRefreshToken {
+		t.Fatalf("introspect refresh token: %+v", resp)
+	}
+
+	revoke := func(token, hint, user, password string) *httptest.ResponseRecorder {
+		return postForm(h, "/oauth/revoke", url.Values{"token": {token}, "token_type_hint": {hint}}, user, password)
+	}
+	if w := revoke(tokens.AccessToken, "", api.ClientID, apiSecret); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unauthorized_client") {
+		t.Fatalf("revoke other client's token: %d %s", w.Code, w.Body)
+	}
+	if w := revoke(tokens.AccessToken, "access_token", demo.ClientID, demoSecret); w.Code != http.StatusOK {
+		t.Fatalf("revoke access token: %d %s", w.Code, w.Body)
+	}
+	if _, resp := introspect(tokens.AccessToken, "", api.ClientID, apiSecret); resp.Active {
+		t.Fatalf("introspect revoked access token: %+v", resp)
+	}
+	if w := bearerGet(h, "/userinfo", tokens.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("userinfo with revoked token: %d", w.Code)
+	}
+
+	// 撤销刷新令牌后整个会话失效, 重复撤销和无效的 token 也返回 200
+	if w := revoke(tokens.RefreshToken, "", demo.ClientID, demoSecret); w.Code != http.StatusOK {
+		t.Fatalf("revoke refresh token: %d %s", w.Code, w.Body)
+	}
+	refresh := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}}
+	if w := postForm(h, "/token", refresh, demo.ClientID, demoSecret); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Fatalf("refresh after revoke: %d %s", w.Code, w.Body)
+	}
+	for _, token := range []string{tokens.RefreshToken, "not-a-token"} {
+		if w := revoke(token, "", demo.ClientID, demoSecret); w.Code != http.StatusOK {
+			t.Fatalf("revoke %s: %d %s", token, w.Code, w.Body)
+		}
+	}
+	if w := get(h, "/.well-known/openid-configuration"); !strings.Contains(w.Body.String(), `"introspection_endpoint":"https://oauth.test/oauth/introspect"`) {
+		t.Fatalf("discovery: %s", w.Body)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+)
+
+// ErrorCode v2 响应中的错误码, 发布后不再修改含义
+type ErrorCode string
+
+const (
+	CodeOK                     ErrorCode = "OK"
+	CodeInvalidRequest         ErrorCode = "INVALID_REQUEST"
+	CodeUnsupportedPlatform    ErrorCode = "UNSUPPORTED_PLATFORM"
+	CodeInvalidJWT             ErrorCode = "INVALID_JWT"
+	CodeInvalidRefreshToken    ErrorCode = "INVALID_REFRESH_TOKEN"
+	CodeRefreshTokenReused     ErrorCode = "REFRESH_TOKEN_REUSED"
+	CodeInvalidState           ErrorCode = "INVALID_STATE"
+	CodeInvalidSignature       ErrorCode = "INVALID_SIGNATURE"
+	CodeRedirectNotAllowed     ErrorCode = "REDIRECT_NOT_ALLOWED"
+	CodeIdentityAlreadyBound   ErrorCode = "IDENTITY_ALREADY_BOUND"
+	CodeIdentityNotBound       ErrorCode = "IDENTITY_NOT_BOUND"
+	CodeProviderExchangeFailed ErrorCode = "PROVIDER_EXCHANGE_FAILED"
+	CodeProviderUnavailable    ErrorCode = "PROVIDER_UNAVAILABLE"
+	CodeLoginFailed            ErrorCode = "LOGIN_FAILED"
+	CodeInvalidAuthorize       ErrorCode = "INVALID_AUTHORIZE_REQUEST"
+	CodeGrantNotFound          ErrorCode = "GRANT_NOT_FOUND"
+	CodeNotFound               ErrorCode = "NOT_FOUND"
+	CodeInternalError          ErrorCode = "INTERNAL_ERROR"
+)
+
+// messages 错误码对应的英文和中文提示
+var messages = map[ErrorCode][2]string{
+	CodeOK:                     {"success", "成功"},
+	CodeInvalidRequest:         {"invalid request parameters", "参数错误"},
+	CodeUnsupportedPlatform:    {"platform not supported", "平台不支持"},
+	CodeInvalidJWT:             {"invalid or expired jwt", "jwt 无效或已过期"},
+	CodeInvalidRefreshToken:    {"invalid or expired refresh token", "刷新令牌无效或已过期"},
+	CodeRefreshTokenReused:     {"refresh token reused, session revoked", "刷新令牌被重复使用, 会话已撤销"},
+	CodeInvalidState:           {"invalid or expired oauth state", "授权 state 无效或已过期"},
+	CodeInvalidSignature:       {"signature verification failed", "签名校验失败"},
+	CodeRedirectNotAllowed:     {"redirect target not allowed", "跳转地址不允许"},
+	CodeIdentityAlreadyBound:   {"account is already bound to another address", "账号已经绑定了其他地址"},
+	CodeIdentityNotBound:       {"account is not bound", "账号没有绑定"},
+	CodeProviderExchangeFailed: {"failed to get user info from the platform", "获取平台用户信息错误"},
+	CodeProviderUnavailable:    {"platform is temporarily unavailable", "平台服务暂时不可用"},
+	CodeLoginFailed:            {"login failed", "登录错误"},
+	CodeInvalidAuthorize:       {"invalid or expired authorize request", "授权请求无效或已过期"},
+	CodeGrantNotFound:          {"app is not authorized", "没有授权过该应用"},
+	CodeNotFound:               {"not found", "接口不存在"},
+	CodeInternalError:          {"internal server error", "服务内部错误"},
+}
+
+// languages 支持的提示语言, 第一个为默认
+var languages = language.NewMatcher([]language.Tag{language.English, language.Chinese})
+
+// Message 错误码的提示, lang 为 ?lang= 或 Accept-Language 的值, 不支持的语言使用英文
+func (code ErrorCode) Message(lang string) string {
+	return localize(lang, messages[code])
+}
+
+// localize 按 lang 选择英文或中文
+func localize(lang string, text [2]string) string {
+	if _, index := language.MatchStrings(languages, lang); index == 1 {
+		return text[1]
+	}
+	return text[0]
+}
+
+// Response v2 接口的统一响应
+type Response struct {
+	Code    ErrorCode   `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data"`
+}
+
+// apiVersionKey gin.Context 中记录接口版本的 key, 由 v2 路由组设置
+const apiVersionKey = "api_version"
+
+func useV2(c *gin.Context) {
+	c.Set(apiVersionKey, 2)
+}
+
+func isV2(c *gin.Context) bool {
+	return c.GetInt(apiVersionKey) == 2
+}
+
+// requestLang 提示语言, ?lang= 优先于 Accept-Language
+func requestLang(c *gin.Context) string {
+	if lang := c.Query("lang"); lang != "" {
+		return lang
+	}
+	return c.GetHeader("Accept-Language")
+}
+
+// ok 返回成功. v1 原样返回 legacy, v2 返回 {code: OK, message, data}
+func ok(c *gin.Context, legacy interface{}, data interface{}) {
+	if !isV2(c) {
+		c.JSON(http.StatusOK, legacy)
+		return
+	}
+	c.JSON(http.StatusOK, Response{Code: CodeOK, Message: CodeOK.Message(requestLang(c)), Data: data})
+}
+
+// fail 返回错误. v2 返回 {code, message, data: null};
+// v1 保持原有格式: 有 err 时为 {"error": err}, 否则只有状态码, 中文提示记在 gin 的错误日志中
+func fail(c *gin.Context, status int, code ErrorCode, err error) {
+	if !isV2(c) {
+		if err != nil {
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.AbortWithError(status, errors.New(code.Message("zh")))
+		return
+	}
+	if err != nil {
+		c.Error(err)
+	}
+	c.AbortWithStatusJSON(status, Response{Code: code, Message: code.Message(requestLang(c))})
+}
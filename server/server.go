@@ -0,0 +1,202 @@
+package server
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"strings"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/httpclient"
+	"github.com/KNN3-Network/oauth-server/module"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// maxBatchAddrs /oauth/bindings/batch 单次最多查询的地址数量
+const maxBatchAddrs = 50000
+
+// Server 处理 oauth 绑定、查询和登录的 http 服务
+type Server struct {
+	cfg       *config.Config
+	store     utils.Store
+	flow      *module.Flow
+	sessions  *module.Sessions
+	providers *module.Registry
+	// loginBackend v2 /oauth/login 签发会话的后端, v1LoginBackend 为 v1 的
+	loginBackend   module.LoginBackend
+	v1LoginBackend module.LoginBackend
+	// auth 作为 OAuth2/OIDC 授权服务器, 没有配置 OIDC_ISSUER 时为 nil
+	auth   *module.AuthServer
+	logger *zap.Logger
+}
+
+// New 创建服务的 http.Handler. 会使用 cfg.JWT 配置 jwt 的签发和校验, 并以 store 作为 jwt 的撤销列表.
+// client 用于请求 transformer, 应当与 providers 使用同一个, 熔断状态才能共享
+func New(cfg *config.Config, store utils.Store, providers []module.Provider, client *http.Client, logger *zap.Logger) http.Handler {
+	utils.ConfigureJwt(cfg.JWT)
+	utils.ConfigureRevocations(store)
+	sessions := module.NewSessions(cfg, store, logger)
+	s := &Server{
+		cfg:            cfg,
+		store:          store,
+		flow:           module.NewFlow(cfg, store, logger),
+		sessions:       sessions,
+		providers:      module.NewRegistry(providers...),
+		loginBackend:   module.NewLoginBackend(cfg.Login.Backend, cfg, client, sessions, logger),
+		v1LoginBackend: module.NewLoginBackend(cfg.Login.V1Backend, cfg, client, sessions, logger),
+		logger:         logger,
+	}
+	if cfg.OIDC.Issuer != "" {
+		s.auth = module.NewAuthServer(cfg, s.flow, store, sessions, s.providers, logger)
+	}
+
+	r := gin.Default()
+	r.Use(cors.Default())
+
+	// v1 保持原有的响应格式, v2 统一返回 {code, message, data}
+	s.routes(r)
+	s.routes(r.Group("/v2", useV2))
+	r.NoRoute(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, "/v2/") {
+			useV2(c)
+			fail(c, http.StatusNotFound, CodeNotFound, nil)
+		}
+	})
+
+	// 本服务签发 jwt 使用的公钥
+	r.GET("/.well-known/jwks.json", s.jwks)
+	// OAuth2/OIDC 授权服务器, 按 RFC 6749 的格式响应, 不区分 v1/v2
+	if s.auth != nil {
+		r.GET("/.well-known/openid-configuration", s.openidConfiguration)
+		r.GET("/authorize", s.authorize)
+		r.POST("/token", s.token)
+		r.GET("/userinfo", s.userinfo)
+		r.POST("/userinfo", s.userinfo)
+		// 服务端渲染的授权页面, 登录页面以表单提交 request 和 jwt
+		r.POST("/authorize/consent", s.consent)
+		r.POST("/authorize/decision", s.consentDecision)
+
+		// 下游服务校验和撤销 token (RFC 7662 / RFC 7009), 用应用的 client_id 和 client_secret 认证
+		r.POST("/oauth/introspect", s.introspect)
+		r.POST("/oauth/revoke", s.revoke)
+	}
+	// 各平台的 oauth 回调
+	for _, provider := range s.providers.List() {
+		provider := provider
+		r.GET(provider.CallbackPath(), func(c *gin.Context) { provider.Callback(c, s.flow) })
+	}
+	return r
+}
+
+// NewDebug 运行指标的 http.Handler, 只应该在 DEBUG_ADDR 这样的内网地址上监听.
+// /debug/vars 的 upstream 为请求第三方平台的延迟、失败和熔断统计
+func NewDebug() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// routes 注册 json 接口, v1 和 v2 共用同一组 handler
+func (s *Server) routes(r gin.IRouter) {
+	r.POST("/oauth/bind", s.bind)
+	r.POST("/oauth/unbind", s.unbind)
+	r.POST("/oauth/login", s.login)
+	r.GET("/oauth/bindings/:addr", s.bindings)
+	r.POST("/oauth/bindings/batch", s.batchBindings)
+	r.GET("/oauth/lookup", s.lookup)
+
+	// Sign-In with Ethereum (EIP-4361)
+	r.GET("/auth/siwe/nonce", s.siweNonce)
+	r.POST("/auth/siwe/verify", s.siweVerify)
+	// 会话的刷新和登出
+	r.POST("/auth/refresh", s.refresh)
+	r.POST("/auth/logout", s.logout)
+	// 第三方应用的登录和授权页面使用
+	if s.auth != nil {
+		r.GET("/oauth/authorize/request", s.authorizeRequest)
+		r.POST("/oauth/authorize/approve", s.authorizeApprove)
+		// 用户查看和撤销对第三方应用的授权
+		r.GET("/oauth/grants", s.grants)
+		r.POST("/oauth/grants/revoke", s.revokeGrant)
+	}
+
+	r.GET("/oauth/authcodeurl", func(c *gin.Context) {
+		s.authCodeURL(c, c.Query("type"))
+	})
+	// stackoverflow
+	r.GET("/oauth/stackoverflow/authcodeurl", func(c *gin.Context) {
+		s.authCodeURL(c, "stackexchange")
+	})
+}
+
+// jwtError jwt 校验失败统一返回 401, v1 的 error 为具体原因 (过期、签名错误、已撤销等).
+// 查询撤销列表失败时返回 500
+func (s *Server) jwtError(c *gin.Context, err error) {
+	s.logger.Error("failed to decode jwt:", zap.Error(err))
+	if errors.Is(err, utils.ErrJwtRevocationCheck) {
+		fail(c, http.StatusInternalServerError, CodeInternalError, nil)
+		return
+	}
+	fail(c, http.StatusUnauthorized, CodeInvalidJWT, err)
+}
+
+// authorizeError 换取平台用户信息失败. 平台限流、故障或被熔断时返回 502, 其他 (code 无效等) 返回 400
+func (s *Server) authorizeError(c *gin.Context, platformType string, err error) {
+	s.logger.Error("failed to get user info:", zap.Error(err), zap.String("type", platformType))
+	switch {
+	case providerUnavailable(err):
+		fail(c, http.StatusBadGateway, CodeProviderUnavailable, nil)
+	case errors.Is(err, module.ErrStateInvalid) || errors.Is(err, module.ErrStateExpired) ||
+		errors.Is(err, module.ErrStateReplayed) || errors.Is(err, module.ErrPKCEVerifierMissing):
+		fail(c, http.StatusBadRequest, CodeInvalidState, nil)
+	default:
+		fail(c, http.StatusBadRequest, CodeProviderExchangeFailed, nil)
+	}
+}
+
+// providerUnavailable 平台或 transformer 限流、故障或被熔断
+func providerUnavailable(err error) bool {
+	var providerErr *module.ProviderError
+	return errors.Is(err, httpclient.ErrCircuitOpen) || errors.As(err, &providerErr) && providerErr.Temporary()
+}
+
+// bearerToken Authorization: Bearer <jwt> 中的 jwt
+func bearerToken(c *gin.Context) string {
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
+
+// bindingFilter 按 Authorization 中的 jwt 过滤绑定查询的结果: 本服务的 jwt 为地址本人,
+// 第三方应用的 access token 只能看到授权过的账号. 没有开启授权服务器时返回 nil, 不过滤
+func (s *Server) bindingFilter(c *gin.Context, addrs []string) (*module.BindingFilter, error) {
+	if s.auth == nil {
+		return nil, nil
+	}
+	owner, clientID := "", ""
+	if token := bearerToken(c); token != "" {
+		claims, err := utils.JwtParse(token)
+		if err == nil {
+			owner = claims.Address
+		} else if errors.Is(err, utils.ErrJwtClientToken) {
+			if claims, err := utils.JwtParseClient(token); err == nil {
+				clientID = claims.ClientID
+			}
+		}
+	}
+	return s.auth.NewBindingFilter(c, owner, clientID, s.cfg.OIDC.PrivateBindings, addrs)
+}
+
+// bearerAddress 解析 Authorization: Bearer <jwt> 中的地址, 没有或无效时返回空
+func bearerAddress(c *gin.Context) string {
+	token := bearerToken(c)
+	if token == "" {
+		return ""
+	}
+	address, err := utils.JwtDecode(token)
+	if err != nil {
+		return ""
+	}
+	return address
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/KNN3-Network/oauth-server/module"
+	"github.com/KNN3-Network/oauth-server/utils"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// stubProvider code 即为平台账号 id
+type stubProvider struct{}
+
+func (stubProvider) Type() string { return "stub" }
+func (stubProvider) Exchange(ctx context.Context, code string, verifier string) (*oauth2.Token, error) {
+	return &oauth2.Token{AccessToken: code}, nil
+}
+func (stubProvider) FetchIdentity(ctx context.Context, token *oauth2.Token) (*module.Identity, error) {
+	return &module.Identity{ID: token.AccessToken, Handle: token.AccessToken}, nil
+}
+func (stubProvider) AuthCodeURL(client string, state string, challenge string) string { return "" }
+func (stubProvider) CallbackPath() string                                             { return "/oauth/stub" }
+func (stubProvider) Callback(c *gin.Context, flow *module.Flow)                       {}
+
+func postJSON(t *testing.T, h http.Handler, path string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data)))
+	return w
+}
+
+func TestBindAndQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default()
+	cfg.JWT.Secret = "secret"
+	h := New(cfg, utils.NewMemoryStore(), []module.Provider{stubProvider{}}, http.DefaultClient, zap.NewNop())
+
+	alice, _ := utils.JwtEncode("0x0000000000000000000000000000000000000001")
+	bob, _ := utils.JwtEncode("0x0000000000000000000000000000000000000002")
+
+	w := postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: alice, Code: "octocat", PlatformType: "stub"})
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"success"`)) {
+		t.Fatalf("bind: %d %s", w.Code, w.Body)
+	}
+	w = postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: bob, Code: "octocat", PlatformType: "stub"})
+	if !bytes.Contains(w.Body.Bytes(), []byte(`"false"`)) {
+		t.Fatalf("bind bound account: %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oauth/lookup?type=stub&id=octocat", nil))
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte("0x0000000000000000000000000000000000000001")) {
+		t.Fatalf("lookup: %d %s", w.Code, w.Body)
+	}
+
+	w = postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: "bad", Code: "octocat", PlatformType: "stub"})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("bind with bad jwt: %d %s", w.Code, w.Body)
+	}
+}
+
+// 绑定查询接口的地址不区分大小写, memory 和 sqlite 的结果一致
+func TestBatchBindings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	stores := map[string]func(t *testing.T) utils.Store{
+		"memory": func(t *testing.T) utils.Store { return utils.NewMemoryStore() },
+		"sqlite": func(t *testing.T) utils.Store {
+			store, _, err := utils.OpenStore(config.DBConfig{Driver: "sqlite", SqlitePath: ":memory:"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			cfg := config.Default()
+			cfg.JWT.Secret = "secret"
+			h := New(cfg, store, []module.Provider{stubProvider{}}, http.DefaultClient, zap.NewNop())
+
+			alice, _ := utils.JwtEncode("0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f")
+			if w := postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: alice, Code: "octocat", PlatformType: "stub"}); w.Code != http.StatusOK {
+				t.Fatalf("bind: %d %s", w.Code, w.Body)
+			}
+
+			// checksum 格式的地址, 以及跨过 1000 个一批的重复地址
+			addrs := []string{"0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F"}
+			for i := 0; i < 1000; i++ {
+				addrs = append(addrs, fmt.Sprintf("0x%040x", i))
+			}
+			addrs = append(addrs, "0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f")
+			data, _ := json.Marshal(utils.RequestBatchBody{Addrs: addrs})
+			req := httptest.NewRequest(http.MethodPost, "/oauth/bindings/batch", bytes.NewReader(data))
+			req.Header.Set("Accept", mimeNDJSON)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			lines := bytes.Split(bytes.TrimSpace(w.Body.Bytes()), []byte("\n"))
+			if w.Code != http.StatusOK || len(lines) != 1 || !bytes.Contains(lines[0], []byte(`"addr":"0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f"`)) {
+				t.Fatalf("batch: %d %s", w.Code, w.Body)
+			}
+
+			w = postJSON(t, h, "/v2/oauth/bindings/batch", utils.RequestBatchBody{Addrs: []string{"0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f", "alice"}})
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("batch with invalid address: %d %s", w.Code, w.Body)
+			}
+
+			// 单个地址的查询同样不区分大小写
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oauth/bindings/0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F", nil))
+			if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"addr":"0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f"`)) || !bytes.Contains(w.Body.Bytes(), []byte("octocat")) {
+				t.Fatalf("bindings with checksum address: %d %s", w.Code, w.Body)
+			}
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/oauth/bindings/alice", nil))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("bindings with invalid address: %d %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestV2Envelope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default()
+	cfg.JWT.Secret = "secret"
+	h := New(cfg, utils.NewMemoryStore(), []module.Provider{stubProvider{}}, http.DefaultClient, zap.NewNop())
+
+	alice, _ := utils.JwtEncode("0x0000000000000000000000000000000000000001")
+	bob, _ := utils.JwtEncode("0x0000000000000000000000000000000000000002")
+	decode := func(w *httptest.ResponseRecorder) Response {
+		var resp Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode %s: %v", w.Body, err)
+		}
+		return resp
+	}
+
+	w := postJSON(t, h, "/v2/oauth/bind", utils.RequestBody{JWT: alice, Code: "octocat", PlatformType: "stub"})
+	if resp := decode(w); w.Code != http.StatusOK || resp.Code != CodeOK || resp.Data.(map[string]interface{})["id"] != "octocat" {
+		t.Fatalf("bind: %d %s", w.Code, w.Body)
+	}
+	w = postJSON(t, h, "/v2/oauth/bind", utils.RequestBody{JWT: bob, Code: "octocat", PlatformType: "stub"})
+	if resp := decode(w); w.Code != http.StatusConflict || resp.Code != CodeIdentityAlreadyBound {
+		t.Fatalf("bind bound account: %d %s", w.Code, w.Body)
+	}
+	w = postJSON(t, h, "/v2/oauth/bind", utils.RequestBody{JWT: "bad", Code: "octocat", PlatformType: "stub"})
+	if resp := decode(w); w.Code != http.StatusUnauthorized || resp.Code != CodeInvalidJWT {
+		t.Fatalf("bind with bad jwt: %d %s", w.Code, w.Body)
+	}
+	// v1 仍然返回 {"error": ...}
+	w = postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: "bad", Code: "octocat", PlatformType: "stub"})
+	if !bytes.HasPrefix(w.Body.Bytes(), []byte(`{"error":`)) {
+		t.Fatalf("v1 bind with bad jwt: %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v2/oauth/lookup?type=stub&id=nobody", nil)
+	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9,en;q=0.8")
+	h.ServeHTTP(w, req)
+	if resp := decode(w); w.Code != http.StatusNotFound || resp.Code != CodeIdentityNotBound || resp.Message != "账号没有绑定" {
+		t.Fatalf("lookup: %d %s", w.Code, w.Body)
+	}
+
+	w = postJSON(t, h, "/v2/oauth/bindings/batch", utils.RequestBatchBody{Addrs: []string{"0x0000000000000000000000000000000000000001"}})
+	if resp := decode(w); w.Code != http.StatusOK || resp.Code != CodeOK || len(resp.Data.([]interface{})) != 1 {
+		t.Fatalf("batch: %d %s", w.Code, w.Body)
+	}
+
+	// Accept 带参数或者多个类型时也按 ndjson 输出, 不套 v2 的 data
+	for _, accept := range []string{"application/x-ndjson; charset=utf-8", "application/x-ndjson, application/json;q=0.5"} {
+		w = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v2/oauth/bindings/batch", bytes.NewBufferString(`{"addrs":["0x0000000000000000000000000000000000000001"]}`))
+		req.Header.Set("Accept", accept)
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != mimeNDJSON || !bytes.HasPrefix(w.Body.Bytes(), []byte(`{"addr":`)) {
+			t.Fatalf("batch ndjson with %q: %d %s", accept, w.Code, w.Body)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/nothing?lang=en", nil))
+	if resp := decode(w); w.Code != http.StatusNotFound || resp.Code != CodeNotFound || resp.Message != "not found" {
+		t.Fatalf("unknown route: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestDebugVars(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default()
+	cfg.JWT.Secret = "secret"
+	h := New(cfg, utils.NewMemoryStore(), []module.Provider{stubProvider{}}, http.DefaultClient, zap.NewNop())
+
+	// 运行指标不在对外的端口上
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("public debug vars: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	NewDebug().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"upstream"`)) {
+		t.Fatalf("debug vars: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default()
+	cfg.JWT.Secret = "secret"
+	h := New(cfg, utils.NewMemoryStore(), []module.Provider{stubProvider{}}, http.DefaultClient, zap.NewNop())
+
+	alice, _ := utils.JwtEncode("0x0000000000000000000000000000000000000001")
+	if w := postJSON(t, h, "/oauth/bind", utils.RequestBody{JWT: alice, Code: "octocat", PlatformType: "stub"}); w.Code != http.StatusOK {
+		t.Fatalf("bind: %d %s", w.Code, w.Body)
+	}
+	var login struct {
+		Data module.Session `json:"data"`
+	}
+	w := postJSON(t, h, "/v2/oauth/login", utils.RequestLoginBody{Code: "octocat", PlatformType: "stub"})
+	if json.Unmarshal(w.Body.Bytes(), &login); w.Code != http.StatusOK || login.Data.RefreshToken == "" {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+
+	var refreshed struct {
+		Data module.Tokens `json:"data"`
+	}
+	w = postJSON(t, h, "/v2/auth/refresh", utils.RequestRefreshBody{RefreshToken: login.Data.RefreshToken})
+	if json.Unmarshal(w.Body.Bytes(), &refreshed); w.Code != http.StatusOK || refreshed.Data.AccessToken == "" || refreshed.Data.RefreshToken == login.Data.RefreshToken {
+		t.Fatalf("refresh: %d %s", w.Code, w.Body)
+	}
+	w = postJSON(t, h, "/v2/auth/refresh", utils.RequestRefreshBody{RefreshToken: "bogus"})
+	if w.Code != http.StatusUnauthorized || !bytes.Contains(w.Body.Bytes(), []byte(CodeInvalidRefreshToken)) {
+		t.Fatalf("refresh with bogus token: %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v2/auth/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+refreshed.Data.AccessToken)
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("logout: %d %s", w.Code, w.Body)
+	}
+
+	// 登出后 jwt 和刷新令牌都失效
+	w = postJSON(t, h, "/v2/oauth/unbind", utils.RequestBody{JWT: refreshed.Data.AccessToken, PlatformType: "stub"})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unbind after logout: %d %s", w.Code, w.Body)
+	}
+	w = postJSON(t, h, "/v2/auth/refresh", utils.RequestRefreshBody{RefreshToken: refreshed.Data.RefreshToken})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh after logout: %d %s", w.Code, w.Body)
+	}
+}
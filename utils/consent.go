@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrGrantNotFound 地址没有授权过该应用
+var ErrGrantNotFound = errors.New("consent grant not found")
+
+// ConsentGrant 地址对第三方应用的授权, 每个 (地址, 应用) 一条, 再次授权时更新 Scope
+type ConsentGrant struct {
+	ID        uint64    `json:"-" gorm:"primaryKey"`
+	Addr      string    `json:"addr" gorm:"size:64;not null;uniqueIndex:uk_addr_client,priority:1"`
+	ClientID  string    `json:"client_id" gorm:"size:64;not null;uniqueIndex:uk_addr_client,priority:2;index"`
+	Scope     string    `json:"scope" gorm:"size:1024;not null"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (ConsentGrant) TableName() string {
+	return "consent_grant"
+}
+
+// ConsentStore 用户授权的存储
+type ConsentStore interface {
+	// SaveGrant 保存授权, (地址, 应用) 已经存在时更新 Scope 和 UpdatedAt
+	SaveGrant(ctx context.Context, grant *ConsentGrant) error
+	// GetGrant 没有授权时返回 ErrGrantNotFound
+	GetGrant(ctx context.Context, addr, clientID string) (*ConsentGrant, error)
+	// ListGrants 地址的所有授权, 按更新时间倒序
+	ListGrants(ctx context.Context, addr string) ([]ConsentGrant, error)
+	// ListClientGrants addrs 中授权过 clientID 的记录
+	ListClientGrants(ctx context.Context, clientID string, addrs []string) ([]ConsentGrant, error)
+	// DeleteGrant 撤销授权, 没有授权时返回 ErrGrantNotFound
+	DeleteGrant(ctx context.Context, addr, clientID string) error
+}
@@ -0,0 +1,314 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+// jwksCacheTTL JWKS_URL 的缓存时间, 遇到未知 kid 时最多每 jwksRefreshInterval 刷新一次
+const (
+	jwksCacheTTL        = 10 * time.Minute
+	jwksRefreshInterval = 30 * time.Second
+)
+
+var ErrJwkUnsupported = errors.New("jwk: unsupported key")
+
+// JWK RFC 7517 公钥
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// signingKey 本服务签发 jwt 使用的私钥
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	key    crypto.Signer
+}
+
+// keySet 校验 jwt 的公钥, 按 kid 索引. 同时存在多个 kid 即可平滑轮换
+var keySet = struct {
+	sync.RWMutex
+	loaded  bool
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	signing []signingKey
+}{}
+
+// PublicKey 把 JWK 转成 rsa/ecdsa/ed25519 公钥
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, ErrJwkUnsupported
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := decode(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, ErrJwkUnsupported
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, ErrJwkUnsupported
+}
+
+// NewJWK 把公钥转成 JWK, kid 为空时使用 RFC 7638 thumbprint
+func NewJWK(kid string, pub crypto.PublicKey) (JWK, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	var k JWK
+	var thumbprint string
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		k = JWK{Kty: "RSA", Alg: "RS256", N: encode(pub.N.Bytes()), E: encode(big.NewInt(int64(pub.E)).Bytes())}
+		thumbprint = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, k.E, k.N)
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return JWK{}, ErrJwkUnsupported
+		}
+		x, y := make([]byte, 32), make([]byte, 32)
+		k = JWK{Kty: "EC", Alg: "ES256", Crv: "P-256", X: encode(pub.X.FillBytes(x)), Y: encode(pub.Y.FillBytes(y))}
+		thumbprint = fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, k.X, k.Y)
+	case ed25519.PublicKey:
+		k = JWK{Kty: "OKP", Alg: "EdDSA", Crv: "Ed25519", X: encode(pub)}
+		thumbprint = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, k.X)
+	default:
+		return JWK{}, ErrJwkUnsupported
+	}
+	k.Use = "sig"
+	k.Kid = kid
+	if k.Kid == "" {
+		sum := sha256.Sum256([]byte(thumbprint))
+		k.Kid = encode(sum[:])
+	}
+	return k, nil
+}
+
+// loadKeySet 读取 JWKS_FILE / JWKS_URL 和本服务的签名私钥 JWT_SIGNING_KEY
+func loadKeySet() error {
+	keys := map[string]crypto.PublicKey{}
+	var jwks []JWK
+
+	if file := jwtConfig.JWKSFile; file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("read JWKS_FILE: %w", err)
+		}
+		set := JWKS{}
+		if err := json.Unmarshal(data, &set); err != nil {
+			return fmt.Errorf("parse JWKS_FILE: %w", err)
+		}
+		jwks = append(jwks, set.Keys...)
+	}
+	if jwksURL := jwtConfig.JWKSURL; jwksURL != "" {
+		set, err := fetchJWKS(jwksURL)
+		if err != nil {
+			return err
+		}
+		jwks = append(jwks, set.Keys...)
+	}
+	for _, k := range jwks {
+		pub, err := k.PublicKey()
+		if err != nil || k.Kid == "" {
+			Logger.Warn("skip jwk", zap.String("kid", k.Kid), zap.String("kty", k.Kty), zap.Error(err))
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	signing, err := loadSigningKeys(jwtConfig.SigningKey)
+	if err != nil {
+		return err
+	}
+	for _, s := range signing {
+		keys[s.kid] = s.key.Public()
+	}
+
+	keySet.keys = keys
+	keySet.signing = signing
+	keySet.fetched = time.Now()
+	keySet.loaded = true
+	return nil
+}
+
+func fetchJWKS(jwksURL string) (*JWKS, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetch JWKS_URL: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch JWKS_URL: unexpected status code: %d", resp.StatusCode)
+	}
+	set := &JWKS{}
+	if err := json.NewDecoder(resp.Body).Decode(set); err != nil {
+		return nil, fmt.Errorf("parse JWKS_URL: %w", err)
+	}
+	return set, nil
+}
+
+// loadSigningKeys 解析 PEM 文件中的私钥, 第一个用于签发, 其余只用于校验和发布, 方便轮换
+func loadSigningKeys(file string) ([]signingKey, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read JWT_SIGNING_KEY: %w", err)
+	}
+	var keys []signingKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse JWT_SIGNING_KEY: %w", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, ErrJwkUnsupported
+		}
+		jwk, err := NewJWK(block.Headers["kid"], signer.Public())
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, signingKey{kid: jwk.Kid, method: jwt.GetSigningMethod(jwk.Alg), key: signer})
+	}
+	return keys, nil
+}
+
+// ensureKeySet 首次使用时加载, JWKS_URL 的缓存过期或 refresh 为 true 时重新拉取
+func ensureKeySet(refresh bool) error {
+	keySet.Lock()
+	defer keySet.Unlock()
+	if keySet.loaded {
+		age := time.Since(keySet.fetched)
+		if jwtConfig.JWKSURL == "" || (age < jwksCacheTTL && !(refresh && age > jwksRefreshInterval)) {
+			return nil
+		}
+	}
+	if err := loadKeySet(); err != nil {
+		Logger.Error("failed to load jwks", zap.Error(err))
+		// 刷新失败时继续使用旧的 key
+		if keySet.loaded {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// verificationKey 根据 kid 找到校验用的公钥, 找不到时尝试刷新一次 JWKS_URL
+func verificationKey(kid string) (crypto.PublicKey, error) {
+	if err := ensureKeySet(false); err != nil {
+		return nil, err
+	}
+	keySet.RLock()
+	key, ok := keySet.keys[kid]
+	keySet.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if err := ensureKeySet(true); err != nil {
+		return nil, err
+	}
+	keySet.RLock()
+	defer keySet.RUnlock()
+	if key, ok := keySet.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown kid %q", kid)
+}
+
+// activeSigningKey 当前用于签发 jwt 的私钥, 没有配置时返回 nil
+func activeSigningKey() (*signingKey, error) {
+	if err := ensureKeySet(false); err != nil {
+		return nil, err
+	}
+	keySet.RLock()
+	defer keySet.RUnlock()
+	if len(keySet.signing) == 0 {
+		return nil, nil
+	}
+	return &keySet.signing[0], nil
+}
+
+// PublicJWKS 本服务签名私钥对应的公钥, 用于 /.well-known/jwks.json
+func PublicJWKS() (*JWKS, error) {
+	if err := ensureKeySet(false); err != nil {
+		return nil, err
+	}
+	keySet.RLock()
+	defer keySet.RUnlock()
+	set := &JWKS{Keys: []JWK{}}
+	for _, s := range keySet.signing {
+		jwk, err := NewJWK(s.kid, s.key.Public())
+		if err != nil {
+			return nil, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
@@ -1,41 +1,363 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"regexp"
+	"strings"
+	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 type RequestBody struct {
 	JWT          string `json:"jwt"`
 	Code         string `json:"code"`
 	PlatformType string `json:"type"`
+	State        string `json:"state"`
 }
 
 type RequestLoginBody struct {
 	Code         string `json:"code"`
 	PlatformType string `json:"type"`
+	State        string `json:"state"`
 }
 
-func JwtDecode(jwtToken string) (string, error) {
-	// 解析JWT
-	parsedToken, err := jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
-		// 验证算法和密钥
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("invalid signing method")
+type RequestSiweBody struct {
+	Message   string `json:"message"`
+	Signature string `json:"signature"`
+}
+
+type RequestRefreshBody struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RequestLogoutBody jwt 也可以放在 Authorization: Bearer 中, all 为 true 时退出地址的所有会话
+type RequestLogoutBody struct {
+	JWT string `json:"jwt"`
+	All bool   `json:"all"`
+}
+
+// RequestAuthorizeBody 登录页面提交的授权结果, request 为 /authorize 签发的授权请求, deny 为 true 时拒绝授权.
+// scopes 为用户同意的 scope, 为空时同意申请的全部 scope
+type RequestAuthorizeBody struct {
+	Request string   `json:"request"`
+	JWT     string   `json:"jwt"`
+	Deny    bool     `json:"deny"`
+	Scopes  []string `json:"scopes"`
+}
+
+// RequestRevokeGrantBody 撤销对第三方应用的授权, jwt 也可以放在 Authorization: Bearer 中
+type RequestRevokeGrantBody struct {
+	JWT      string `json:"jwt"`
+	ClientID string `json:"client_id"`
+}
+
+type RequestBatchBody struct {
+	Addrs        []string `json:"addrs"`
+	PlatformType string   `json:"type"`
+}
+
+// defaultAccessTTL 没有配置 AccessTTL 时 jwt 的有效期
+const defaultAccessTTL = 15 * time.Minute
+
+var (
+	ErrJwtMalformed    = errors.New("jwt malformed")
+	ErrJwtSignature    = errors.New("jwt signature invalid")
+	ErrJwtExpired      = errors.New("jwt expired")
+	ErrJwtNotValidYet  = errors.New("jwt not valid yet")
+	ErrJwtIssuer       = errors.New("jwt issuer invalid")
+	ErrJwtAudience     = errors.New("jwt audience invalid")
+	ErrJwtMissingClaim = errors.New("jwt missing address claim")
+	ErrJwtRevoked      = errors.New("jwt revoked")
+	// ErrJwtRevocationCheck 查询撤销列表失败, 不是 jwt 本身的问题
+	ErrJwtRevocationCheck = errors.New("jwt revocation check failed")
+	// ErrJwtClientToken 签发给第三方应用的 access token, 不能调用本服务自己的接口
+	ErrJwtClientToken = errors.New("jwt issued to oauth client")
+	// ErrJwtSessionToken 本服务自己的会话 jwt, 不是第三方应用的 access token
+	ErrJwtSessionToken = errors.New("jwt is not an oauth client access token")
+	// ErrNoSigningKey 没有配置 JWT_SIGNING_KEY, 不能签发 id_token
+	ErrNoSigningKey = errors.New("jwt signing key not configured")
+)
+
+var addressRegexp = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+
+// Claims 本服务接受的 jwt 内容
+type Claims struct {
+	Address string `json:"address"`
+	// Sid 签发 jwt 的会话, 即刷新令牌的 Family, 登出或检测到重放时整个会话失效
+	Sid string `json:"sid,omitempty"`
+	// ClientID/Scope 签发给第三方应用的 access token 才有, 只能用于 /userinfo 等开放接口, 见 JwtParseClient
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// jwtConfig 签发和校验 jwt 的配置
+var jwtConfig config.JWTConfig
+
+// ConfigureJwt 设置 jwt 的配置, 已经加载的公钥会在下次使用时重新加载
+func ConfigureJwt(cfg config.JWTConfig) {
+	keySet.Lock()
+	defer keySet.Unlock()
+	jwtConfig = cfg
+	keySet.loaded = false
+}
+
+// RevocationList 校验 jwt 时查询的撤销列表
+type RevocationList interface {
+	IsRevoked(ctx context.Context, jti, family, addr string, issuedAt time.Time) (bool, error)
+}
+
+// revocations 为 nil 时不检查撤销
+var revocations RevocationList
+
+// ConfigureRevocations 设置 JwtParse 使用的撤销列表
+func ConfigureRevocations(list RevocationList) {
+	revocations = list
+}
+
+// JwtAccessTTL 本服务签发的 jwt 的有效期
+func JwtAccessTTL() time.Duration {
+	if jwtConfig.AccessTTL > 0 {
+		return time.Duration(jwtConfig.AccessTTL) * time.Second
+	}
+	return defaultAccessTTL
+}
+
+// jwtLeeway exp/nbf 允许的时钟误差
+func jwtLeeway() time.Duration {
+	return time.Duration(jwtConfig.Leeway) * time.Second
+}
+
+// jwtKeyFunc HMAC 使用 jwtConfig.Secret, 非对称算法按 header 中的 kid 查找公钥
+func jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		secret := jwtConfig.Secret
+		if secret == "" {
+			return nil, fmt.Errorf("hmac jwt disabled")
+		}
+		return []byte(secret), nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, fmt.Errorf("missing kid")
+	}
+	return verificationKey(kid)
+}
+
+// NormalizeAddress 校验并转成小写的 0x 地址
+func NormalizeAddress(address string) (string, bool) {
+	if !addressRegexp.MatchString(address) {
+		return "", false
+	}
+	return strings.ToLower(address), true
+}
+
+// ClientTokenType 签发给第三方应用的 access token 的 typ header (RFC 9068), 与本服务自己的会话 jwt 区分
+const ClientTokenType = "at+jwt"
+
+// JwtParse 校验本服务自己的会话 jwt: 签名、exp/nbf、iss/aud 和撤销列表, 返回 address 已经规范化的 Claims.
+// 签发给第三方应用的 access token 返回 ErrJwtClientToken, 需要时用 JwtParseClient 校验
+func JwtParse(jwtToken string) (*Claims, error) {
+	claims, typ, err := parseClaims(jwtToken)
+	if err != nil {
+		return nil, err
+	}
+	if typ == ClientTokenType || claims.ClientID != "" {
+		return nil, ErrJwtClientToken
+	}
+	// Audience 为空时不校验
+	if audience := jwtConfig.Audience; audience != "" && !containsAudience(claims.Audience, audience) {
+		return nil, ErrJwtAudience
+	}
+	if err := checkRevoked(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// JwtParseClient 校验签发给第三方应用的 access token, aud 必须是 token 中的 client_id.
+// 本服务自己的会话 jwt 返回 ErrJwtSessionToken
+func JwtParseClient(jwtToken string) (*Claims, error) {
+	claims, typ, err := parseClaims(jwtToken)
+	if err != nil {
+		return nil, err
+	}
+	if typ != ClientTokenType || claims.ClientID == "" {
+		return nil, ErrJwtSessionToken
+	}
+	if !containsAudience(claims.Audience, claims.ClientID) {
+		return nil, ErrJwtAudience
+	}
+	if err := checkRevoked(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// parseClaims 校验签名、exp/nbf 和 iss, 返回规范化地址后的 Claims 和 typ header
+func parseClaims(jwtToken string) (*Claims, string, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "HS384", "HS512", "RS256", "ES256", "EdDSA"}),
+		jwt.WithLeeway(jwtLeeway()),
+	}
+	// Issuer 为空时不校验
+	if issuer := jwtConfig.Issuer; issuer != "" {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(jwtToken, claims, jwtKeyFunc, options...)
+	switch {
+	case err == nil:
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return nil, "", ErrJwtExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return nil, "", ErrJwtNotValidYet
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return nil, "", ErrJwtIssuer
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return nil, "", ErrJwtSignature
+	default:
+		return nil, "", ErrJwtMalformed
+	}
+
+	address, ok := NormalizeAddress(claims.Address)
+	if !ok {
+		return nil, "", ErrJwtMissingClaim
+	}
+	claims.Address = address
+	typ, _ := token.Header["typ"].(string)
+	return claims, typ, nil
+}
+
+// checkRevoked 查询撤销列表
+func checkRevoked(claims *Claims) error {
+	if revocations == nil {
+		return nil
+	}
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	revoked, err := revocations.IsRevoked(context.Background(), claims.ID, claims.Sid, claims.Address, issuedAt)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrJwtRevocationCheck, err)
+	}
+	if revoked {
+		return ErrJwtRevoked
+	}
+	return nil
+}
+
+func containsAudience(audience jwt.ClaimStrings, want string) bool {
+	for _, aud := range audience {
+		if aud == want {
+			return true
 		}
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
+	}
+	return false
+}
+
+// JwtDecode 解析本服务自己的 jwt 并返回其中的地址, 第三方应用的 access token 返回 ErrJwtClientToken
+func JwtDecode(jwtToken string) (string, error) {
+	claims, err := JwtParse(jwtToken)
+	if err != nil {
+		return "", err
+	}
+	return claims.Address, nil
+}
 
+// JwtEncode 签发带 address 的 jwt, 不属于任何会话
+func JwtEncode(address string) (string, error) {
+	return JwtEncodeSession(address, "")
+}
+
+// JwtEncodeSession 签发属于会话 sid 的 jwt, 带随机的 jti
+func JwtEncodeSession(address string, sid string) (string, error) {
+	claims, err := newClaims(address, sid)
+	if err != nil {
+		return "", err
+	}
+	if audience := jwtConfig.Audience; audience != "" {
+		claims.Audience = jwt.ClaimStrings{audience}
+	}
+	return signClaims(claims, "")
+}
+
+// JwtEncodeClient 签发给第三方应用 clientID 的 access token, 带授权的 scope.
+// typ 为 ClientTokenType, aud 为 clientID, 本服务和其他按 JWT_AUDIENCE 校验的服务都不会把它当成会话 jwt
+func JwtEncodeClient(address, sid, clientID, scope string) (string, error) {
+	claims, err := newClaims(address, sid)
+	if err != nil {
+		return "", err
+	}
+	claims.ClientID = clientID
+	claims.Scope = scope
+	claims.Audience = jwt.ClaimStrings{clientID}
+	return signClaims(claims, ClientTokenType)
+}
+
+// newClaims 带随机 jti 和有效期的 Claims
+func newClaims(address, sid string) (*Claims, error) {
+	jti, err := RandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &Claims{
+		Address: address,
+		Sid:     sid,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    jwtConfig.Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(JwtAccessTTL())),
+		},
+	}, nil
+}
+
+// signClaims 配置了签名私钥时使用私钥签名并带上 kid, 否则使用 HMAC 密钥. typ 为空时使用默认的 JWT
+func signClaims(claims jwt.Claims, typ string) (string, error) {
+	key, err := activeSigningKey()
 	if err != nil {
 		return "", err
 	}
+	if key == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		if typ != "" {
+			token.Header["typ"] = typ
+		}
+		return token.SignedString([]byte(jwtConfig.Secret))
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	if typ != "" {
+		token.Header["typ"] = typ
+	}
+	return token.SignedString(key.key)
+}
 
-	claims, ok := parsedToken.Claims.(jwt.MapClaims)
-	if !ok || !parsedToken.Valid {
+// SignIDToken 用签名私钥签发 OIDC id_token. 第三方应用只能通过 JWKS 校验, 不支持 HMAC
+func SignIDToken(claims jwt.Claims) (string, error) {
+	key, err := activeSigningKey()
+	if err != nil {
 		return "", err
 	}
-	address := claims["address"].(string)
-	return address, nil
+	if key == nil {
+		return "", ErrNoSigningKey
+	}
+	return signClaims(claims, "")
+}
+
+// SigningAlgorithm 当前签名私钥的算法, 用于 OIDC discovery, 没有配置时为空
+func SigningAlgorithm() string {
+	key, err := activeSigningKey()
+	if err != nil || key == nil {
+		return ""
+	}
+	return key.method.Alg()
 }
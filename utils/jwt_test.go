@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signTestJwt(t *testing.T, claims jwt.Claims, secret string) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJwtDecode(t *testing.T) {
+	ConfigureJwt(config.JWTConfig{Secret: "secret", Issuer: "knn3"})
+	t.Cleanup(func() { ConfigureJwt(config.JWTConfig{}) })
+
+	valid := &Claims{
+		Address:          "0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F",
+		RegisteredClaims: jwt.RegisteredClaims{Issuer: "knn3", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	}
+	expired := &Claims{
+		Address:          valid.Address,
+		RegisteredClaims: jwt.RegisteredClaims{Issuer: "knn3", ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour))},
+	}
+	otherIssuer := &Claims{Address: valid.Address, RegisteredClaims: jwt.RegisteredClaims{Issuer: "other"}}
+	noAddress := &Claims{RegisteredClaims: jwt.RegisteredClaims{Issuer: "knn3"}}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", signTestJwt(t, valid, "secret"), nil},
+		{"expired", signTestJwt(t, expired, "secret"), ErrJwtExpired},
+		{"bad signature", signTestJwt(t, valid, "other"), ErrJwtSignature},
+		{"issuer", signTestJwt(t, otherIssuer, "secret"), ErrJwtIssuer},
+		{"missing address", signTestJwt(t, noAddress, "secret"), ErrJwtMissingClaim},
+		{"malformed", "not-a-jwt", ErrJwtMalformed},
+	}
+	for _, tt := range tests {
+		address, err := JwtDecode(tt.token)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+		if err == nil && address != "0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f" {
+			t.Errorf("%s: address not normalized: %s", tt.name, address)
+		}
+	}
+
+	token, err := JwtEncode(valid.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := JwtDecode(token); err != nil {
+		t.Errorf("JwtEncode token rejected: %v", err)
+	}
+}
+
+func TestJwtSigningKeyRotation(t *testing.T) {
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var pemData []byte
+	for _, key := range []interface{}{newKey, oldKey} {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+	}
+	file := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(file, pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ConfigureJwt(config.JWTConfig{SigningKey: file})
+	t.Cleanup(func() { ConfigureJwt(config.JWTConfig{}) })
+
+	jwks, err := PublicJWKS()
+	if err != nil || len(jwks.Keys) != 2 || jwks.Keys[0].Alg != "ES256" || jwks.Keys[1].Alg != "EdDSA" {
+		t.Fatalf("jwks: %+v %v", jwks, err)
+	}
+
+	// 新签发的 token 使用第一个 key
+	token, err := JwtEncode("0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := JwtDecode(token); err != nil {
+		t.Errorf("ES256 token rejected: %v", err)
+	}
+
+	// 轮换期间旧 key 签发的 token 仍然有效
+	old := jwt.NewWithClaims(jwt.SigningMethodEdDSA, &Claims{Address: "0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F"})
+	old.Header["kid"] = jwks.Keys[1].Kid
+	oldToken, _ := old.SignedString(oldKey)
+	if _, err := JwtDecode(oldToken); err != nil {
+		t.Errorf("EdDSA token rejected: %v", err)
+	}
+
+	// HMAC 在没有 JWT_SECRET 时不再接受
+	hmacToken := signTestJwt(t, &Claims{Address: "0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F"}, "")
+	if _, err := JwtDecode(hmacToken); err != ErrJwtSignature {
+		t.Errorf("hmac: got %v", err)
+	}
+}
+
+func TestJwtClientToken(t *testing.T) {
+	ConfigureJwt(config.JWTConfig{Secret: "secret", Issuer: "knn3", Audience: "knn3-api"})
+	t.Cleanup(func() { ConfigureJwt(config.JWTConfig{}) })
+	address := "0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f"
+
+	clientToken, err := JwtEncodeClient(address, "family", "demo", "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionToken, err := JwtEncodeSession(address, "family")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第三方应用的 access token 不是会话 jwt, aud 也不是本服务的 audience
+	if _, err := JwtDecode(clientToken); err != ErrJwtClientToken {
+		t.Errorf("JwtDecode client token: %v", err)
+	}
+	claims, err := JwtParseClient(clientToken)
+	if err != nil || claims.ClientID != "demo" || len(claims.Audience) != 1 || claims.Audience[0] != "demo" {
+		t.Fatalf("JwtParseClient: %+v %v", claims, err)
+	}
+	if _, err := JwtParseClient(sessionToken); err != ErrJwtSessionToken {
+		t.Errorf("JwtParseClient session token: %v", err)
+	}
+	if claims, err := JwtParse(sessionToken); err != nil || claims.Sid != "family" {
+		t.Errorf("JwtParse session token: %+v %v", claims, err)
+	}
+
+	// typ 为 at+jwt 但去掉 client_id 的 token 也不能当成会话 jwt
+	stripped := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		Address:          address,
+		RegisteredClaims: jwt.RegisteredClaims{Issuer: "knn3", Audience: jwt.ClaimStrings{"knn3-api"}},
+	})
+	stripped.Header["typ"] = ClientTokenType
+	raw, _ := stripped.SignedString([]byte("secret"))
+	if _, err := JwtDecode(raw); err != ErrJwtClientToken {
+		t.Errorf("JwtDecode at+jwt without client_id: %v", err)
+	}
+	// 没有 client_id 的 at+jwt 也不是有效的应用 token
+	if _, err := JwtParseClient(raw); err != ErrJwtSessionToken {
+		t.Errorf("JwtParseClient at+jwt without client_id: %v", err)
+	}
+}
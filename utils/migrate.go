@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// legacyBindTable 迁移后旧的 oauth_bind 表重命名为该表, oauth_bind 变为兼容视图
+const legacyBindTable = "oauth_bind_legacy"
+
+// oauthBindView 按旧 oauth_bind 的列展开 linked_identity, 供直接读表的调用方继续使用.
+// subject 已经换成 GitHub 的数字 id 和 Google 的 sub, github/gmail 列仍然是旧表中的 login 和邮箱, 即 handle
+const oauthBindView = `SELECT addr,
+	COALESCE(MAX(CASE WHEN provider = 'github' THEN handle END), '') AS github,
+	COALESCE(MAX(CASE WHEN provider = 'gmail' THEN handle END), '') AS gmail,
+	COALESCE(MAX(CASE WHEN provider = 'discord' THEN subject END), '') AS discord,
+	COALESCE(MAX(CASE WHEN provider = 'discord' THEN handle END), '') AS discord_name,
+	COALESCE(MAX(CASE WHEN provider = 'stackexchange' THEN subject END), '') AS exchange,
+	COALESCE(MAX(CASE WHEN provider = 'stackexchange' THEN display_name END), '') AS exchange_name
+FROM linked_identity
+GROUP BY addr`
+
+// Identities 把一条 oauth_bind 记录按平台拆成 linked_identity. 旧表的地址大小写不一, 统一转成小写,
+// 与绑定和查询时 NormalizeAddress 的结果一致
+func (b OauthBind) Identities() []LinkedIdentity {
+	addr, valid := NormalizeAddress(b.Addr)
+	if !valid {
+		addr = strings.ToLower(b.Addr)
+	}
+	var list []LinkedIdentity
+	add := func(provider, subject, handle, name string, legacy bool) {
+		if subject != "" {
+			list = append(list, LinkedIdentity{Addr: addr, Provider: provider, Subject: subject, Handle: handle, DisplayName: name, LegacySubject: legacy})
+		}
+	}
+	// 旧表的 github 和 gmail 存的是 login 和邮箱, 需要回填成账号 id
+	add("github", b.Github, b.Github, "", true)
+	add("gmail", b.Gmail, b.Gmail, "", true)
+	add("discord", b.Discord, b.DiscordName, b.DiscordName, false)
+	add("stackexchange", b.Exchange, b.ExchangeName, b.ExchangeName, false)
+	return list
+}
+
+// MigrateLinkedIdentity 建立 linked_identity 表, 从 oauth_bind 回填数据,
+// 再把 oauth_bind 重命名为 oauth_bind_legacy 并建立同名的兼容视图. 可以重复执行
+func MigrateLinkedIdentity(db *gorm.DB) error {
+	addLegacyColumn := db.Migrator().HasTable(&LinkedIdentity{}) && !db.Migrator().HasColumn(&LinkedIdentity{}, "LegacySubject")
+	if err := db.AutoMigrate(&LinkedIdentity{}); err != nil {
+		return err
+	}
+	if addLegacyColumn {
+		// 添加 legacy_subject 列之前回填的 github/gmail 记录没有标记, subject 仍然等于 login 或邮箱的就是没有换成 id 的旧记录
+		result := db.Model(&LinkedIdentity{}).Where("provider IN ? AND subject = handle", []string{"github", "gmail"}).Update("legacy_subject", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		Logger.Info("marked legacy linked_identity", zap.Int64("rows", result.RowsAffected))
+	}
+
+	isTable, err := oauthBindIsTable(db)
+	if err != nil {
+		return err
+	}
+	source := legacyBindTable
+	if isTable {
+		source = "oauth_bind"
+	} else if !db.Migrator().HasTable(legacyBindTable) {
+		Logger.Info("no oauth_bind table to backfill")
+		return createOauthBindView(db)
+	}
+
+	now := time.Now()
+	total := 0
+	var binds []OauthBind
+	result := db.Table(source).FindInBatches(&binds, 500, func(tx *gorm.DB, batch int) error {
+		var identities []LinkedIdentity
+		for _, bind := range binds {
+			for _, identity := range bind.Identities() {
+				identity.VerifiedAt = &now
+				identities = append(identities, identity)
+			}
+		}
+		if len(identities) == 0 {
+			return nil
+		}
+		// 已经回填过或者冲突的账号保持不变
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&identities)
+		total += int(result.RowsAffected)
+		return result.Error
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	Logger.Info("backfilled linked_identity", zap.String("source", source), zap.Int("rows", total))
+
+	if source == "oauth_bind" {
+		if err := db.Migrator().RenameTable("oauth_bind", legacyBindTable); err != nil {
+			return err
+		}
+	}
+	return createOauthBindView(db)
+}
+
+// oauthBindIsTable oauth_bind 是还没有迁移的旧表, 而不是兼容视图或者不存在
+func oauthBindIsTable(db *gorm.DB) (bool, error) {
+	if db.Dialector.Name() == "sqlite" {
+		// SQLite 的 HasTable 只查询 type = 'table', 不包括视图
+		return db.Migrator().HasTable("oauth_bind"), nil
+	}
+	// MySQL 的 HasTable 包括视图, 需要查询 table_type
+	var tableType string
+	err := db.Raw("SELECT table_type FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?", "oauth_bind").Scan(&tableType).Error
+	if err != nil {
+		return false, fmt.Errorf("query oauth_bind table type: %w", err)
+	}
+	return tableType == "BASE TABLE", nil
+}
+
+// createOauthBindView 建立或替换 oauth_bind 兼容视图, SQLite 不支持 CREATE OR REPLACE VIEW
+func createOauthBindView(db *gorm.DB) error {
+	if db.Dialector.Name() == "sqlite" {
+		if err := db.Exec("DROP VIEW IF EXISTS oauth_bind").Error; err != nil {
+			return err
+		}
+		return db.Exec("CREATE VIEW oauth_bind AS " + oauthBindView).Error
+	}
+	return db.Exec("CREATE OR REPLACE VIEW oauth_bind AS " + oauthBindView).Error
+}
+
+// MigrateSessions 建立刷新令牌、撤销列表、第三方应用、授权码、用户授权和授权流程 nonce 的表. 可以重复执行
+func MigrateSessions(db *gorm.DB) error {
+	return db.AutoMigrate(&RefreshToken{}, &Revocation{}, &OAuthClient{}, &AuthorizationCode{}, &ConsentGrant{}, &FlowNonce{})
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	"github.com/KNN3-Network/oauth-server/config"
+)
+
+func TestOauthBindView(t *testing.T) {
+	store, db, err := OpenStore(config.DBConfig{Driver: "sqlite", SqlitePath: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	addr := "0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f"
+	for _, identity := range []LinkedIdentity{
+		{Addr: addr, Provider: "github", Subject: "583231", Handle: "octocat"},
+		{Addr: addr, Provider: "gmail", Subject: "109876543210987654321", Handle: "alice@gmail.com"},
+		{Addr: addr, Provider: "discord", Subject: "80351110224678912", Handle: "nelly"},
+		{Addr: addr, Provider: "stackexchange", Subject: "1001", DisplayName: "Alice"},
+	} {
+		identity := identity
+		if err := store.Upsert(ctx, &identity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 重复建立视图也可以
+	for i := 0; i < 2; i++ {
+		if err := createOauthBindView(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 视图中的 github/gmail 仍然是 login 和邮箱, 不是账号 id
+	bind := OauthBind{}
+	if err := db.Where("addr = ?", addr).First(&bind).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := OauthBind{Addr: addr, Github: "octocat", Gmail: "alice@gmail.com", Discord: "80351110224678912", DiscordName: "nelly", Exchange: "1001", ExchangeName: "Alice"}
+	if bind != want {
+		t.Fatalf("oauth_bind view: %+v, want %+v", bind, want)
+	}
+}
+
+func TestMigrateLinkedIdentity(t *testing.T) {
+	store, db, err := OpenStore(config.DBConfig{Driver: "sqlite", SqlitePath: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&OauthBind{}); err != nil {
+		t.Fatal(err)
+	}
+	// 旧表中的地址可能是 checksum 格式
+	if err := db.Create(&OauthBind{Addr: "0x9D8A62f656a8d1615C1294fd71e9CFb3E4855A4F", Github: "octocat", Discord: "80351110224678912", DiscordName: "nelly"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	// 第二次执行时 oauth_bind 已经是视图
+	for i := 0; i < 2; i++ {
+		if err := MigrateLinkedIdentity(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := "0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f"
+	linked, err := store.GetByIdentity(context.Background(), "discord", "80351110224678912")
+	if err != nil || linked.Addr != addr {
+		t.Fatalf("backfilled identity: %+v %v", linked, err)
+	}
+	if !db.Migrator().HasTable(legacyBindTable) {
+		t.Fatalf("oauth_bind should be renamed to %s", legacyBindTable)
+	}
+	bind := OauthBind{}
+	if err := db.Where("addr = ?", addr).First(&bind).Error; err != nil || bind.Github != "octocat" {
+		t.Fatalf("oauth_bind view: %+v %v", bind, err)
+	}
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNonceNotFound nonce 不存在、已经取出或已经过期
+	ErrNonceNotFound = errors.New("nonce not found")
+	// ErrNonceExists nonce 已经保存过
+	ErrNonceExists = errors.New("nonce exists")
+)
+
+// FlowNonce 授权流程中多个实例共享的一次性数据, 如 PKCE 的 code_verifier.
+// Nonce 带用途前缀, ExpiresAt 之后失效并被清理
+type FlowNonce struct {
+	ID        uint64    `gorm:"primaryKey"`
+	Nonce     string    `gorm:"size:191;not null;uniqueIndex"`
+	Value     string    `gorm:"size:255"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+func (FlowNonce) TableName() string {
+	return "flow_nonce"
+}
+
+// NonceStore 授权流程一次性数据的存储
+type NonceStore interface {
+	// CreateNonce 保存 nonce, 同名的 nonce 已经存在时返回 ErrNonceExists
+	CreateNonce(ctx context.Context, nonce *FlowNonce) error
+	// TakeNonce 取出并删除 nonce, 并发时只有一个调用方能取到. 不存在或已经过期时返回 ErrNonceNotFound
+	TakeNonce(ctx context.Context, nonce string) (*FlowNonce, error)
+}
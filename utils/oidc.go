@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrClientNotFound client_id 没有注册
+	ErrClientNotFound = errors.New("oauth client not found")
+	// ErrAuthorizationCodeNotFound 授权码不存在
+	ErrAuthorizationCodeNotFound = errors.New("authorization code not found")
+	// ErrAuthorizationCodeUsed 授权码已经换过 token
+	ErrAuthorizationCodeUsed = errors.New("authorization code used")
+)
+
+// OAuthClient 在本服务注册的第三方应用 ("Login with KNN3")
+type OAuthClient struct {
+	ID       uint64 `json:"-" gorm:"primaryKey"`
+	ClientID string `json:"client_id" gorm:"size:64;not null;uniqueIndex"`
+	// SecretHash client_secret 的 sha256, 为空时是公开客户端, 必须使用 PKCE
+	SecretHash   string     `json:"-" gorm:"size:64"`
+	Name         string     `json:"name" gorm:"size:191;not null"`
+	RedirectURIs StringList `json:"redirect_uris" gorm:"type:json"`
+	// ResourceServer 本服务的下游服务, 可以校验任意 token, 没有 redirect_uri 不能发起授权
+	ResourceServer bool      `json:"resource_server" gorm:"not null;default:false"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (OAuthClient) TableName() string {
+	return "oauth_client"
+}
+
+// Public 公开客户端 (浏览器或移动端), 没有 client_secret
+func (c *OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+// AuthorizationCode /authorize 签发的授权码, 只保存授权码的 sha256
+type AuthorizationCode struct {
+	ID          uint64 `gorm:"primaryKey"`
+	Hash        string `gorm:"size:64;not null;uniqueIndex"`
+	ClientID    string `gorm:"size:64;not null"`
+	Addr        string `gorm:"size:64;not null"`
+	RedirectURI string `gorm:"size:2048;not null"`
+	Scope       string `gorm:"size:1024"`
+	Nonce       string `gorm:"size:255"`
+	// CodeChallenge PKCE 的 S256 code_challenge
+	CodeChallenge string `gorm:"size:128"`
+	// Family 用授权码换取的会话, 授权码被重复使用时撤销
+	Family    string    `gorm:"size:64;not null"`
+	AuthTime  time.Time `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func (AuthorizationCode) TableName() string {
+	return "authorization_code"
+}
+
+// ClientStore 第三方应用和授权码的存储
+type ClientStore interface {
+	// CreateClient 注册应用
+	CreateClient(ctx context.Context, client *OAuthClient) error
+	// GetClient 没有注册时返回 ErrClientNotFound
+	GetClient(ctx context.Context, clientID string) (*OAuthClient, error)
+	// CreateAuthorizationCode 保存新的授权码
+	CreateAuthorizationCode(ctx context.Context, code *AuthorizationCode) error
+	// UseAuthorizationCode 把 hash 对应的授权码标记为已使用并返回.
+	// 已经使用过时同时返回授权码和 ErrAuthorizationCodeUsed, 不存在时返回 ErrAuthorizationCodeNotFound
+	UseAuthorizationCode(ctx context.Context, hash string) (*AuthorizationCode, error)
+}
+
+// StringList 以 json 数组存储的字段
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(l)
+	return string(data), err
+}
+
+func (l *StringList) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported StringList value %T", value)
+	}
+	return json.Unmarshal(data, l)
+}
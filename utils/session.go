@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrRefreshTokenNotFound 刷新令牌不存在
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	// ErrRefreshTokenReused 刷新令牌已经轮换过, 再次使用说明令牌可能泄露
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// RefreshToken 服务端保存的刷新令牌, 只保存令牌的 sha256.
+// 同一次登录轮换出的令牌属于同一个 Family
+type RefreshToken struct {
+	ID     uint64 `gorm:"primaryKey"`
+	Hash   string `gorm:"size:64;not null;uniqueIndex"`
+	Family string `gorm:"size:64;not null;index"`
+	Addr   string `gorm:"size:64;not null;index"`
+	// ClientID/Scope 第三方应用的会话, 本服务自己的会话为空
+	ClientID  string     `gorm:"size:64"`
+	Scope     string     `gorm:"size:1024"`
+	ExpiresAt time.Time  `gorm:"not null;index"`
+	UsedAt    *time.Time // 已经轮换出新的令牌
+	RevokedAt *time.Time // 登出或检测到重放
+	CreatedAt time.Time
+}
+
+func (RefreshToken) TableName() string {
+	return "refresh_token"
+}
+
+// 撤销的类型
+const (
+	RevokeJTI     = "jti"     // 单个 access token
+	RevokeFamily  = "family"  // 一次登录签发的所有 access token
+	RevokeAddress = "address" // 地址在 RevokedAt 所在的秒之前签发的所有 access token
+)
+
+// Revocation 撤销列表中的一项, ExpiresAt 之后相关的 access token 都已过期, 可以清理
+type Revocation struct {
+	ID        uint64    `gorm:"primaryKey"`
+	Kind      string    `gorm:"size:16;not null;uniqueIndex:uk_kind_value,priority:1"`
+	Value     string    `gorm:"size:191;not null;uniqueIndex:uk_kind_value,priority:2"`
+	RevokedAt time.Time `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+func (Revocation) TableName() string {
+	return "revocation"
+}
+
+// SessionStore 刷新令牌和撤销列表的存储
+type SessionStore interface {
+	// CreateRefreshToken 保存新的刷新令牌
+	CreateRefreshToken(ctx context.Context, token *RefreshToken) error
+	// UseRefreshToken 把 hash 对应的令牌标记为已使用并返回.
+	// 已经使用过时同时返回令牌和 ErrRefreshTokenReused, 不存在时返回 ErrRefreshTokenNotFound
+	UseRefreshToken(ctx context.Context, hash string) (*RefreshToken, error)
+	// GetRefreshToken 查询 hash 对应的令牌, 不改变令牌的状态, 不存在时返回 ErrRefreshTokenNotFound
+	GetRefreshToken(ctx context.Context, hash string) (*RefreshToken, error)
+	// RevokeRefreshTokens 撤销 family 或 addr 的所有刷新令牌, 为空的条件不使用. 返回撤销的令牌所属的 family
+	RevokeRefreshTokens(ctx context.Context, family, addr string) ([]string, error)
+	// RevokeClientRefreshTokens 撤销地址签发给第三方应用 clientID 的所有刷新令牌, 返回撤销的令牌所属的 family
+	RevokeClientRefreshTokens(ctx context.Context, clientID, addr string) ([]string, error)
+	// Revoke 加入撤销列表, 同一项重复撤销时更新时间
+	Revoke(ctx context.Context, revocation *Revocation) error
+	// IsRevoked jti、family 或地址 (在 issuedAt 之后的一秒撤销) 在撤销列表中
+	IsRevoked(ctx context.Context, jti, family, addr string, issuedAt time.Time) (bool, error)
+	// DeleteExpired 清理已经过期的刷新令牌、撤销记录、授权码和授权流程的 nonce
+	DeleteExpired(ctx context.Context, now time.Time) error
+}
+
+// Store 绑定关系、会话、第三方应用、用户授权和授权流程 nonce 的存储
+type Store interface {
+	BindingStore
+	SessionStore
+	ClientStore
+	ConsentStore
+	NonceStore
+}
+
+// RandomToken n 字节的随机数, base64url 编码
+func RandomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// HashToken 刷新令牌保存在服务端的 sha256
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
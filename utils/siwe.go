@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"golang.org/x/crypto/sha3"
+)
+
+// siweNonceTTL 签发的 nonce 的有效期
+const siweNonceTTL = 10 * time.Minute
+
+// siweMaxAge 没有 Expiration Time 时, Issued At 距今的最大时长
+const siweMaxAge = 10 * time.Minute
+
+// siweNoncePrefix 签发的 nonce 在 NonceStore 中的前缀
+const siweNoncePrefix = "siwe."
+
+var (
+	ErrSiweMessage   = errors.New("siwe: malformed message")
+	ErrSiweDomain    = errors.New("siwe: domain mismatch")
+	ErrSiweNonce     = errors.New("siwe: invalid nonce")
+	ErrSiweExpired   = errors.New("siwe: message expired")
+	ErrSiweSignature = errors.New("siwe: invalid signature")
+	// ErrSiweNonceCheck 查询或消费 nonce 失败, 不是消息本身的问题
+	ErrSiweNonceCheck = errors.New("siwe: nonce check failed")
+)
+
+var siweAddressRegexp = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+
+// SiweMessage EIP-4361 Sign-In with Ethereum 消息
+type SiweMessage struct {
+	Domain         string
+	Address        string
+	Statement      string
+	URI            string
+	Version        string
+	ChainID        int64
+	Nonce          string
+	IssuedAt       time.Time
+	ExpirationTime *time.Time
+	NotBefore      *time.Time
+	RequestID      string
+	Resources      []string
+}
+
+// SiweNonce 签发一个一次性的 nonce, 保存在共享的 store 中, 任一实例都可以校验
+func SiweNonce(ctx context.Context, store NonceStore) (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(buf)
+	err := store.CreateNonce(ctx, &FlowNonce{Nonce: siweNoncePrefix + nonce, ExpiresAt: time.Now().Add(siweNonceTTL)})
+	if err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+// consumeSiweNonce nonce 只能使用一次, 没有签发过、已经使用或已经过期时返回 false
+func consumeSiweNonce(ctx context.Context, store NonceStore, nonce string) (bool, error) {
+	_, err := store.TakeNonce(ctx, siweNoncePrefix+nonce)
+	if errors.Is(err, ErrNonceNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ParseSiweMessage 解析 EIP-4361 消息
+func ParseSiweMessage(message string) (*SiweMessage, error) {
+	lines := strings.Split(strings.ReplaceAll(message, "\r\n", "\n"), "\n")
+	if len(lines) < 3 {
+		return nil, ErrSiweMessage
+	}
+	domain, ok := strings.CutSuffix(lines[0], " wants you to sign in with your Ethereum account:")
+	if !ok || domain == "" {
+		return nil, ErrSiweMessage
+	}
+	// 带 scheme 时只比较 host 部分
+	if _, host, found := strings.Cut(domain, "://"); found {
+		domain = host
+	}
+	msg := &SiweMessage{Domain: domain, Address: lines[1]}
+	if !siweAddressRegexp.MatchString(msg.Address) {
+		return nil, ErrSiweMessage
+	}
+
+	var statement []string
+	inResources := false
+	for _, line := range lines[2:] {
+		// URI 之前的非空行是 statement
+		if msg.URI == "" && !strings.HasPrefix(line, "URI: ") {
+			if strings.TrimSpace(line) != "" {
+				statement = append(statement, line)
+			}
+			continue
+		}
+		if line == "Resources:" {
+			inResources = true
+			continue
+		}
+		if inResources {
+			if resource, ok := strings.CutPrefix(line, "- "); ok {
+				msg.Resources = append(msg.Resources, resource)
+			}
+			continue
+		}
+		key, value, _ := strings.Cut(line, ": ")
+		var err error
+		switch key {
+		case "URI":
+			msg.URI = value
+		case "Version":
+			msg.Version = value
+		case "Chain ID":
+			msg.ChainID, err = strconv.ParseInt(value, 10, 64)
+		case "Nonce":
+			msg.Nonce = value
+		case "Issued At":
+			msg.IssuedAt, err = time.Parse(time.RFC3339, value)
+		case "Expiration Time":
+			msg.ExpirationTime, err = parseSiweTime(value)
+		case "Not Before":
+			msg.NotBefore, err = parseSiweTime(value)
+		case "Request ID":
+			msg.RequestID = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrSiweMessage, key, err)
+		}
+	}
+	msg.Statement = strings.Join(statement, "\n")
+	if msg.URI == "" || msg.Version != "1" || msg.Nonce == "" || msg.IssuedAt.IsZero() {
+		return nil, ErrSiweMessage
+	}
+	return msg, nil
+}
+
+func parseSiweTime(value string) (*time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// VerifySiwe 校验消息的 domain、nonce、有效期和签名, 返回签名的地址. nonce 从 store 中消费
+func VerifySiwe(ctx context.Context, store NonceStore, message string, signature string, domain string) (string, error) {
+	msg, err := ParseSiweMessage(message)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(msg.Domain, domain) {
+		return "", ErrSiweDomain
+	}
+	now := time.Now()
+	if msg.ExpirationTime != nil && now.After(*msg.ExpirationTime) {
+		return "", ErrSiweExpired
+	}
+	if msg.ExpirationTime == nil && now.Sub(msg.IssuedAt) > siweMaxAge {
+		return "", ErrSiweExpired
+	}
+	if msg.NotBefore != nil && now.Before(*msg.NotBefore) {
+		return "", ErrSiweExpired
+	}
+	signer, err := RecoverPersonalSign(message, signature)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(signer, msg.Address) {
+		return "", ErrSiweSignature
+	}
+	// 签名通过后再消费 nonce, 避免伪造的请求把合法的 nonce 用掉
+	fresh, err := consumeSiweNonce(ctx, store, msg.Nonce)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrSiweNonceCheck, err)
+	}
+	if !fresh {
+		return "", ErrSiweNonce
+	}
+	return msg.Address, nil
+}
+
+// RecoverPersonalSign 从 personal_sign (EIP-191) 签名中恢复签名者地址, 返回小写的 0x 地址
+func RecoverPersonalSign(message string, signature string) (string, error) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil || len(sig) != 65 {
+		return "", ErrSiweSignature
+	}
+	v := sig[64]
+	if v >= 27 {
+		v -= 27
+	}
+	if v > 1 {
+		return "", ErrSiweSignature
+	}
+	// decred 的 compact 签名格式为 [27+recid][r][s]
+	compact := make([]byte, 65)
+	compact[0] = 27 + v
+	copy(compact[1:], sig[:64])
+
+	hash := keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(message), message)))
+	pub, _, err := ecdsa.RecoverCompact(compact, hash)
+	if err != nil {
+		return "", ErrSiweSignature
+	}
+	// 地址为未压缩公钥 (去掉 0x04 前缀) 的 keccak256 后 20 字节
+	return "0x" + hex.EncodeToString(keccak256(pub.SerializeUncompressed()[1:])[12:]), nil
+}
+
+func keccak256(data []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// 私钥 0x4646...46 对应的地址
+const siweTestAddress = "0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F"
+
+func siweTestSign(t *testing.T, message string) string {
+	key, _ := hex.DecodeString("4646464646464646464646464646464646464646464646464646464646464646")
+	hash := keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(message), message)))
+	compact := ecdsa.SignCompact(secp256k1.PrivKeyFromBytes(key), hash, false)
+	// [27+recid][r][s] 转成以太坊的 [r][s][v]
+	return "0x" + hex.EncodeToString(append(compact[1:], compact[0]))
+}
+
+func TestVerifySiwe(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	nonce, err := SiweNonce(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := fmt.Sprintf("knn3.xyz wants you to sign in with your Ethereum account:\n%s\n\nSign in to KNN3\n\nURI: https://knn3.xyz\nVersion: 1\nChain ID: 1\nNonce: %s\nIssued At: %s",
+		siweTestAddress, nonce, time.Now().UTC().Format(time.RFC3339))
+	signature := siweTestSign(t, message)
+
+	if _, err := VerifySiwe(ctx, store, message, signature, "evil.xyz"); err != ErrSiweDomain {
+		t.Fatalf("domain: got %v", err)
+	}
+	address, err := VerifySiwe(ctx, store, message, signature, "knn3.xyz")
+	if err != nil || address != siweTestAddress {
+		t.Fatalf("verify: got %s %v", address, err)
+	}
+	if _, err := VerifySiwe(ctx, store, message, signature, "knn3.xyz"); err != ErrSiweNonce {
+		t.Fatalf("replay: got %v", err)
+	}
+}
+
+func TestVerifySiweExpired(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	nonce, _ := SiweNonce(ctx, store)
+	message := fmt.Sprintf("knn3.xyz wants you to sign in with your Ethereum account:\n%s\n\n\nURI: https://knn3.xyz\nVersion: 1\nChain ID: 1\nNonce: %s\nIssued At: %s\nExpiration Time: %s",
+		siweTestAddress, nonce, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339), time.Now().Add(-time.Minute).UTC().Format(time.RFC3339))
+
+	if _, err := VerifySiwe(ctx, store, message, siweTestSign(t, message), "knn3.xyz"); err != ErrSiweExpired {
+		t.Fatalf("got %v", err)
+	}
+}
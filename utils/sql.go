@@ -1,17 +1,17 @@
 package utils
 
 import (
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
-	"log"
-	"os"
+	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/KNN3-Network/oauth-server/config"
+	"github.com/glebarez/sqlite"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
-var db *gorm.DB
-
 type OauthBind struct {
 	Addr         string `json:"addr" gorm:"column:addr;primaryKey"`
 	Github       string `json:"github"`
@@ -26,30 +26,95 @@ func (OauthBind) TableName() string {
 	return "oauth_bind"
 }
 
-func init() {
+// LinkedIdentity 地址绑定的一个平台账号, 每个平台账号 (provider, subject) 只能绑定一个地址
+type LinkedIdentity struct {
+	ID          uint64     `json:"-" gorm:"primaryKey"`
+	Addr        string     `json:"addr" gorm:"column:addr;size:64;not null;uniqueIndex:uk_addr_provider,priority:1"`
+	Provider    string     `json:"provider" gorm:"size:32;not null;uniqueIndex:uk_provider_subject,priority:1;uniqueIndex:uk_addr_provider,priority:2"`
+	Subject     string     `json:"subject" gorm:"size:191;not null;uniqueIndex:uk_provider_subject,priority:2"`
+	Handle      string     `json:"handle" gorm:"size:191"`
+	DisplayName string     `json:"display_name" gorm:"size:191"`
+	Metadata    JSONMap    `json:"metadata" gorm:"type:json"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	VerifiedAt  *time.Time `json:"verified_at"`
+	// LegacySubject Subject 还是旧版本的 github login 或 gmail 邮箱, 没有换成不可变的账号 id
+	LegacySubject bool `json:"-" gorm:"not null;default:false"`
+}
+
+func (LinkedIdentity) TableName() string {
+	return "linked_identity"
+}
+
+// JSONMap 以 json 格式存储的字段
+type JSONMap map[string]interface{}
+
+func (m JSONMap) Value() (driver.Value, error) {
+	if m == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(m)
+	return string(data), err
+}
+
+func (m *JSONMap) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported JSONMap value %T", value)
+	}
+	return json.Unmarshal(data, m)
+}
+
+// OpenStore 根据 Driver 打开绑定关系、会话、第三方应用和用户授权的存储. Driver 为 mysql 或 sqlite 时同时返回 gorm.DB, memory 时为 nil
+func OpenStore(cfg config.DBConfig) (Store, *gorm.DB, error) {
+	var db *gorm.DB
 	var err error
-	err = godotenv.Load()
+	switch cfg.Driver {
+	case "", "mysql":
+		db, err = openMysql(cfg)
+	case "sqlite":
+		db, err = openSqlite(cfg)
+	case "memory":
+		return NewMemoryStore(), nil, nil
+	default:
+		err = fmt.Errorf("unknown db driver %q", cfg.Driver)
+	}
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		return nil, nil, err
 	}
+	return NewGormStore(db), db, nil
+}
+
+func openMysql(cfg config.DBConfig) (*gorm.DB, error) {
 	// 连接到 MySQL 服务器
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/lens?charset=utf8mb4&parseTime=True&loc=Local",
-		os.Getenv("DB_USERNAME"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+		cfg.Username,
+		cfg.Password,
+		cfg.Host,
+		cfg.Port,
+		cfg.Name,
 	)
-	db, err = gorm.Open(mysql.New(mysql.Config{
+	mysqlDB, err := gorm.Open(mysql.New(mysql.Config{
 		DSN: dsn,
-	}), &gorm.Config{})
-
+	}), &gorm.Config{
+		// 把唯一索引冲突转换成 gorm.ErrDuplicatedKey
+		TranslateError: true,
+	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	// 获取通用数据库对象 sql.DB ，然后使用其提供的功能
-	sqlDB, err := db.DB()
+	sqlDB, err := mysqlDB.DB()
 	if err != nil {
-		log.Fatalf("failed to get underlying sql.DB: %v", err)
+		return nil, fmt.Errorf("failed to get underlying sql.DB: %w", err)
 	}
 
 	// SetMaxIdleConns 用于设置连接池中空闲连接的最大数量。
@@ -57,8 +122,25 @@ func init() {
 
 	// SetMaxOpenConns 设置打开数据库连接的最大数量。
 	sqlDB.SetMaxOpenConns(100)
+	return mysqlDB, nil
 }
 
-func GetDB() *gorm.DB {
-	return db
+// openSqlite 打开 SqlitePath (:memory: 为内存数据库) 并自动建表
+func openSqlite(cfg config.DBConfig) (*gorm.DB, error) {
+	sqliteDB, err := gorm.Open(sqlite.Open(cfg.SqlitePath+"?_pragma=busy_timeout(5000)"), &gorm.Config{
+		TranslateError: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := sqliteDB.DB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get underlying sql.DB: %w", err)
+	}
+	// SQLite 只允许一个写连接, :memory: 数据库每个连接各自独立
+	sqlDB.SetMaxOpenConns(1)
+	if err := sqliteDB.AutoMigrate(&LinkedIdentity{}, &RefreshToken{}, &Revocation{}, &OAuthClient{}, &AuthorizationCode{}, &ConsentGrant{}, &FlowNonce{}); err != nil {
+		return nil, err
+	}
+	return sqliteDB, nil
 }
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrBindingNotFound 没有对应的绑定记录
+	ErrBindingNotFound = errors.New("binding not found")
+	// ErrBindingConflict 平台账号已经绑定了其他地址
+	ErrBindingConflict = errors.New("binding conflict")
+)
+
+// BindingStore 地址与平台账号绑定关系的存储
+type BindingStore interface {
+	// GetByAddress 地址绑定的所有平台账号, 按 provider 排序
+	GetByAddress(ctx context.Context, addr string) ([]LinkedIdentity, error)
+	// GetByIdentity 平台账号对应的绑定记录, 没有时返回 ErrBindingNotFound
+	GetByIdentity(ctx context.Context, provider, subject string) (*LinkedIdentity, error)
+	// Upsert 绑定平台账号, 地址已经绑定过该平台时替换为新的账号.
+	// 平台账号已经绑定其他地址时返回 ErrBindingConflict
+	Upsert(ctx context.Context, identity *LinkedIdentity) error
+	// Delete 删除地址在该平台的绑定, 没有时返回 ErrBindingNotFound
+	Delete(ctx context.Context, addr, provider string) error
+	// List 多个地址的绑定记录, 按 addr、provider 排序. provider 为空时返回所有平台
+	List(ctx context.Context, addrs []string, provider string) ([]LinkedIdentity, error)
+	// ListByProvider 该平台 id 大于 afterID 的最多 limit 条记录, 按 id 排序, 用于分批回填
+	ListByProvider(ctx context.Context, provider string, afterID uint64, limit int) ([]LinkedIdentity, error)
+	// UpdateSubject 把记录的平台账号标识换成 subject 并清除 LegacySubject, 新的标识已经被绑定时返回 ErrBindingConflict
+	UpdateSubject(ctx context.Context, id uint64, subject string) error
+}
@@ -0,0 +1,338 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// upsertRetries 事务死锁时的重试次数
+const upsertRetries = 3
+
+// GormStore 基于 gorm 的 Store, 用于 MySQL 和 SQLite
+type GormStore struct {
+	db *gorm.DB
+}
+
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{db: db}
+}
+
+func (s *GormStore) GetByAddress(ctx context.Context, addr string) ([]LinkedIdentity, error) {
+	var list []LinkedIdentity
+	err := s.db.WithContext(ctx).Where("addr = ?", addr).Order("provider").Find(&list).Error
+	return list, err
+}
+
+func (s *GormStore) GetByIdentity(ctx context.Context, provider, subject string) (*LinkedIdentity, error) {
+	linked := &LinkedIdentity{}
+	result := s.db.WithContext(ctx).Where("provider = ? AND subject = ?", provider, subject).Limit(1).Find(linked)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrBindingNotFound
+	}
+	return linked, nil
+}
+
+// Upsert 在事务中锁住相关记录, 并发绑定时由 (provider, subject) 唯一索引兜底, 重复键同样返回 ErrBindingConflict
+func (s *GormStore) Upsert(ctx context.Context, identity *LinkedIdentity) error {
+	var err error
+	for i := 0; i < upsertRetries; i++ {
+		if err = s.upsert(ctx, identity); !isDeadlock(err) {
+			break
+		}
+		Logger.Warn("upsert deadlock, retry", zap.String("provider", identity.Provider), zap.Int("attempt", i+1))
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrBindingConflict
+	}
+	return err
+}
+
+func (s *GormStore) upsert(ctx context.Context, identity *LinkedIdentity) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Session 让两次查询各自使用新的条件
+		locked := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Session(&gorm.Session{})
+
+		bound := LinkedIdentity{}
+		result := locked.Where("provider = ? AND subject = ?", identity.Provider, identity.Subject).Limit(1).Find(&bound)
+		if result.Error != nil {
+			return result.Error
+		}
+		// 同一个地址重复绑定同一个账号时只刷新账号信息
+		if result.RowsAffected > 0 && !strings.EqualFold(bound.Addr, identity.Addr) {
+			return ErrBindingConflict
+		}
+
+		linked := LinkedIdentity{}
+		result = locked.Where("addr = ? AND provider = ?", identity.Addr, identity.Provider).Limit(1).Find(&linked)
+		if result.Error != nil {
+			return result.Error
+		}
+		identity.ID = linked.ID
+		identity.CreatedAt = linked.CreatedAt
+		return tx.Save(identity).Error
+	})
+}
+
+func (s *GormStore) Delete(ctx context.Context, addr, provider string) error {
+	result := s.db.WithContext(ctx).Where("addr = ? AND provider = ?", addr, provider).Delete(&LinkedIdentity{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrBindingNotFound
+	}
+	return nil
+}
+
+func (s *GormStore) List(ctx context.Context, addrs []string, provider string) ([]LinkedIdentity, error) {
+	query := s.db.WithContext(ctx).Where("addr IN ?", addrs)
+	if provider != "" {
+		query = query.Where("provider = ?", provider)
+	}
+	var list []LinkedIdentity
+	err := query.Order("addr").Order("provider").Find(&list).Error
+	return list, err
+}
+
+// isDeadlock MySQL 的死锁 (1213) 和锁等待超时 (1205) 可以重试
+func isDeadlock(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == 1213 || mysqlErr.Number == 1205)
+}
+
+func (s *GormStore) ListByProvider(ctx context.Context, provider string, afterID uint64, limit int) ([]LinkedIdentity, error) {
+	var list []LinkedIdentity
+	err := s.db.WithContext(ctx).Where("provider = ? AND id > ?", provider, afterID).Order("id").Limit(limit).Find(&list).Error
+	return list, err
+}
+
+func (s *GormStore) UpdateSubject(ctx context.Context, id uint64, subject string) error {
+	result := s.db.WithContext(ctx).Model(&LinkedIdentity{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"subject": subject, "legacy_subject": false})
+	if errors.Is(result.Error, gorm.ErrDuplicatedKey) {
+		return ErrBindingConflict
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrBindingNotFound
+	}
+	return nil
+}
+
+func (s *GormStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	return s.db.WithContext(ctx).Create(token).Error
+}
+
+// UseRefreshToken 以 used_at IS NULL 为条件更新, 并发使用同一个令牌时只有一个成功
+func (s *GormStore) UseRefreshToken(ctx context.Context, hash string) (*RefreshToken, error) {
+	db := s.db.WithContext(ctx)
+	result := db.Model(&RefreshToken{}).Where("hash = ? AND used_at IS NULL", hash).Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	token := &RefreshToken{}
+	found := db.Where("hash = ?", hash).Limit(1).Find(token)
+	if found.Error != nil {
+		return nil, found.Error
+	}
+	if found.RowsAffected == 0 {
+		return nil, ErrRefreshTokenNotFound
+	}
+	if result.RowsAffected == 0 {
+		return token, ErrRefreshTokenReused
+	}
+	return token, nil
+}
+
+func (s *GormStore) GetRefreshToken(ctx context.Context, hash string) (*RefreshToken, error) {
+	token := &RefreshToken{}
+	result := s.db.WithContext(ctx).Where("hash = ?", hash).Limit(1).Find(token)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrRefreshTokenNotFound
+	}
+	return token, nil
+}
+
+func (s *GormStore) RevokeRefreshTokens(ctx context.Context, family, addr string) ([]string, error) {
+	query := s.db.WithContext(ctx).Model(&RefreshToken{}).Where("revoked_at IS NULL")
+	if family != "" {
+		query = query.Where("family = ?", family)
+	}
+	if addr != "" {
+		query = query.Where("addr = ?", addr)
+	}
+	query = query.Session(&gorm.Session{})
+	var families []string
+	if err := query.Distinct("family").Pluck("family", &families).Error; err != nil {
+		return nil, err
+	}
+	return families, query.Update("revoked_at", time.Now()).Error
+}
+
+func (s *GormStore) RevokeClientRefreshTokens(ctx context.Context, clientID, addr string) ([]string, error) {
+	query := s.db.WithContext(ctx).Model(&RefreshToken{}).
+		Where("revoked_at IS NULL AND client_id = ? AND addr = ?", clientID, addr).
+		Session(&gorm.Session{})
+	var families []string
+	if err := query.Distinct("family").Pluck("family", &families).Error; err != nil {
+		return nil, err
+	}
+	return families, query.Update("revoked_at", time.Now()).Error
+}
+
+func (s *GormStore) Revoke(ctx context.Context, revocation *Revocation) error {
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "kind"}, {Name: "value"}},
+		DoUpdates: clause.AssignmentColumns([]string{"revoked_at", "expires_at"}),
+	}).Create(revocation).Error
+}
+
+func (s *GormStore) IsRevoked(ctx context.Context, jti, family, addr string, issuedAt time.Time) (bool, error) {
+	query := s.db.WithContext(ctx).Model(&Revocation{}).Where("kind = ? AND value = ? AND revoked_at > ?", RevokeAddress, addr, issuedAt)
+	if jti != "" {
+		query = query.Or("kind = ? AND value = ?", RevokeJTI, jti)
+	}
+	if family != "" {
+		query = query.Or("kind = ? AND value = ?", RevokeFamily, family)
+	}
+	var count int64
+	err := query.Count(&count).Error
+	return count > 0, err
+}
+
+func (s *GormStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	db := s.db.WithContext(ctx)
+	for _, model := range []interface{}{&RefreshToken{}, &Revocation{}, &AuthorizationCode{}, &FlowNonce{}} {
+		if err := db.Where("expires_at < ?", now).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *GormStore) CreateClient(ctx context.Context, client *OAuthClient) error {
+	return s.db.WithContext(ctx).Create(client).Error
+}
+
+func (s *GormStore) GetClient(ctx context.Context, clientID string) (*OAuthClient, error) {
+	client := &OAuthClient{}
+	result := s.db.WithContext(ctx).Where("client_id = ?", clientID).Limit(1).Find(client)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrClientNotFound
+	}
+	return client, nil
+}
+
+func (s *GormStore) CreateAuthorizationCode(ctx context.Context, code *AuthorizationCode) error {
+	return s.db.WithContext(ctx).Create(code).Error
+}
+
+// UseAuthorizationCode 与 UseRefreshToken 相同, 以 used_at IS NULL 为条件更新
+func (s *GormStore) UseAuthorizationCode(ctx context.Context, hash string) (*AuthorizationCode, error) {
+	db := s.db.WithContext(ctx)
+	result := db.Model(&AuthorizationCode{}).Where("hash = ? AND used_at IS NULL", hash).Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	code := &AuthorizationCode{}
+	found := db.Where("hash = ?", hash).Limit(1).Find(code)
+	if found.Error != nil {
+		return nil, found.Error
+	}
+	if found.RowsAffected == 0 {
+		return nil, ErrAuthorizationCodeNotFound
+	}
+	if result.RowsAffected == 0 {
+		return code, ErrAuthorizationCodeUsed
+	}
+	return code, nil
+}
+
+func (s *GormStore) SaveGrant(ctx context.Context, grant *ConsentGrant) error {
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "addr"}, {Name: "client_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"scope", "updated_at"}),
+	}).Create(grant).Error
+}
+
+func (s *GormStore) GetGrant(ctx context.Context, addr, clientID string) (*ConsentGrant, error) {
+	grant := &ConsentGrant{}
+	result := s.db.WithContext(ctx).Where("addr = ? AND client_id = ?", addr, clientID).Limit(1).Find(grant)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrGrantNotFound
+	}
+	return grant, nil
+}
+
+func (s *GormStore) ListGrants(ctx context.Context, addr string) ([]ConsentGrant, error) {
+	var grants []ConsentGrant
+	err := s.db.WithContext(ctx).Where("addr = ?", addr).Order("updated_at DESC").Find(&grants).Error
+	return grants, err
+}
+
+func (s *GormStore) ListClientGrants(ctx context.Context, clientID string, addrs []string) ([]ConsentGrant, error) {
+	var grants []ConsentGrant
+	err := s.db.WithContext(ctx).Where("client_id = ? AND addr IN ?", clientID, addrs).Find(&grants).Error
+	return grants, err
+}
+
+func (s *GormStore) DeleteGrant(ctx context.Context, addr, clientID string) error {
+	result := s.db.WithContext(ctx).Where("addr = ? AND client_id = ?", addr, clientID).Delete(&ConsentGrant{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrGrantNotFound
+	}
+	return nil
+}
+
+func (s *GormStore) CreateNonce(ctx context.Context, nonce *FlowNonce) error {
+	err := s.db.WithContext(ctx).Create(nonce).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrNonceExists
+	}
+	return err
+}
+
+// TakeNonce 先查询再按 id 删除, 删除成功的调用方取到 nonce
+func (s *GormStore) TakeNonce(ctx context.Context, nonce string) (*FlowNonce, error) {
+	db := s.db.WithContext(ctx)
+	found := &FlowNonce{}
+	result := db.Where("nonce = ?", nonce).Limit(1).Find(found)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNonceNotFound
+	}
+	deleted := db.Delete(&FlowNonce{}, found.ID)
+	if deleted.Error != nil {
+		return nil, deleted.Error
+	}
+	if deleted.RowsAffected == 0 || time.Now().After(found.ExpiresAt) {
+		return nil, ErrNonceNotFound
+	}
+	return found, nil
+}
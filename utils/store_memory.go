@@ -0,0 +1,442 @@
+package utils
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore 保存在内存中的 Store, 用于本地开发和测试, 重启后数据丢失
+type MemoryStore struct {
+	mu     sync.RWMutex
+	nextID uint64
+	// 以 addr 为 key, 地址统一转成小写, 与 MySQL 不区分大小写的比较保持一致
+	byAddr map[string]map[string]*LinkedIdentity
+	// refreshTokens 以 hash 为 key
+	refreshTokens map[string]*RefreshToken
+	// revocations 以 kind 和 value 为 key
+	revocations map[[2]string]*Revocation
+	// clients 以 client_id 为 key, codes 以 hash 为 key
+	clients map[string]*OAuthClient
+	codes   map[string]*AuthorizationCode
+	// grants 以小写的 addr 和 client_id 为 key
+	grants map[[2]string]*ConsentGrant
+	// nonces 以 nonce 为 key
+	nonces map[string]*FlowNonce
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		byAddr:        map[string]map[string]*LinkedIdentity{},
+		refreshTokens: map[string]*RefreshToken{},
+		revocations:   map[[2]string]*Revocation{},
+		clients:       map[string]*OAuthClient{},
+		codes:         map[string]*AuthorizationCode{},
+		grants:        map[[2]string]*ConsentGrant{},
+		nonces:        map[string]*FlowNonce{},
+	}
+}
+
+func (s *MemoryStore) GetByAddress(ctx context.Context, addr string) ([]LinkedIdentity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.list(strings.ToLower(addr), ""), nil
+}
+
+func (s *MemoryStore) GetByIdentity(ctx context.Context, provider, subject string) (*LinkedIdentity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if linked := s.findIdentity(provider, subject); linked != nil {
+		copied := *linked
+		return &copied, nil
+	}
+	return nil, ErrBindingNotFound
+}
+
+func (s *MemoryStore) Upsert(ctx context.Context, identity *LinkedIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := strings.ToLower(identity.Addr)
+	if bound := s.findIdentity(identity.Provider, identity.Subject); bound != nil && strings.ToLower(bound.Addr) != addr {
+		return ErrBindingConflict
+	}
+
+	now := time.Now()
+	identity.UpdatedAt = now
+	if existing, ok := s.byAddr[addr][identity.Provider]; ok {
+		identity.ID = existing.ID
+		identity.CreatedAt = existing.CreatedAt
+	} else {
+		s.nextID++
+		identity.ID = s.nextID
+		identity.CreatedAt = now
+	}
+	if s.byAddr[addr] == nil {
+		s.byAddr[addr] = map[string]*LinkedIdentity{}
+	}
+	copied := *identity
+	s.byAddr[addr][identity.Provider] = &copied
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, addr, provider string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr = strings.ToLower(addr)
+	if _, ok := s.byAddr[addr][provider]; !ok {
+		return ErrBindingNotFound
+	}
+	delete(s.byAddr[addr], provider)
+	if len(s.byAddr[addr]) == 0 {
+		delete(s.byAddr, addr)
+	}
+	return nil
+}
+
+func (s *MemoryStore) List(ctx context.Context, addrs []string, provider string) ([]LinkedIdentity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seen := map[string]bool{}
+	keys := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = strings.ToLower(addr)
+		if !seen[addr] {
+			seen[addr] = true
+			keys = append(keys, addr)
+		}
+	}
+	sort.Strings(keys)
+	var list []LinkedIdentity
+	for _, addr := range keys {
+		list = append(list, s.list(addr, provider)...)
+	}
+	return list, nil
+}
+
+func (s *MemoryStore) ListByProvider(ctx context.Context, provider string, afterID uint64, limit int) ([]LinkedIdentity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []LinkedIdentity
+	for _, providers := range s.byAddr {
+		if linked, ok := providers[provider]; ok && linked.ID > afterID {
+			list = append(list, *linked)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+func (s *MemoryStore) UpdateSubject(ctx context.Context, id uint64, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, providers := range s.byAddr {
+		for provider, linked := range providers {
+			if linked.ID != id {
+				continue
+			}
+			if bound := s.findIdentity(provider, subject); bound != nil && bound.ID != id {
+				return ErrBindingConflict
+			}
+			linked.Subject = subject
+			linked.LegacySubject = false
+			linked.UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return ErrBindingNotFound
+}
+
+// list 按 provider 排序返回地址的绑定, 调用方需要持有锁
+func (s *MemoryStore) list(addr, provider string) []LinkedIdentity {
+	var list []LinkedIdentity
+	for p, linked := range s.byAddr[addr] {
+		if provider == "" || p == provider {
+			list = append(list, *linked)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Provider < list[j].Provider })
+	return list
+}
+
+// findIdentity 调用方需要持有锁
+func (s *MemoryStore) findIdentity(provider, subject string) *LinkedIdentity {
+	for _, providers := range s.byAddr {
+		if linked, ok := providers[provider]; ok && linked.Subject == subject {
+			return linked
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	token.ID = s.nextID
+	token.CreatedAt = time.Now()
+	copied := *token
+	s.refreshTokens[token.Hash] = &copied
+	return nil
+}
+
+func (s *MemoryStore) UseRefreshToken(ctx context.Context, hash string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.refreshTokens[hash]
+	if !ok {
+		return nil, ErrRefreshTokenNotFound
+	}
+	if token.UsedAt != nil {
+		copied := *token
+		return &copied, ErrRefreshTokenReused
+	}
+	now := time.Now()
+	token.UsedAt = &now
+	copied := *token
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetRefreshToken(ctx context.Context, hash string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.refreshTokens[hash]
+	if !ok {
+		return nil, ErrRefreshTokenNotFound
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (s *MemoryStore) RevokeRefreshTokens(ctx context.Context, family, addr string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	seen := map[string]bool{}
+	var families []string
+	for _, token := range s.refreshTokens {
+		if token.RevokedAt != nil || family != "" && token.Family != family || addr != "" && !strings.EqualFold(token.Addr, addr) {
+			continue
+		}
+		token.RevokedAt = &now
+		if !seen[token.Family] {
+			seen[token.Family] = true
+			families = append(families, token.Family)
+		}
+	}
+	return families, nil
+}
+
+func (s *MemoryStore) RevokeClientRefreshTokens(ctx context.Context, clientID, addr string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	seen := map[string]bool{}
+	var families []string
+	for _, token := range s.refreshTokens {
+		if token.RevokedAt != nil || token.ClientID != clientID || !strings.EqualFold(token.Addr, addr) {
+			continue
+		}
+		token.RevokedAt = &now
+		if !seen[token.Family] {
+			seen[token.Family] = true
+			families = append(families, token.Family)
+		}
+	}
+	return families, nil
+}
+
+func (s *MemoryStore) Revoke(ctx context.Context, revocation *Revocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *revocation
+	s.revocations[[2]string{revocation.Kind, revocation.Value}] = &copied
+	return nil
+}
+
+func (s *MemoryStore) IsRevoked(ctx context.Context, jti, family, addr string, issuedAt time.Time) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if r, ok := s.revocations[[2]string{RevokeAddress, addr}]; ok && r.RevokedAt.After(issuedAt) {
+		return true, nil
+	}
+	if _, ok := s.revocations[[2]string{RevokeJTI, jti}]; ok && jti != "" {
+		return true, nil
+	}
+	if _, ok := s.revocations[[2]string{RevokeFamily, family}]; ok && family != "" {
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *MemoryStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, token := range s.refreshTokens {
+		if token.ExpiresAt.Before(now) {
+			delete(s.refreshTokens, hash)
+		}
+	}
+	for key, revocation := range s.revocations {
+		if revocation.ExpiresAt.Before(now) {
+			delete(s.revocations, key)
+		}
+	}
+	for hash, code := range s.codes {
+		if code.ExpiresAt.Before(now) {
+			delete(s.codes, hash)
+		}
+	}
+	for key, nonce := range s.nonces {
+		if nonce.ExpiresAt.Before(now) {
+			delete(s.nonces, key)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) CreateClient(ctx context.Context, client *OAuthClient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	client.ID = s.nextID
+	client.CreatedAt = time.Now()
+	copied := *client
+	s.clients[client.ClientID] = &copied
+	return nil
+}
+
+func (s *MemoryStore) GetClient(ctx context.Context, clientID string) (*OAuthClient, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	client, ok := s.clients[clientID]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	copied := *client
+	return &copied, nil
+}
+
+func (s *MemoryStore) CreateAuthorizationCode(ctx context.Context, code *AuthorizationCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	code.ID = s.nextID
+	code.CreatedAt = time.Now()
+	copied := *code
+	s.codes[code.Hash] = &copied
+	return nil
+}
+
+func (s *MemoryStore) UseAuthorizationCode(ctx context.Context, hash string) (*AuthorizationCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code, ok := s.codes[hash]
+	if !ok {
+		return nil, ErrAuthorizationCodeNotFound
+	}
+	if code.UsedAt != nil {
+		copied := *code
+		return &copied, ErrAuthorizationCodeUsed
+	}
+	now := time.Now()
+	code.UsedAt = &now
+	copied := *code
+	return &copied, nil
+}
+
+func (s *MemoryStore) SaveGrant(ctx context.Context, grant *ConsentGrant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := [2]string{strings.ToLower(grant.Addr), grant.ClientID}
+	now := time.Now()
+	if existing, ok := s.grants[key]; ok {
+		existing.Scope = grant.Scope
+		existing.UpdatedAt = now
+		*grant = *existing
+		return nil
+	}
+	s.nextID++
+	grant.ID = s.nextID
+	grant.CreatedAt = now
+	grant.UpdatedAt = now
+	copied := *grant
+	s.grants[key] = &copied
+	return nil
+}
+
+func (s *MemoryStore) GetGrant(ctx context.Context, addr, clientID string) (*ConsentGrant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	grant, ok := s.grants[[2]string{strings.ToLower(addr), clientID}]
+	if !ok {
+		return nil, ErrGrantNotFound
+	}
+	copied := *grant
+	return &copied, nil
+}
+
+func (s *MemoryStore) ListGrants(ctx context.Context, addr string) ([]ConsentGrant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var grants []ConsentGrant
+	for key, grant := range s.grants {
+		if key[0] == strings.ToLower(addr) {
+			grants = append(grants, *grant)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].UpdatedAt.After(grants[j].UpdatedAt) })
+	return grants, nil
+}
+
+func (s *MemoryStore) ListClientGrants(ctx context.Context, clientID string, addrs []string) ([]ConsentGrant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var grants []ConsentGrant
+	for _, addr := range addrs {
+		if grant, ok := s.grants[[2]string{strings.ToLower(addr), clientID}]; ok {
+			grants = append(grants, *grant)
+		}
+	}
+	return grants, nil
+}
+
+func (s *MemoryStore) DeleteGrant(ctx context.Context, addr, clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := [2]string{strings.ToLower(addr), clientID}
+	if _, ok := s.grants[key]; !ok {
+		return ErrGrantNotFound
+	}
+	delete(s.grants, key)
+	return nil
+}
+
+func (s *MemoryStore) CreateNonce(ctx context.Context, nonce *FlowNonce) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.nonces[nonce.Nonce]; ok {
+		return ErrNonceExists
+	}
+	s.nextID++
+	nonce.ID = s.nextID
+	copied := *nonce
+	s.nonces[nonce.Nonce] = &copied
+	return nil
+}
+
+func (s *MemoryStore) TakeNonce(ctx context.Context, nonce string) (*FlowNonce, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found, ok := s.nonces[nonce]
+	delete(s.nonces, nonce)
+	if !ok || time.Now().After(found.ExpiresAt) {
+		return nil, ErrNonceNotFound
+	}
+	copied := *found
+	return &copied, nil
+}
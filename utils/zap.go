@@ -8,12 +8,14 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-var Logger *zap.Logger
+// Logger utils 内部使用的 logger, 默认不输出, 由 main 替换为 NewLogger 创建的 logger
+var Logger = zap.NewNop()
 
-func init() {
+// NewLogger 创建同时输出到终端和日志文件 file 的 logger
+func NewLogger(file string) *zap.Logger {
 	// 创建一个 lumberjack 实例，用于处理日志文件的切分和删除
 	lj := &lumberjack.Logger{
-		Filename:   "logger.log",
+		Filename:   file,
 		MaxSize:    100, // 按大小切分，单位 MB
 		MaxBackups: 0,
 		MaxAge:     3,     // 保留最近 3 天的日志文件
@@ -40,5 +42,5 @@ func init() {
 	core := zapcore.NewTee(consoleCore, fileCore)
 
 	// 创建 logger
-	Logger = zap.New(core)
+	return zap.New(core)
 }